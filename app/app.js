@@ -163,18 +163,32 @@ async function uploadVideoFile(videoID) {
   setUploadButtonState(true, uploadBtnSelector);
 
   try {
-    const res = await fetch(`/api/video_upload/${videoID}`, {
+    let res = await fetch(`/api/video_upload/${videoID}`, {
       method: 'POST',
       headers: {
         Authorization: `Bearer ${localStorage.getItem('token')}`,
       },
       body: formData,
     });
+    if (res.status === 409 && confirm('This video already has a file. Replace it?')) {
+      res = await fetch(`/api/video_upload/${videoID}`, {
+        method: 'PUT',
+        headers: {
+          Authorization: `Bearer ${localStorage.getItem('token')}`,
+        },
+        body: formData,
+      });
+    }
     if (!res.ok) {
       const data = await res.json();
       throw new Error(`Failed to upload video file. Error: ${data.error}`);
     }
 
+    // 202 means the server is still processing; wait until it's done
+    if (res.status === 202) {
+      await waitForProcessing(videoID);
+    }
+
     console.log('Video uploaded!');
     await getVideo(videoID);
   } catch (error) {
@@ -184,11 +198,10 @@ async function uploadVideoFile(videoID) {
   setUploadButtonState(false, uploadBtnSelector);
 }
 
-const videoStateHandler = createVideoStateHandler();
-
-async function getVideos() {
-  try {
-    const res = await fetch('/api/videos', {
+async function waitForProcessing(videoID) {
+  for (;;) {
+    await new Promise((resolve) => setTimeout(resolve, 2000));
+    const res = await fetch(`/api/videos/${videoID}/status`, {
       method: 'GET',
       headers: {
         Authorization: `Bearer ${localStorage.getItem('token')}`,
@@ -196,10 +209,41 @@ async function getVideos() {
     });
     if (!res.ok) {
       const data = await res.json();
-      throw new Error(`Failed to get videos. Error: ${data.error}`);
+      throw new Error(`Failed to get video status. Error: ${data.error}`);
+    }
+    const { status } = await res.json();
+    if (status === 'ready') {
+      return;
+    }
+    if (status === 'failed') {
+      throw new Error('Video processing failed');
+    }
+  }
+}
+
+const videoStateHandler = createVideoStateHandler();
+
+async function getVideos() {
+  try {
+    // The list comes a page at a time; follow the cursors to the end
+    const videos = [];
+    let url = '/api/videos';
+    while (url) {
+      const res = await fetch(url, {
+        method: 'GET',
+        headers: {
+          Authorization: `Bearer ${localStorage.getItem('token')}`,
+        },
+      });
+      if (!res.ok) {
+        const data = await res.json();
+        throw new Error(`Failed to get videos. Error: ${data.error}`);
+      }
+      const page = await res.json();
+      videos.push(...page.videos);
+      url = page.next_cursor ? `/api/videos?cursor=${encodeURIComponent(page.next_cursor)}` : null;
     }
 
-    const videos = await res.json();
     const videoList = document.getElementById('video-list');
     videoList.innerHTML = '';
     for (const video of videos) {
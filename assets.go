@@ -1,9 +1,10 @@
 package main
 
 import (
-	"crypto/rand"
-	"encoding/base64"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"strings"
@@ -16,12 +17,58 @@ func (cfg apiConfig) ensureAssetsDir() error {
 	return nil
 }
 
-func getAssetPath(mediaType string) string {
-	ext := mediaTypeToExt(mediaType)
-	key := make([]byte, 32)
-	rand.Read(key)
-	b64 := base64.RawURLEncoding.EncodeToString(key)
-	return fmt.Sprintf("%s%s", b64, ext)
+// checkTempDir makes sure dir exists and files can be created in it. An
+// empty dir is the system default and isn't checked.
+func checkTempDir(dir string) error {
+	if dir == "" {
+		return nil
+	}
+	info, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+	probe, err := os.CreateTemp(dir, ".tubely-probe-*")
+	if err != nil {
+		return err
+	}
+	probe.Close()
+	return os.Remove(probe.Name())
+}
+
+// saveContentAddressedAsset stores src in the assets directory named by
+// the SHA-256 of its bytes, so identical files share one asset. If the
+// asset already exists the new copy is dropped. The file is written under
+// a temporary name and renamed into place, so concurrent uploads of the
+// same bytes never see a partial file; whichever rename lands last wins,
+// with identical contents.
+func (cfg apiConfig) saveContentAddressedAsset(src io.Reader, mediaType string) (string, error) {
+	tmp, err := os.CreateTemp(cfg.assetsRoot, ".upload-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+
+	hasher := sha256.New()
+	_, err = io.Copy(tmp, io.TeeReader(src, hasher))
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", err
+	}
+
+	assetPath := hex.EncodeToString(hasher.Sum(nil)) + mediaTypeToExt(mediaType)
+	diskPath := cfg.getAssetDiskPath(assetPath)
+	if _, err := os.Stat(diskPath); err == nil {
+		return assetPath, nil
+	}
+	if err := os.Rename(tmp.Name(), diskPath); err != nil {
+		return "", err
+	}
+	return assetPath, nil
 }
 
 func (cfg apiConfig) getAssetDiskPath(assetPath string) string {
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/credentials/ec2rolecreds"
+	"github.com/aws/aws-sdk-go-v2/credentials/endpointcreds"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+)
+
+// awsCredentialsConfig selects where the S3 client gets its credentials.
+// An empty source keeps the SDK's default chain (env, shared config, web
+// identity, ECS, EC2), which is what most deployments want.
+type awsCredentialsConfig struct {
+	source               string // "", "default", "static", "profile", "web_identity", "ec2", "ecs"
+	accessKeyID          string
+	secretAccessKey      string
+	sessionToken         string
+	profile              string
+	roleARN              string
+	webIdentityTokenFile string
+	roleSessionName      string
+	containerCredsURI    string
+}
+
+func awsCredentialsConfigFromEnv() awsCredentialsConfig {
+	containerURI := os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI")
+	if containerURI == "" {
+		if rel := os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"); rel != "" {
+			containerURI = "http://169.254.170.2" + rel
+		}
+	}
+	return awsCredentialsConfig{
+		source:               os.Getenv("AWS_CREDENTIALS_SOURCE"),
+		accessKeyID:          os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretAccessKey:      os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		sessionToken:         os.Getenv("AWS_SESSION_TOKEN"),
+		profile:              os.Getenv("AWS_PROFILE"),
+		roleARN:              os.Getenv("AWS_ROLE_ARN"),
+		webIdentityTokenFile: os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE"),
+		roleSessionName:      os.Getenv("AWS_ROLE_SESSION_NAME"),
+		containerCredsURI:    containerURI,
+	}
+}
+
+// loadAWSConfig builds the SDK config for the configured credentials source
+// and makes sure credentials actually resolve, so a misconfigured deployment
+// fails at startup rather than on the first upload.
+func loadAWSConfig(ctx context.Context, region string, creds awsCredentialsConfig) (aws.Config, error) {
+	opts := []func(*config.LoadOptions) error{config.WithRegion(region)}
+
+	switch creds.source {
+	case "", "default":
+	case "static":
+		if creds.accessKeyID == "" || creds.secretAccessKey == "" {
+			return aws.Config{}, fmt.Errorf("static credentials need AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+		}
+		opts = append(opts, config.WithCredentialsProvider(
+			credentials.NewStaticCredentialsProvider(creds.accessKeyID, creds.secretAccessKey, creds.sessionToken),
+		))
+	case "profile":
+		if creds.profile == "" {
+			return aws.Config{}, fmt.Errorf("profile credentials need AWS_PROFILE")
+		}
+		opts = append(opts, config.WithSharedConfigProfile(creds.profile))
+	case "web_identity":
+		if creds.roleARN == "" || creds.webIdentityTokenFile == "" {
+			return aws.Config{}, fmt.Errorf("web identity credentials need AWS_ROLE_ARN and AWS_WEB_IDENTITY_TOKEN_FILE")
+		}
+		// The STS call itself is unauthenticated, so a bare config is enough.
+		stsCfg, err := config.LoadDefaultConfig(ctx, config.WithRegion(region))
+		if err != nil {
+			return aws.Config{}, fmt.Errorf("load STS config: %w", err)
+		}
+		provider := stscreds.NewWebIdentityRoleProvider(
+			sts.NewFromConfig(stsCfg),
+			creds.roleARN,
+			stscreds.IdentityTokenFile(creds.webIdentityTokenFile),
+			func(o *stscreds.WebIdentityRoleOptions) {
+				if creds.roleSessionName != "" {
+					o.RoleSessionName = creds.roleSessionName
+				}
+			},
+		)
+		opts = append(opts, config.WithCredentialsProvider(aws.NewCredentialsCache(provider)))
+	case "ec2":
+		opts = append(opts, config.WithCredentialsProvider(aws.NewCredentialsCache(ec2rolecreds.New())))
+	case "ecs":
+		if creds.containerCredsURI == "" {
+			return aws.Config{}, fmt.Errorf("ecs credentials need AWS_CONTAINER_CREDENTIALS_RELATIVE_URI or AWS_CONTAINER_CREDENTIALS_FULL_URI")
+		}
+		opts = append(opts, config.WithCredentialsProvider(aws.NewCredentialsCache(endpointcreds.New(creds.containerCredsURI))))
+	default:
+		return aws.Config{}, fmt.Errorf("unknown AWS credentials source %q", creds.source)
+	}
+
+	awsCfg, err := config.LoadDefaultConfig(ctx, opts...)
+	if err != nil {
+		return aws.Config{}, fmt.Errorf("load AWS config: %w", err)
+	}
+
+	retrieveCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	if _, err := awsCfg.Credentials.Retrieve(retrieveCtx); err != nil {
+		return aws.Config{}, fmt.Errorf("resolve AWS credentials: %w", err)
+	}
+	return awsCfg, nil
+}
+
+// s3Context bounds an S3 call by S3_TIMEOUT, on top of any deadline or
+// cancellation ctx already carries.
+func (cfg *apiConfig) s3Context(ctx context.Context) (context.Context, context.CancelFunc) {
+	if cfg.s3Timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, cfg.s3Timeout)
+}
+
+func newS3Client(ctx context.Context, region string, creds awsCredentialsConfig) (*s3.Client, error) {
+	awsCfg, err := loadAWSConfig(ctx, region, creds)
+	if err != nil {
+		return nil, err
+	}
+	return s3.NewFromConfig(awsCfg), nil
+}
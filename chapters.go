@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+const ffmetadataHeader = ";FFMETADATA1"
+
+// parseChapters accepts either a JSON array of {start, end, title} objects
+// (seconds; end optional) or an ffmpeg ffmetadata file with [CHAPTER]
+// sections, and returns the chapters sorted by start.
+func parseChapters(data []byte) ([]database.Chapter, error) {
+	trimmed := bytes.TrimSpace(data)
+	var chapters []database.Chapter
+	switch {
+	case bytes.HasPrefix(trimmed, []byte("[")):
+		if err := json.Unmarshal(trimmed, &chapters); err != nil {
+			return nil, fmt.Errorf("invalid chapters JSON: %w", err)
+		}
+	case bytes.HasPrefix(trimmed, []byte(ffmetadataHeader)):
+		var err error
+		chapters, err = parseFFMetadataChapters(trimmed)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("chapters must be a JSON array or an ffmetadata file")
+	}
+	if len(chapters) == 0 {
+		return nil, fmt.Errorf("no chapters found")
+	}
+
+	sort.SliceStable(chapters, func(i, j int) bool { return chapters[i].Start < chapters[j].Start })
+	return chapters, nil
+}
+
+func parseFFMetadataChapters(data []byte) ([]database.Chapter, error) {
+	type rawChapter struct {
+		timebase   float64
+		start, end int64
+		hasEnd     bool
+		title      string
+	}
+	var raw []*rawChapter
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	var current *rawChapter
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		switch {
+		case text == "" || strings.HasPrefix(text, ";") || strings.HasPrefix(text, "#"):
+			continue
+		case strings.HasPrefix(text, "["):
+			current = nil
+			if strings.EqualFold(text, "[CHAPTER]") {
+				current = &rawChapter{timebase: 1.0 / 1000}
+				raw = append(raw, current)
+			}
+			continue
+		case current == nil:
+			// Global metadata or another section; not ours.
+			continue
+		}
+
+		key, value, ok := strings.Cut(text, "=")
+		if !ok {
+			return nil, fmt.Errorf("line %d: expected key=value", line)
+		}
+		var err error
+		switch strings.ToUpper(key) {
+		case "TIMEBASE":
+			num, den, ok := strings.Cut(value, "/")
+			n, errN := strconv.ParseFloat(num, 64)
+			d, errD := strconv.ParseFloat(den, 64)
+			if !ok || errN != nil || errD != nil || n <= 0 || d <= 0 {
+				return nil, fmt.Errorf("line %d: invalid TIMEBASE %q", line, value)
+			}
+			current.timebase = n / d
+		case "START":
+			current.start, err = strconv.ParseInt(value, 10, 64)
+		case "END":
+			current.end, err = strconv.ParseInt(value, 10, 64)
+			current.hasEnd = true
+		case "TITLE":
+			current.title = value
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid %s %q", line, key, value)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	chapters := make([]database.Chapter, 0, len(raw))
+	for _, rc := range raw {
+		ch := database.Chapter{
+			Start: float64(rc.start) * rc.timebase,
+			Title: rc.title,
+		}
+		if rc.hasEnd {
+			ch.End = float64(rc.end) * rc.timebase
+		}
+		chapters = append(chapters, ch)
+	}
+	return chapters, nil
+}
+
+// validateChapters fills in missing end times (next chapter's start, or
+// the end of the video) and checks every chapter lies within duration
+// without overlapping the next one. chapters must be sorted by start.
+func validateChapters(chapters []database.Chapter, duration float64) error {
+	for i := range chapters {
+		ch := &chapters[i]
+		if ch.End == 0 {
+			ch.End = duration
+			if i+1 < len(chapters) {
+				ch.End = chapters[i+1].Start
+			}
+		}
+		if strings.TrimSpace(ch.Title) == "" {
+			return fmt.Errorf("chapter %d has no title", i+1)
+		}
+		if ch.Start < 0 || ch.End <= ch.Start {
+			return fmt.Errorf("chapter %d %q has an invalid range %.3fs-%.3fs", i+1, ch.Title, ch.Start, ch.End)
+		}
+		if ch.End > duration {
+			return fmt.Errorf("chapter %d %q ends at %.3fs, after the video ends at %.3fs", i+1, ch.Title, ch.End, duration)
+		}
+		if i+1 < len(chapters) && ch.End > chapters[i+1].Start {
+			return fmt.Errorf("chapter %d %q overlaps the next chapter", i+1, ch.Title)
+		}
+	}
+	return nil
+}
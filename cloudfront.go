@@ -0,0 +1,119 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cloudFrontSigner signs URLs on a CloudFront distribution with a canned
+// policy, so videos are fetched through the CDN instead of straight from
+// S3. CloudFront decides which bucket backs the distribution; only the key
+// of a stored "bucket,key" is used.
+type cloudFrontSigner struct {
+	domain    string
+	keyPairID string
+	key       *rsa.PrivateKey
+}
+
+// cloudFrontSignerFromEnv reads CLOUDFRONT_KEY_PAIR_ID and
+// CLOUDFRONT_PRIVATE_KEY_FILE. It returns nil when neither is set, which
+// keeps S3 presigning; setting only one, or an unreadable key, is an error.
+func cloudFrontSignerFromEnv(domain string) (*cloudFrontSigner, error) {
+	keyPairID := os.Getenv("CLOUDFRONT_KEY_PAIR_ID")
+	keyFile := os.Getenv("CLOUDFRONT_PRIVATE_KEY_FILE")
+	if keyPairID == "" && keyFile == "" {
+		return nil, nil
+	}
+	if keyPairID == "" || keyFile == "" {
+		return nil, fmt.Errorf("CloudFront signing needs both CLOUDFRONT_KEY_PAIR_ID and CLOUDFRONT_PRIVATE_KEY_FILE")
+	}
+
+	dat, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("read CloudFront private key: %w", err)
+	}
+	key, err := parseRSAPrivateKey(dat)
+	if err != nil {
+		return nil, fmt.Errorf("parse CloudFront private key: %w", err)
+	}
+
+	// S3_CF_DISTRO may be a bare domain or a full URL
+	domain = strings.TrimSuffix(strings.TrimPrefix(strings.TrimPrefix(domain, "https://"), "http://"), "/")
+	return &cloudFrontSigner{domain: domain, keyPairID: keyPairID, key: key}, nil
+}
+
+// parseRSAPrivateKey accepts a PEM key in PKCS#1 ("RSA PRIVATE KEY"), the
+// format CloudFront generates, or PKCS#8.
+func parseRSAPrivateKey(dat []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(dat)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM block found")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("CloudFront keys must be RSA, got %T", parsed)
+	}
+	return key, nil
+}
+
+// sign returns a URL for key on the distribution that works until expires.
+func (s *cloudFrontSigner) sign(key string, expires time.Time) (string, error) {
+	resource := "https://" + s.domain + (&url.URL{Path: "/" + key}).EscapedPath()
+
+	type condition struct {
+		DateLessThan struct {
+			EpochTime int64 `json:"AWS:EpochTime"`
+		} `json:"DateLessThan"`
+	}
+	type statement struct {
+		Resource  string    `json:"Resource"`
+		Condition condition `json:"Condition"`
+	}
+	var stmt statement
+	stmt.Resource = resource
+	stmt.Condition.DateLessThan.EpochTime = expires.Unix()
+	policy, err := json.Marshal(struct {
+		Statement []statement `json:"Statement"`
+	}{[]statement{stmt}})
+	if err != nil {
+		return "", err
+	}
+
+	// CloudFront only verifies SHA-1 RSA signatures for canned policies
+	hash := sha1.Sum(policy)
+	sig, err := rsa.SignPKCS1v15(rand.Reader, s.key, crypto.SHA1, hash[:])
+	if err != nil {
+		return "", fmt.Errorf("sign CloudFront policy: %w", err)
+	}
+
+	query := url.Values{}
+	query.Set("Expires", strconv.FormatInt(expires.Unix(), 10))
+	query.Set("Signature", cloudFrontBase64(sig))
+	query.Set("Key-Pair-Id", s.keyPairID)
+	return resource + "?" + query.Encode(), nil
+}
+
+// cloudFrontBase64 is base64 with the characters that are invalid in a
+// query string swapped out, as CloudFront expects.
+func cloudFrontBase64(b []byte) string {
+	return strings.NewReplacer("+", "-", "=", "_", "/", "~").Replace(base64.StdEncoding.EncodeToString(b))
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+// videoEncoders maps the codec names clients may request to the ffmpeg
+// encoder that produces them. Only codecs that fit in an MP4 are listed.
+var videoEncoders = map[string]string{
+	"h264": "libx264",
+	"hevc": "libx265",
+	"vp9":  "libvpx-vp9",
+	"av1":  "libaom-av1",
+}
+
+// codecAllowlist is the set of codecs this deployment lets clients
+// request. Requests for anything else never reach ffmpeg.
+type codecAllowlist map[string]bool
+
+// encoderFor validates a requested codec and returns its ffmpeg encoder.
+// An empty request means keep the upload's codec, which is always allowed
+// and returns "".
+func (a codecAllowlist) encoderFor(codec string) (string, error) {
+	if codec == "" {
+		return "", nil
+	}
+	codec = strings.ToLower(codec)
+	encoder, known := videoEncoders[codec]
+	if !known || !a[codec] {
+		return "", fmt.Errorf("codec %q is not supported", codec)
+	}
+	return encoder, nil
+}
+
+// remuxStreams is the stream part of an ffmpeg remux: which tracks to
+// keep and whether to re-encode the video.
+type remuxStreams struct {
+	// Encoder re-encodes the video with this ffmpeg encoder; empty copies
+	// it as-is.
+	Encoder string
+	// AudioEncoder re-encodes the audio with this ffmpeg encoder; empty
+	// copies it as-is.
+	AudioEncoder string
+	// AudioLanguage keeps only audio tracks in this language; empty keeps
+	// every audio track.
+	AudioLanguage string
+}
+
+func (s remuxStreams) args() []string {
+	// Without -map ffmpeg keeps just one audio track
+	audio := "0:a?"
+	if s.AudioLanguage != "" {
+		audio = "0:a:m:language:" + s.AudioLanguage
+	}
+	args := []string{"-map", "0:v:0?", "-map", audio}
+	if s.Encoder == "" && s.AudioEncoder == "" {
+		return append(args, "-c", "copy")
+	}
+	return append(args, "-c:v", cmp.Or(s.Encoder, "copy"), "-c:a", cmp.Or(s.AudioEncoder, "copy"))
+}
+
+// playableEncoders picks the encoders that make an upload play everywhere
+// as MP4: H.264 video and AAC audio are copied, anything else is
+// re-encoded to them. A stream the upload doesn't have gets "".
+func playableEncoders(meta videoMetadata) (video, audio string) {
+	if meta.VideoCodec != "" && meta.VideoCodec != "h264" {
+		video = videoEncoders["h264"]
+	}
+	if meta.AudioCodec != "" && meta.AudioCodec != "aac" {
+		audio = "aac"
+	}
+	return video, audio
+}
+
+// audioLanguageFor picks the audio language to keep: the preferred one if
+// the upload has it, otherwise "" to keep every track.
+func audioLanguageFor(meta videoMetadata, preferred string) string {
+	if preferred == "" {
+		return ""
+	}
+	for _, language := range meta.AudioLanguages {
+		if language == preferred {
+			return preferred
+		}
+	}
+	log.Printf("no %q audio track among %v, keeping all tracks", preferred, meta.AudioLanguages)
+	return ""
+}
+
+// codecAllowlistFromEnv reads ALLOWED_OUTPUT_CODECS, a comma-separated
+// list that defaults to h264. Unknown names are logged and ignored.
+func codecAllowlistFromEnv() codecAllowlist {
+	raw := os.Getenv("ALLOWED_OUTPUT_CODECS")
+	if raw == "" {
+		raw = "h264"
+	}
+	allowed := codecAllowlist{}
+	for _, codec := range strings.Split(raw, ",") {
+		codec = strings.ToLower(strings.TrimSpace(codec))
+		if codec == "" {
+			continue
+		}
+		if _, known := videoEncoders[codec]; !known {
+			log.Printf("Ignoring unknown codec %q in ALLOWED_OUTPUT_CODECS", codec)
+			continue
+		}
+		allowed[codec] = true
+	}
+	return allowed
+}
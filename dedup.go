@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// duplicateUpload finds another video whose upload had the same content
+// hash and whose object is still in S3, so its processed file can be
+// reused. Only files processed with the default settings record their
+// hash, so a match is never a transcode to a requested codec or one with
+// audio tracks dropped. Lookup failures are logged and treated as no
+// match; the upload then just goes through processing as usual.
+func (cfg *apiConfig) duplicateUpload(ctx context.Context, contentHash string, videoID uuid.UUID) (database.Video, bool) {
+	source, err := cfg.db.GetVideoByContentHash(contentHash, videoID)
+	if err != nil {
+		cfg.logger.Error("looking up duplicate upload", "video_id", videoID, "content_hash", contentHash, "error", err)
+		return database.Video{}, false
+	}
+	if source.VideoURL == nil {
+		return database.Video{}, false
+	}
+
+	ctx, cancel := cfg.s3Context(ctx)
+	defer cancel()
+	exists, err := cfg.objectExists(ctx, *source.VideoURL)
+	if err != nil {
+		cfg.logger.Error("checking duplicate video in S3", "video_id", videoID, "source_id", source.ID, "error", err)
+		return database.Video{}, false
+	}
+	return source, exists
+}
+
+// reuseMedia points video at source's processed objects and copies what
+// was learned processing them.
+func reuseMedia(video *database.Video, source database.Video) {
+	video.VideoURL = source.VideoURL
+	video.ReplicaURL = source.ReplicaURL
+	video.IFrameURL = source.IFrameURL
+	video.HLSURL = source.HLSURL
+	video.Renditions = source.Renditions
+	video.AudioOnly = source.AudioOnly
+	video.QualityWarnings = source.QualityWarnings
+	video.AudioLanguages = source.AudioLanguages
+	video.Duration = source.Duration
+	video.Bitrate = source.Bitrate
+	video.ContentHash = source.ContentHash
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// The helpers below read optional settings. Unset values use the fallback;
+// values that fail to parse are logged and also use the fallback so a typo
+// never takes the server down.
+
+func envInt(key string, fallback int) int {
+	raw := os.Getenv(key)
+	if raw == "" {
+		return fallback
+	}
+	n, err := strconv.Atoi(raw)
+	if err != nil {
+		log.Printf("Invalid %s %q, using default %d", key, raw, fallback)
+		return fallback
+	}
+	return n
+}
+
+func envDuration(key string, fallback time.Duration) time.Duration {
+	raw := os.Getenv(key)
+	if raw == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(raw)
+	if err != nil {
+		log.Printf("Invalid %s %q, using default %s", key, raw, fallback)
+		return fallback
+	}
+	return d
+}
+
+func envFloat(key string, fallback float64) float64 {
+	raw := os.Getenv(key)
+	if raw == "" {
+		return fallback
+	}
+	f, err := strconv.ParseFloat(raw, 64)
+	if err != nil {
+		log.Printf("Invalid %s %q, using default %g", key, raw, fallback)
+		return fallback
+	}
+	return f
+}
+
+func envBool(key string, fallback bool) bool {
+	raw := os.Getenv(key)
+	if raw == "" {
+		return fallback
+	}
+	b, err := strconv.ParseBool(raw)
+	if err != nil {
+		log.Printf("Invalid %s %q, using default %t", key, raw, fallback)
+		return fallback
+	}
+	return b
+}
+
+// envUserIDs reads a comma-separated list of user IDs. These grant access,
+// so unlike the settings above a bad entry is an error rather than ignored.
+func envUserIDs(key string) (map[uuid.UUID]bool, error) {
+	users := map[uuid.UUID]bool{}
+	for _, raw := range strings.Split(os.Getenv(key), ",") {
+		raw = strings.TrimSpace(raw)
+		if raw == "" {
+			continue
+		}
+		userID, err := uuid.Parse(raw)
+		if err != nil {
+			return nil, fmt.Errorf("invalid user ID %q: %w", raw, err)
+		}
+		users[userID] = true
+	}
+	return users, nil
+}
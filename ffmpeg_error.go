@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"strings"
+)
+
+// ffmpegFailure says why an ffmpeg or ffprobe run failed, as far as can be
+// told from the outside.
+type ffmpegFailure string
+
+const (
+	// ffmpegNotFound means the binary isn't installed or isn't on PATH.
+	ffmpegNotFound ffmpegFailure = "not_found"
+	// ffmpegBadInput means the file couldn't be read as media.
+	ffmpegBadInput ffmpegFailure = "bad_input"
+	// ffmpegResources covers the failures isTransientFFmpegFailure retries:
+	// out of memory or disk, or killed.
+	ffmpegResources ffmpegFailure = "resources"
+	// ffmpegTimeout means the run was killed for taking too long.
+	ffmpegTimeout ffmpegFailure = "timeout"
+	ffmpegFailed  ffmpegFailure = "failed"
+)
+
+// badInputFFmpegErrors are stderr fragments, lowercased, that blame the
+// input file.
+var badInputFFmpegErrors = []string{
+	"invalid data found when processing input",
+	"moov atom not found",
+	"could not find codec parameters",
+	"invalid nal unit size",
+	"ebml header parsing failed",
+}
+
+// ffmpegError is a failed ffmpeg or ffprobe run with what it printed.
+type ffmpegError struct {
+	Command string
+	Args    []string
+	// ExitCode is -1 when the process never started or was killed.
+	ExitCode int
+	Stderr   string
+	Kind     ffmpegFailure
+	Err      error
+}
+
+// newFFmpegError describes cmd failing with err. ctx is the one cmd was
+// built with, to tell a timeout apart from other kills.
+func newFFmpegError(ctx context.Context, cmd *exec.Cmd, err error, stderr string) *ffmpegError {
+	e := &ffmpegError{
+		Command:  cmd.Path,
+		ExitCode: -1,
+		Stderr:   stderr,
+		Kind:     ffmpegFailed,
+		Err:      err,
+	}
+	if len(cmd.Args) > 0 {
+		e.Command = cmd.Args[0]
+		e.Args = cmd.Args[1:]
+	}
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		e.ExitCode = exitErr.ExitCode()
+	}
+	switch {
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		e.Kind = ffmpegTimeout
+	case errors.Is(err, exec.ErrNotFound):
+		e.Kind = ffmpegNotFound
+	case isTransientFFmpegFailure(err, stderr):
+		e.Kind = ffmpegResources
+	default:
+		lower := strings.ToLower(stderr)
+		for _, fragment := range badInputFFmpegErrors {
+			if strings.Contains(lower, fragment) {
+				e.Kind = ffmpegBadInput
+				break
+			}
+		}
+	}
+	return e
+}
+
+func (e *ffmpegError) Error() string {
+	if e.Kind == ffmpegTimeout {
+		return fmt.Sprintf("%s timed out: %v", e.Command, e.Err)
+	}
+	if e.Stderr == "" {
+		return fmt.Sprintf("%s: %v", e.Command, e.Err)
+	}
+	return fmt.Sprintf("%s: %v; stderr: %s", e.Command, e.Err, e.Stderr)
+}
+
+func (e *ffmpegError) Unwrap() error {
+	return e.Err
+}
+
+// Is lets errors.Is(err, context.DeadlineExceeded) find timeouts.
+func (e *ffmpegError) Is(target error) bool {
+	return target == context.DeadlineExceeded && e.Kind == ffmpegTimeout
+}
+
+// ffmpegProcessingError reports a failed probe or transcode of an upload.
+// A file ffmpeg can't read is the uploader's problem; anything else,
+// including a missing binary, is ours and gets msg.
+func ffmpegProcessingError(msg string, err error) *processingError {
+	var ferr *ffmpegError
+	if errors.As(err, &ferr) {
+		switch ferr.Kind {
+		case ffmpegBadInput:
+			return &processingError{code: http.StatusBadRequest, msg: "Video file is corrupt or not a supported format", err: err}
+		case ffmpegTimeout:
+			return &processingError{code: http.StatusUnprocessableEntity, msg: "Video took too long to process", err: err}
+		}
+	}
+	return &processingError{code: http.StatusInternalServerError, msg: msg, err: err}
+}
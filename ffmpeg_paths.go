@@ -0,0 +1,26 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"path/filepath"
+)
+
+// ffmpegPath makes a path safe to pass to ffmpeg or ffprobe as an input or
+// output. Local paths become absolute and get the "file:" protocol prefix,
+// so a name like "-i.mp4" can't be read as an option and a name containing
+// a colon can't be read as a protocol. http(s) URLs, such as presigned
+// object URLs, are passed through unchanged.
+func ffmpegPath(p string) (string, error) {
+	if p == "" {
+		return "", fmt.Errorf("empty media path")
+	}
+	if u, err := url.Parse(p); err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "" {
+		return p, nil
+	}
+	abs, err := filepath.Abs(p)
+	if err != nil {
+		return "", fmt.Errorf("resolve media path %q: %w", p, err)
+	}
+	return "file:" + abs, nil
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestFFmpegPath(t *testing.T) {
+	wd, err := filepath.Abs(".")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		path    string
+		want    string
+		wantErr bool
+	}{
+		{name: "empty", path: "", wantErr: true},
+		{name: "absolute", path: "/tmp/upload.mp4", want: "file:/tmp/upload.mp4"},
+		{name: "relative", path: "upload.mp4", want: "file:" + filepath.Join(wd, "upload.mp4")},
+		// Without the file: prefix these would be read as options or protocols
+		{name: "leading dash", path: "-i.mp4", want: "file:" + filepath.Join(wd, "-i.mp4")},
+		{name: "protocol lookalike", path: "concat:a.mp4|b.mp4", want: "file:" + filepath.Join(wd, "concat:a.mp4|b.mp4")},
+		{name: "colon in name", path: "/tmp/clip 10:30.mp4", want: "file:/tmp/clip 10:30.mp4"},
+		{name: "https URL", path: "https://bucket.s3.amazonaws.com/key.mp4?X-Amz-Signature=abc", want: "https://bucket.s3.amazonaws.com/key.mp4?X-Amz-Signature=abc"},
+		{name: "http URL", path: "http://localhost:9000/key.mp4", want: "http://localhost:9000/key.mp4"},
+		{name: "URL without host", path: "https:key.mp4", want: "file:" + filepath.Join(wd, "https:key.mp4")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ffmpegPath(tt.path)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("ffmpegPath(%q) error = nil, want an error", tt.path)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ffmpegPath(%q) error = %v", tt.path, err)
+			}
+			if got != tt.want {
+				t.Errorf("ffmpegPath(%q) = %q, want %q", tt.path, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// retryPolicy bounds how often a failed ffmpeg run or S3 call is retried.
+// Attempts counts every try, so 1 means no retries. The wait doubles after
+// each failure, starting at Backoff.
+type retryPolicy struct {
+	Attempts int
+	Backoff  time.Duration
+	// Timeout kills an ffmpeg run that takes longer, e.g. one stuck on a
+	// malformed file. Zero means no limit. S3 calls use S3_TIMEOUT instead.
+	Timeout time.Duration
+}
+
+// commandContext bounds one ffmpeg or ffprobe run by timeout, on top of
+// any deadline or cancellation ctx already carries. Zero means no limit.
+func commandContext(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// transientFFmpegErrors are stderr fragments that point at the machine
+// rather than the input: memory, disk space, file handles.
+var transientFFmpegErrors = []string{
+	"Cannot allocate memory",
+	"No space left on device",
+	"Resource temporarily unavailable",
+	"Too many open files",
+	"Disk quota exceeded",
+}
+
+// isTransientFFmpegFailure reports whether a failed run is worth retrying.
+// Being killed (usually by the OOM killer) counts as transient; anything
+// else, including invalid input, does not.
+func isTransientFFmpegFailure(err error, stderr string) bool {
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() && status.Signal() == syscall.SIGKILL {
+			return true
+		}
+	}
+	for _, fragment := range transientFFmpegErrors {
+		if strings.Contains(stderr, fragment) {
+			return true
+		}
+	}
+	return false
+}
+
+// runFFmpeg runs the command built by newCmd, retrying transient failures
+// according to policy. newCmd is called for every attempt because an
+// exec.Cmd can only run once; it must build the command with
+// exec.CommandContext and the given ctx, which is cancelled once the
+// attempt exceeds policy.Timeout. Its Stderr is set here. A run that times
+// out isn't retried: the same file would most likely hang again.
+func runFFmpeg(newCmd func(ctx context.Context) *exec.Cmd, policy retryPolicy) error {
+	wait := policy.Backoff
+	for attempt := 1; ; attempt++ {
+		ctx, cancel := commandContext(context.Background(), policy.Timeout)
+		cmd := newCmd(ctx)
+		var errBuf bytes.Buffer
+		cmd.Stderr = &errBuf
+
+		started := time.Now()
+		err := cmd.Run()
+		cancel()
+		slog.Debug("ran ffmpeg", "args", cmd.Args[1:], "attempt", attempt, "elapsed", time.Since(started), "error", err)
+		if err == nil {
+			return nil
+		}
+		ferr := newFFmpegError(ctx, cmd, err, errBuf.String())
+		if attempt >= policy.Attempts || ferr.Kind != ffmpegResources {
+			return ferr
+		}
+
+		slog.Warn("ffmpeg failed transiently, retrying", "attempt", attempt, "attempts", policy.Attempts, "wait", wait, "error", err)
+		time.Sleep(wait)
+		wait *= 2
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+)
+
+// handlerAdminFlushPresignCache forgets cached presigned URLs, e.g. after
+// rotating credentials, so the next read signs fresh ones. ?bucket= and
+// ?key= narrow it down; with neither, the whole cache is flushed. Only the
+// users in ADMIN_USERS may call it.
+func (cfg *apiConfig) handlerAdminFlushPresignCache(w http.ResponseWriter, r *http.Request) {
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret, cfg.jwtExpectations)
+	if err != nil {
+		respondWithJWTError(w, err)
+		return
+	}
+	if !cfg.adminUsers[userID] {
+		respondWithError(w, http.StatusForbidden, "Admin access required", nil)
+		return
+	}
+
+	bucket := r.URL.Query().Get("bucket")
+	key := r.URL.Query().Get("key")
+	if key != "" && bucket == "" {
+		respondWithError(w, http.StatusBadRequest, "key requires bucket", nil)
+		return
+	}
+
+	evicted := cfg.presignCache.flush(bucket, key)
+	cfg.logger.Info("flushed presign cache", "user_id", userID, "bucket", bucket, "key", key, "evicted", evicted)
+	respondWithJSON(w, http.StatusOK, struct {
+		Evicted int `json:"evicted"`
+	}{
+		Evicted: evicted,
+	})
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"path"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// reconcileAsset is one asset the database records for a video.
+type reconcileAsset struct {
+	Kind     string `json:"kind"`
+	Location string `json:"location"`
+	Exists   bool   `json:"exists"`
+}
+
+type reconcileReport struct {
+	VideoID  uuid.UUID        `json:"video_id"`
+	Prefixes []string         `json:"prefixes"`
+	Assets   []reconcileAsset `json:"assets"`
+	// Missing are recorded assets that aren't in storage.
+	Missing []string `json:"missing"`
+	// Orphaned are objects under the video's prefixes that nothing records.
+	Orphaned []string `json:"orphaned"`
+}
+
+// videoObjectStem is the part of a key shared by every object stored for
+// the same upload. Files beside the video share it up to their first dot,
+// as in "landscape/ab12.mp4" and "landscape/ab12.iframes.mp4"; renditions
+// and HLS streams live in a directory named after it, as in
+// "landscape/ab12/720p.mp4" and "landscape/ab12/hls/index.m3u8".
+func videoObjectStem(kind, key string) string {
+	switch kind {
+	case "rendition":
+		return path.Dir(key)
+	case "hls":
+		return path.Dir(path.Dir(key))
+	}
+	dir, base := path.Split(key)
+	stem, _, _ := strings.Cut(base, ".")
+	return dir + stem
+}
+
+// recordedObjects lists the S3 objects the database records for video,
+// keyed by "bucket,key", with what kind of asset each one is.
+func recordedObjects(video database.Video) map[string]string {
+	recorded := map[string]string{}
+	if video.VideoURL != nil {
+		recorded[*video.VideoURL] = "video"
+	}
+	if video.IFrameURL != nil {
+		recorded[*video.IFrameURL] = "iframes"
+	}
+	if video.HLSURL != nil {
+		recorded[*video.HLSURL] = "hls"
+	}
+	if video.ReplicaURL != nil {
+		recorded[*video.ReplicaURL] = "replica"
+	}
+	for _, rendition := range video.Renditions {
+		recorded[rendition.URL] = "rendition"
+	}
+	return recorded
+}
+
+// handlerAdminReconcileVideo cross-checks one video's recorded assets
+// against what is actually in storage and reports both missing and
+// orphaned objects. It only reports; nothing is changed.
+func (cfg *apiConfig) handlerAdminReconcileVideo(w http.ResponseWriter, r *http.Request) {
+	if cfg.platform != "dev" {
+		respondWithError(w, http.StatusForbidden, "Reconciliation is only allowed in dev environment", nil)
+		return
+	}
+
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return
+	}
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	// GetVideo reports a missing row as a zero Video, not an error
+	if video.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
+
+	report := reconcileReport{
+		VideoID:  videoID,
+		Prefixes: []string{},
+		Assets:   []reconcileAsset{},
+		Missing:  []string{},
+		Orphaned: []string{},
+	}
+	recorded := recordedObjects(video)
+
+	// Every bucket/prefix pair the recorded objects live under
+	type bucketPrefix struct{ bucket, prefix string }
+	var searched []bucketPrefix
+	seen := map[bucketPrefix]bool{}
+	// HLS segments aren't recorded one by one; everything beside a
+	// recorded manifest belongs to it
+	var hlsDirs []string
+	for location, kind := range recorded {
+		bucket, key, err := parseVideoLocation(location)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Invalid stored location", err)
+			return
+		}
+		stem := videoObjectStem(kind, key)
+		for _, prefix := range []string{stem + ".", stem + "/"} {
+			bp := bucketPrefix{bucket, prefix}
+			if !seen[bp] {
+				seen[bp] = true
+				searched = append(searched, bp)
+			}
+		}
+		if kind == "hls" {
+			hlsDirs = append(hlsDirs, bucket+","+path.Dir(key)+"/")
+		}
+	}
+
+	for _, bp := range searched {
+		report.Prefixes = append(report.Prefixes, bp.bucket+","+bp.prefix)
+		keys, err := listObjectKeys(r.Context(), cfg.s3ClientForBucket(bp.bucket), bp.bucket, bp.prefix)
+		if err != nil {
+			respondWithError(w, http.StatusBadGateway, "Couldn't list objects", err)
+			return
+		}
+		for _, key := range keys {
+			location := bp.bucket + "," + key
+			if _, ok := recorded[location]; ok {
+				continue
+			}
+			if slices.ContainsFunc(hlsDirs, func(dir string) bool { return strings.HasPrefix(location, dir) }) {
+				continue
+			}
+			report.Orphaned = append(report.Orphaned, location)
+		}
+	}
+
+	// Check the recorded objects directly rather than trusting the listing,
+	// which only covers their shared prefixes
+	locations := make([]string, 0, len(recorded))
+	for location := range recorded {
+		locations = append(locations, location)
+	}
+	found, err := cfg.objectsExist(r.Context(), locations, cfg.reconcileConcurrency)
+	if err != nil {
+		respondWithError(w, http.StatusBadGateway, "Couldn't check objects", err)
+		return
+	}
+	for location, kind := range recorded {
+		report.Assets = append(report.Assets, reconcileAsset{Kind: kind, Location: location, Exists: found[location]})
+		if !found[location] {
+			report.Missing = append(report.Missing, location)
+		}
+	}
+
+	// Thumbnails are local assets rather than S3 objects
+	if video.ThumbnailURL != nil {
+		asset := reconcileAsset{Kind: "thumbnail", Location: *video.ThumbnailURL}
+		if assetPath, err := thumbnailAssetPath(*video.ThumbnailURL); err == nil {
+			_, statErr := os.Stat(cfg.getAssetDiskPath(assetPath))
+			asset.Exists = !errors.Is(statErr, os.ErrNotExist)
+		}
+		report.Assets = append(report.Assets, asset)
+		if !asset.Exists {
+			report.Missing = append(report.Missing, asset.Location)
+		}
+	}
+
+	sort.Slice(report.Assets, func(i, j int) bool { return report.Assets[i].Location < report.Assets[j].Location })
+	sort.Strings(report.Prefixes)
+	sort.Strings(report.Missing)
+	sort.Strings(report.Orphaned)
+	respondWithJSON(w, http.StatusOK, report)
+}
+
+// s3ClientForBucket returns the client for the primary or secondary bucket.
+func (cfg *apiConfig) s3ClientForBucket(bucket string) *s3.Client {
+	if bucket == cfg.secondaryS3Bucket && cfg.secondaryS3Client != nil {
+		return cfg.secondaryS3Client
+	}
+	return cfg.s3Client
+}
+
+// listObjectKeys returns every key in bucket that starts with prefix.
+func listObjectKeys(ctx context.Context, client *s3.Client, bucket, prefix string) ([]string, error) {
+	var keys []string
+	paginator := s3.NewListObjectsV2Paginator(client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(bucket),
+		Prefix: aws.String(prefix),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, obj := range page.Contents {
+			keys = append(keys, aws.ToString(obj.Key))
+		}
+	}
+	return keys, nil
+}
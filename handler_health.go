@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// healthCheckTimeout bounds each dependency check, so a hung dependency
+// fails the check instead of the load balancer's request.
+const healthCheckTimeout = 2 * time.Second
+
+type dependencyHealth struct {
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+type healthReport struct {
+	Status       string                      `json:"status"`
+	Dependencies map[string]dependencyHealth `json:"dependencies"`
+}
+
+// handlerHealth reports whether the server can reach S3 and its database.
+// It answers 200 when both are reachable and 503 otherwise, with the state
+// of each in the body.
+func (cfg *apiConfig) handlerHealth(w http.ResponseWriter, r *http.Request) {
+	checks := map[string]func(ctx context.Context) error{
+		"s3": func(ctx context.Context) error {
+			_, err := cfg.s3Client.HeadBucket(ctx, &s3.HeadBucketInput{Bucket: aws.String(cfg.s3Bucket)})
+			return err
+		},
+		"database": cfg.db.Ping,
+	}
+
+	type result struct {
+		name string
+		err  error
+	}
+	results := make(chan result, len(checks))
+	for name, check := range checks {
+		go func() {
+			ctx, cancel := context.WithTimeout(r.Context(), healthCheckTimeout)
+			defer cancel()
+			results <- result{name, check(ctx)}
+		}()
+	}
+
+	report := healthReport{Status: "ok", Dependencies: map[string]dependencyHealth{}}
+	code := http.StatusOK
+	for range checks {
+		res := <-results
+		health := dependencyHealth{OK: res.err == nil}
+		if res.err != nil {
+			health.Error = res.err.Error()
+			report.Status = "unavailable"
+			code = http.StatusServiceUnavailable
+		}
+		report.Dependencies[res.name] = health
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	respondWithJSON(w, code, report)
+}
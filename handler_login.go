@@ -44,6 +44,7 @@ func (cfg *apiConfig) handlerLogin(w http.ResponseWriter, r *http.Request) {
 		user.ID,
 		cfg.jwtSecret,
 		time.Hour*24*30,
+		cfg.jwtExpectations,
 	)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Couldn't create access JWT", err)
@@ -59,7 +60,7 @@ func (cfg *apiConfig) handlerLogin(w http.ResponseWriter, r *http.Request) {
 	_, err = cfg.db.CreateRefreshToken(database.CreateRefreshTokenParams{
 		UserID:    user.ID,
 		Token:     refreshToken,
-		ExpiresAt: time.Now().UTC().Add(time.Hour * 24 * 60),
+		ExpiresAt: time.Now().UTC().Add(refreshTokenTTL),
 	})
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Couldn't save refresh token", err)
@@ -1,15 +1,27 @@
 package main
 
 import (
+	"errors"
 	"net/http"
 	"time"
 
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
 )
 
+// refreshTokenTTL is how long a refresh token can wait to be exchanged.
+// Each exchange issues a fresh one, so active sessions never run out.
+const refreshTokenTTL = 60 * 24 * time.Hour
+
+// handlerRefresh exchanges a refresh token for a new access token and a
+// new refresh token; the old one can't be used again. If a token that was
+// already exchanged comes back, someone else has a copy, so every token
+// descended from the same login is revoked and both holders must log in
+// again.
 func (cfg *apiConfig) handlerRefresh(w http.ResponseWriter, r *http.Request) {
 	type response struct {
-		Token string `json:"token"`
+		Token        string `json:"token"`
+		RefreshToken string `json:"refresh_token"`
 	}
 
 	refreshToken, err := auth.GetBearerToken(r.Header)
@@ -18,16 +30,53 @@ func (cfg *apiConfig) handlerRefresh(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	user, err := cfg.db.GetUserByRefreshToken(refreshToken)
+	stored, err := cfg.db.GetRefreshToken(refreshToken)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get refresh token", err)
+		return
+	}
+	// GetRefreshToken reports a missing token as a zero value
+	if stored.Token == "" {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't get user for refresh token", nil)
+		return
+	}
+
+	err = auth.ValidateRefreshToken(stored.ExpiresAt, stored.RevokedAt, stored.RotatedAt, time.Now())
+	if errors.Is(err, auth.ErrRefreshTokenReused) {
+		cfg.revokeReusedRefreshToken(stored)
+	}
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Refresh token not accepted", err)
+		return
+	}
+
+	nextToken, err := auth.MakeRefreshToken()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create refresh token", err)
+		return
+	}
+	rotated, err := cfg.db.RotateRefreshToken(refreshToken, database.CreateRefreshTokenParams{
+		Token:     nextToken,
+		UserID:    stored.UserID,
+		ExpiresAt: time.Now().UTC().Add(refreshTokenTTL),
+		FamilyID:  stored.FamilyID,
+	})
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Couldn't get user for refresh token", err)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't save refresh token", err)
+		return
+	}
+	// Another request exchanged the same token first
+	if !rotated {
+		cfg.revokeReusedRefreshToken(stored)
+		respondWithError(w, http.StatusUnauthorized, "Refresh token not accepted", auth.ErrRefreshTokenReused)
 		return
 	}
 
 	accessToken, err := auth.MakeJWT(
-		user.ID,
+		stored.UserID,
 		cfg.jwtSecret,
 		time.Hour,
+		cfg.jwtExpectations,
 	)
 	if err != nil {
 		respondWithError(w, http.StatusUnauthorized, "Couldn't validate token", err)
@@ -35,10 +84,20 @@ func (cfg *apiConfig) handlerRefresh(w http.ResponseWriter, r *http.Request) {
 	}
 
 	respondWithJSON(w, http.StatusOK, response{
-		Token: accessToken,
+		Token:        accessToken,
+		RefreshToken: nextToken,
 	})
 }
 
+// revokeReusedRefreshToken ends the session a replayed refresh token
+// belongs to.
+func (cfg *apiConfig) revokeReusedRefreshToken(token database.RefreshToken) {
+	cfg.logger.Warn("refresh token reused, revoking its family", "user_id", token.UserID)
+	if err := cfg.db.RevokeRefreshTokenFamily(token.FamilyID); err != nil {
+		cfg.logger.Error("revoking refresh token family", "user_id", token.UserID, "error", err)
+	}
+}
+
 func (cfg *apiConfig) handlerRevoke(w http.ResponseWriter, r *http.Request) {
 	refreshToken, err := auth.GetBearerToken(r.Header)
 	if err != nil {
@@ -46,7 +105,11 @@ func (cfg *apiConfig) handlerRevoke(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = cfg.db.RevokeRefreshToken(refreshToken)
+	// Logging out ends the session, including tokens rotated from this one
+	stored, err := cfg.db.GetRefreshToken(refreshToken)
+	if err == nil && stored.Token != "" {
+		err = cfg.db.RevokeRefreshTokenFamily(stored.FamilyID)
+	}
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Couldn't revoke session", err)
 		return
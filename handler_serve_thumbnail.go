@@ -0,0 +1,85 @@
+package main
+
+import (
+	"errors"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// thumbnailProxyURL is the stable URL clients see for a video's thumbnail,
+// whatever it's stored as.
+func thumbnailProxyURL(videoID uuid.UUID) string {
+	return "/api/thumbnails/" + videoID.String()
+}
+
+// thumbnailAssetPath extracts the asset file name from a stored thumbnail
+// URL such as "http://localhost:8091/assets/abc.png".
+func thumbnailAssetPath(thumbnailURL string) (string, error) {
+	_, assetPath, ok := strings.Cut(thumbnailURL, "/assets/")
+	if !ok || assetPath == "" || assetPath != path.Base(assetPath) {
+		return "", errors.New("thumbnail is not a local asset")
+	}
+	return assetPath, nil
+}
+
+// handlerServeThumbnail serves a video's thumbnail from the assets
+// directory. Thumbnails are named by the SHA-256 of their bytes (older
+// ones by a random name, which is just as unique), so the name doubles as
+// a strong ETag; http.ServeContent answers a matching If-None-Match with
+// a 304.
+func (cfg *apiConfig) handlerServeThumbnail(w http.ResponseWriter, r *http.Request) {
+	videoIDString := r.PathValue("videoID")
+	videoID, err := uuid.Parse(videoIDString)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "Couldn't get video", err)
+		return
+	}
+	if video.ThumbnailURL == nil {
+		respondWithError(w, http.StatusNotFound, "Video has no thumbnail", nil)
+		return
+	}
+
+	assetPath, err := thumbnailAssetPath(*video.ThumbnailURL)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Invalid stored thumbnail location", err)
+		return
+	}
+	f, err := os.Open(cfg.getAssetDiskPath(assetPath))
+	if errors.Is(err, os.ErrNotExist) {
+		respondWithError(w, http.StatusNotFound, "Thumbnail file is missing", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't open thumbnail", err)
+		return
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't read thumbnail", err)
+		return
+	}
+
+	if contentType := mime.TypeByExtension(filepath.Ext(assetPath)); contentType != "" {
+		w.Header().Set("Content-Type", contentType)
+	}
+	w.Header().Set("ETag", `"`+strings.TrimSuffix(assetPath, filepath.Ext(assetPath))+`"`)
+	// The URL stays the same when the thumbnail is replaced, so browsers
+	// must revalidate; the ETag makes that a cheap 304
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	http.ServeContent(w, r, assetPath, info.ModTime(), f)
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/google/uuid"
+)
+
+// maxHLSManifestSize caps how much of a stored manifest is read. A VOD
+// playlist is one short line per segment.
+const maxHLSManifestSize = 4 << 20
+
+// hlsManifestURL is where clients fetch a video's HLS manifest. The stored
+// manifest names its segments relative to itself, which a presigned URL
+// for the manifest alone can't serve, so it's handed out through here with
+// every segment signed.
+func hlsManifestURL(videoID uuid.UUID) string {
+	return "/api/videos/" + videoID.String() + "/hls/" + hlsManifestName
+}
+
+// rewriteHLSManifest replaces every segment URI in manifest with what sign
+// returns for it. Tags, comments and blank lines are copied as they are.
+func rewriteHLSManifest(manifest []byte, sign func(uri string) (string, error)) ([]byte, error) {
+	var out bytes.Buffer
+	scanner := bufio.NewScanner(bytes.NewReader(manifest))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			signed, err := sign(line)
+			if err != nil {
+				return nil, err
+			}
+			line = signed
+		}
+		out.WriteString(line)
+		out.WriteByte('\n')
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// handlerStreamHLS serves a video's HLS manifest with each segment
+// rewritten to its own signed URL. Segment URLs last as long as other
+// signed URLs, so players fetch the manifest again for a new set.
+func (cfg *apiConfig) handlerStreamHLS(w http.ResponseWriter, r *http.Request) {
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret, cfg.jwtExpectations)
+	if err != nil {
+		respondWithJWTError(w, err)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	// GetVideo reports a missing row as a zero Video, not an error
+	if video.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
+	if video.UserID != userID {
+		respondWithError(w, http.StatusUnauthorized, "Unauthorized", nil)
+		return
+	}
+	if video.HLSURL == nil {
+		respondWithError(w, http.StatusNotFound, "Video has no HLS stream", nil)
+		return
+	}
+
+	bucket, key, err := parseVideoLocation(*video.HLSURL)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Invalid stored location", err)
+		return
+	}
+	ctx, cancel := cfg.s3Context(r.Context())
+	defer cancel()
+	out, err := cfg.s3ClientForBucket(bucket).GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		respondWithError(w, http.StatusBadGateway, "Couldn't read HLS manifest", err)
+		return
+	}
+	manifest, err := io.ReadAll(io.LimitReader(out.Body, maxHLSManifestSize))
+	out.Body.Close()
+	if err != nil {
+		respondWithError(w, http.StatusBadGateway, "Couldn't read HLS manifest", err)
+		return
+	}
+
+	// One presigner signs every segment. They bypass the presign cache,
+	// which a long playlist would only fill up
+	presigner := s3.NewPresignClient(cfg.s3ClientForBucket(bucket))
+	expiry := min(cfg.presignExpiry, maxPresignExpiry)
+	dir := path.Dir(key) + "/"
+	rewritten, err := rewriteHLSManifest(manifest, func(uri string) (string, error) {
+		segmentKey := path.Join(dir, uri)
+		// Only segments stored beside the manifest are signed
+		if strings.Contains(uri, "://") || !strings.HasPrefix(segmentKey, dir) {
+			return "", fmt.Errorf("unexpected segment URI %q", uri)
+		}
+		signed, err := presigner.PresignGetObject(ctx, &s3.GetObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(segmentKey),
+		}, s3.WithPresignExpires(expiry))
+		if err != nil {
+			return "", fmt.Errorf("presign %s: %w", segmentKey, err)
+		}
+		return signed.URL, nil
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't sign HLS segments", err)
+		return
+	}
+
+	// The segment URLs are signed for this user, so nothing may cache them
+	w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+	w.Header().Set("Cache-Control", "private, no-store")
+	w.WriteHeader(http.StatusOK)
+	w.Write(rewritten)
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/google/uuid"
+)
+
+// streamPassthroughHeaders are owned by the object and the Range handling.
+// Configured headers never override them.
+var streamPassthroughHeaders = map[string]bool{
+	"Accept-Ranges":  true,
+	"Content-Length": true,
+	"Content-Range":  true,
+	"Content-Type":   true,
+	"Etag":           true,
+	"Last-Modified":  true,
+}
+
+func defaultStreamHeaders() http.Header {
+	h := http.Header{}
+	h.Set("X-Content-Type-Options", "nosniff")
+	h.Set("Cache-Control", "private, no-cache")
+	h.Set("Content-Security-Policy", "default-src 'none'")
+	return h
+}
+
+// streamHeadersFromEnv merges STREAM_RESPONSE_HEADERS, a JSON object of
+// header name to value, over the defaults. An empty value drops a default.
+func streamHeadersFromEnv() http.Header {
+	headers := defaultStreamHeaders()
+	raw := os.Getenv("STREAM_RESPONSE_HEADERS")
+	if raw == "" {
+		return headers
+	}
+
+	var configured map[string]string
+	if err := json.Unmarshal([]byte(raw), &configured); err != nil {
+		log.Printf("Invalid STREAM_RESPONSE_HEADERS, using defaults: %v", err)
+		return headers
+	}
+	for name, value := range configured {
+		name = http.CanonicalHeaderKey(name)
+		if streamPassthroughHeaders[name] {
+			log.Printf("Ignoring STREAM_RESPONSE_HEADERS entry %q: set from the object", name)
+			continue
+		}
+		if value == "" {
+			headers.Del(name)
+			continue
+		}
+		headers.Set(name, value)
+	}
+	return headers
+}
+
+// applyIfRange turns an If-Range validator into S3 preconditions so the
+// range is only served if the object is unchanged. A strong ETag becomes
+// IfMatch and an HTTP date becomes IfUnmodifiedSince. Weak or unparsable
+// validators can never match, so the range is dropped and the full object
+// is sent.
+func applyIfRange(input *s3.GetObjectInput, ifRange string) {
+	switch {
+	case ifRange == "":
+	case strings.HasPrefix(ifRange, `"`):
+		input.IfMatch = aws.String(ifRange)
+	default:
+		if t, err := http.ParseTime(ifRange); err == nil {
+			input.IfUnmodifiedSince = &t
+			return
+		}
+		input.Range = nil
+	}
+}
+
+func (cfg *apiConfig) handlerStreamVideo(w http.ResponseWriter, r *http.Request) {
+	videoIDString := r.PathValue("videoID")
+	videoID, err := uuid.Parse(videoIDString)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret, cfg.jwtExpectations)
+	if err != nil {
+		respondWithJWTError(w, err)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	// GetVideo reports a missing row as a zero Video, not an error
+	if video.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
+	if video.UserID != userID {
+		respondWithError(w, http.StatusUnauthorized, "Unauthorized", nil)
+		return
+	}
+	if video.VideoURL == nil {
+		respondWithError(w, http.StatusNotFound, "Video has no uploaded file", nil)
+		return
+	}
+
+	bucket, key, err := parseVideoLocation(*video.VideoURL)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Invalid stored video location", err)
+		return
+	}
+
+	rangeHeader, ifRange := r.Header.Get("Range"), r.Header.Get("If-Range")
+	out, err := getVideoObject(r.Context(), cfg.s3Client, bucket, key, rangeHeader, ifRange)
+	var apiErr smithy.APIError
+	invalidRange := err != nil && errors.As(err, &apiErr) && apiErr.ErrorCode() == "InvalidRange"
+	if err != nil && !invalidRange && video.ReplicaURL != nil && cfg.secondaryS3Client != nil {
+		// Only a failed read of the primary sends the stream to the replica
+		if replicaBucket, replicaKey, replicaErr := parseVideoLocation(*video.ReplicaURL); replicaErr == nil {
+			cfg.logger.Warn("primary object unreadable, streaming replica", "video_id", videoID, "bucket", bucket, "key", key, "error", err)
+			bucket, key = replicaBucket, replicaKey
+			out, err = getVideoObject(r.Context(), cfg.secondaryS3Client, bucket, key, rangeHeader, ifRange)
+			invalidRange = err != nil && errors.As(err, &apiErr) && apiErr.ErrorCode() == "InvalidRange"
+		}
+	}
+	if err != nil {
+		if invalidRange {
+			respondWithError(w, http.StatusRequestedRangeNotSatisfiable, "Requested range not satisfiable", err)
+			return
+		}
+		respondWithError(w, http.StatusBadGateway, "Couldn't fetch video from storage", err)
+		return
+	}
+	defer out.Body.Close()
+
+	for name, values := range cfg.streamHeaders {
+		w.Header()[name] = values
+	}
+	w.Header().Set("Accept-Ranges", "bytes")
+	if out.ContentType != nil {
+		w.Header().Set("Content-Type", *out.ContentType)
+	}
+	if out.ContentLength != nil {
+		w.Header().Set("Content-Length", strconv.FormatInt(*out.ContentLength, 10))
+	}
+	if out.ETag != nil {
+		w.Header().Set("ETag", *out.ETag)
+	}
+	if out.LastModified != nil {
+		w.Header().Set("Last-Modified", out.LastModified.UTC().Format(http.TimeFormat))
+	}
+
+	status := http.StatusOK
+	if out.ContentRange != nil {
+		w.Header().Set("Content-Range", *out.ContentRange)
+		status = http.StatusPartialContent
+	}
+	w.WriteHeader(status)
+
+	if r.Method == http.MethodHead {
+		return
+	}
+	body := newThrottledWriter(r.Context(), w, cfg.streamRateLimits.forUser(userID))
+	if _, err := io.Copy(body, out.Body); err != nil {
+		cfg.logger.Warn("streaming video interrupted", "video_id", videoID, "key", key, "error", err)
+	}
+}
+
+// getVideoObject fetches key from client, or the requested range of it.
+// When If-Range no longer matches, S3 refuses the conditional request and
+// the whole object is fetched instead, as HTTP says to.
+func getVideoObject(ctx context.Context, client *s3.Client, bucket, key, rangeHeader, ifRange string) (*s3.GetObjectOutput, error) {
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	}
+	if rangeHeader != "" {
+		input.Range = aws.String(rangeHeader)
+		applyIfRange(input, ifRange)
+	}
+
+	out, err := client.GetObject(ctx, input)
+	var apiErr smithy.APIError
+	if err != nil && errors.As(err, &apiErr) && apiErr.ErrorCode() == "PreconditionFailed" {
+		input.Range, input.IfMatch, input.IfUnmodifiedSince = nil, nil, nil
+		out, err = client.GetObject(ctx, input)
+	}
+	return out, err
+}
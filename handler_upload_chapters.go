@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+func (cfg *apiConfig) handlerUploadChapters(w http.ResponseWriter, r *http.Request) {
+	videoIDString := r.PathValue("videoID")
+	videoID, err := uuid.Parse(videoIDString)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret, cfg.jwtExpectations)
+	if err != nil {
+		respondWithJWTError(w, err)
+		return
+	}
+
+	cfg.logger.Info("uploading chapters", "video_id", videoID, "user_id", userID)
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error while getting video", err)
+		return
+	}
+	// GetVideo reports a missing row as a zero Video, not an error
+	if video.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
+	if userID != video.UserID {
+		respondWithError(w, http.StatusUnauthorized, "Unauthorized", err)
+		return
+	}
+	if video.VideoURL == nil {
+		respondWithError(w, http.StatusConflict, "Upload the video before its chapters", nil)
+		return
+	}
+
+	const maxMemory = 1 << 20
+	r.ParseMultipartForm(maxMemory)
+
+	// "chapters" should match the HTML form input name
+	file, _, err := r.FormFile("chapters")
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Unable to parse form file", err)
+		return
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(io.LimitReader(file, maxMemory))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Unable to read form file", err)
+		return
+	}
+
+	chapters, err := parseChapters(data)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error(), err)
+		return
+	}
+
+	// The duration is recorded at upload; only older videos need a probe
+	var duration float64
+	if video.Duration != nil {
+		duration = *video.Duration
+	} else {
+		releaseProbe, err := cfg.probeLimiter.acquire(r.Context())
+		if errors.Is(err, errPipelineSaturated) {
+			respondWithUnavailable(w, cfg.probeLimiter.retryAfter(), "Video processing is at capacity, try again later", err)
+			return
+		}
+		if err != nil {
+			respondWithError(w, http.StatusServiceUnavailable, "Request cancelled while waiting for processing", err)
+			return
+		}
+		duration, err = cfg.probeStoredDuration(r.Context(), video)
+		releaseProbe()
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "could not read video duration", err)
+			return
+		}
+	}
+
+	if err := validateChapters(chapters, duration); err != nil {
+		respondWithError(w, http.StatusUnprocessableEntity, err.Error(), err)
+		return
+	}
+
+	video.Chapters = chapters
+	err = cfg.db.UpdateVideo(video)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error while updating video", err)
+		return
+	}
+
+	signed, err := cfg.dbVideoToSignedVideo(r.Context(), video)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "failed to generate presigned video", err)
+		return
+	}
+	respondWithNegotiatedJSON(w, r, http.StatusOK, signed)
+}
+
+// probeStoredDuration runs ffprobe on a stored video, falling back to the
+// replica when the primary can't be read. ffprobe reads S3 through its own
+// presigned URL: the URLs handed to clients may be templated, CloudFront,
+// or the relative stream fallback, none of which it can fetch.
+func (cfg *apiConfig) probeStoredDuration(ctx context.Context, video database.Video) (float64, error) {
+	duration, err := cfg.probeObjectDuration(ctx, cfg.s3Client, *video.VideoURL)
+	if err == nil || errors.Is(err, errNoDuration) || video.ReplicaURL == nil || cfg.secondaryS3Client == nil {
+		return duration, err
+	}
+	cfg.logger.Warn("probing primary object failed, probing replica", "video_id", video.ID, "error", err)
+	return cfg.probeObjectDuration(ctx, cfg.secondaryS3Client, *video.ReplicaURL)
+}
+
+// probeObjectDuration runs ffprobe on the object at location in client's
+// region.
+func (cfg *apiConfig) probeObjectDuration(ctx context.Context, client *s3.Client, location string) (float64, error) {
+	bucket, key, err := parseVideoLocation(location)
+	if err != nil {
+		return 0, err
+	}
+	s3Ctx, cancel := cfg.s3Context(ctx)
+	signedURL, err := generatePresignedURL(s3Ctx, client, bucket, key, "", cfg.presignExpiry)
+	cancel()
+	if err != nil {
+		return 0, fmt.Errorf("presigning S3 URL: %w", err)
+	}
+
+	probeCtx, cancelProbe := commandContext(ctx, cfg.ffprobeTimeout)
+	defer cancelProbe()
+	return getVideoDuration(probeCtx, signedURL)
+}
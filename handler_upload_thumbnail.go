@@ -1,11 +1,10 @@
 package main
 
 import (
-	"fmt"
+	"errors"
 	"io"
 	"mime"
 	"net/http"
-	"os"
 
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
 	"github.com/google/uuid"
@@ -25,16 +24,33 @@ func (cfg *apiConfig) handlerUploadThumbnail(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
-	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret, cfg.jwtExpectations)
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		respondWithJWTError(w, err)
+		return
+	}
+	if !cfg.allowUpload(w, userID) {
 		return
 	}
 
+	logger := cfg.logger.With("video_id", videoID, "user_id", userID)
+	logger.Info("uploading thumbnail")
 
-	fmt.Println("uploading thumbnail for video", videoID, "by user", userID)
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error while getting video", err)
+		return
+	}
+	// GetVideo reports a missing row as a zero Video, not an error
+	if video.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
+	if userID != video.UserID {
+		respondWithError(w, http.StatusUnauthorized, "Unauthorized", nil)
+		return
+	}
 
-	// TODO: implement the upload here
 	const maxMemory = 10 << 20
 	r.ParseMultipartForm(maxMemory)
 
@@ -47,52 +63,62 @@ func (cfg *apiConfig) handlerUploadThumbnail(w http.ResponseWriter, r *http.Requ
 	defer file.Close()
 
 	mediaType := header.Header.Get("Content-Type")
+	if mediaType == "" && cfg.sniffThumbnailType {
+		mediaType, err = sniffContentType(file)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Unable to read thumbnail", err)
+			return
+		}
+	}
 	if mediaType == "" {
 		respondWithError(w, http.StatusBadRequest, "Missing Content-Type for thumbnail", nil)
 		return
 	}
-	mimeType, _, err:= mime.ParseMediaType(mediaType)
+	mimeType, _, err := mime.ParseMediaType(mediaType)
 	if err != nil {
 		respondWithError(w, http.StatusBadRequest, "Error parsing mime type", err)
 		return
 	}
-	if mimeType != "image/png" && mimeType != "image/jpeg" {
-		respondWithError(w, http.StatusBadRequest, "Wrong file type. Will only accept jpeg or png", err)
+	if mimeType != "image/png" && mimeType != "image/jpeg" && mimeType != "image/webp" && mimeType != "image/gif" {
+		respondWithError(w, http.StatusBadRequest, "Wrong file type. Will only accept png, jpeg, gif or webp", nil)
 		return
 	}
 
-	// fileData, err := io.ReadAll(file)
-	// if err != nil {
-	// 	respondWithError(w, http.StatusBadRequest, "Unable to read form file", err)
-	// 	return
-	// }
-
-	assetPath := getAssetPath(mediaType)
-	assetDiskPath := cfg.getAssetDiskPath(assetPath)
-
-	dst, err := os.Create(assetDiskPath)
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Unable to create file on server", err)
+	thumb, mimeType, size, err := fitThumbnail(file, mimeType, cfg.thumbnailMaxDimension)
+	if errors.Is(err, errThumbnailTooLarge) {
+		respondWithError(w, http.StatusBadRequest, "Thumbnail dimensions are too large", err)
 		return
 	}
-	defer dst.Close()
-	if _, err = io.Copy(dst, file); err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Error saving file", err)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Unable to decode thumbnail", err)
 		return
 	}
 
-	video, err := cfg.db.GetVideo(videoID)
+	// Re-uploads of the same image share one file. Use the parsed type so
+	// parameters like "; charset=" can't leak into the extension
+	assetPath, err := cfg.saveThumbnail(thumb, mimeType)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Error while getting video", err)
-		return
-	}
-	if userID != video.UserID {
-		respondWithError(w, http.StatusUnauthorized, "Unauthorized", err)
+		respondWithError(w, http.StatusInternalServerError, "Error saving file", err)
 		return
 	}
 
 	url := cfg.getAssetURL(assetPath)
 	video.ThumbnailURL = &url
+	video.ThumbnailWidth = &size.X
+	video.ThumbnailHeight = &size.Y
+	// An uploaded thumbnail isn't replaced by a new poster frame
+	video.PosterTimestamp = nil
+	// The placeholder is a nicety; a thumbnail it can't be made from is
+	// still saved without one
+	video.ThumbnailPlaceholder = nil
+	if _, err := thumb.Seek(0, io.SeekStart); err == nil {
+		placeholder, err := thumbnailPlaceholder(thumb)
+		if err != nil {
+			logger.Debug("no placeholder for thumbnail", "error", err)
+		} else {
+			video.ThumbnailPlaceholder = &placeholder
+		}
+	}
 
 	err = cfg.db.UpdateVideo(video)
 	if err != nil {
@@ -100,5 +126,25 @@ func (cfg *apiConfig) handlerUploadThumbnail(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
-	respondWithJSON(w, http.StatusOK, video)
+	videoUpdated, err := cfg.dbVideoToSignedVideo(r.Context(), video)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "failed to generate presigned video", err)
+		return
+	}
+
+	respondWithNegotiatedJSON(w, r, http.StatusOK, videoUpdated)
+}
+
+// sniffContentType guesses a file's media type from its first bytes and
+// rewinds it so the whole file can still be read.
+func sniffContentType(file io.ReadSeeker) (string, error) {
+	head := make([]byte, 512)
+	n, err := io.ReadFull(file, head)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return "", err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	return http.DetectContentType(head[:n]), nil
 }
@@ -1,22 +1,68 @@
 package main
 
 import (
+	"cmp"
 	"context"
-	"crypto/rand"
+	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
+	"log/slog"
+	"math"
 	"mime"
 	"net/http"
 	"os"
+	"strconv"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
 	"github.com/google/uuid"
 )
 
+// uploadAssets aggregates the URLs produced by an upload so clients don't
+// need follow-up calls. Anything that wasn't produced is left out.
+type uploadAssets struct {
+	Video     string `json:"video,omitempty"`
+	Thumbnail string `json:"thumbnail,omitempty"`
+	IFrames   string `json:"iframes,omitempty"`
+}
+
+type uploadReceipt struct {
+	database.Video
+	Assets uploadAssets `json:"assets"`
+}
+
+func newUploadReceipt(video database.Video) uploadReceipt {
+	receipt := uploadReceipt{Video: video}
+	if video.VideoURL != nil {
+		receipt.Assets.Video = *video.VideoURL
+	}
+	if video.ThumbnailURL != nil {
+		receipt.Assets.Thumbnail = *video.ThumbnailURL
+	}
+	if video.IFrameURL != nil {
+		receipt.Assets.IFrames = *video.IFrameURL
+	}
+	return receipt
+}
+
 func (cfg *apiConfig) handlerUploadVideo(w http.ResponseWriter, r *http.Request) {
+	cfg.uploadVideo(w, r, r.URL.Query().Get("overwrite") == "true")
+}
+
+// handlerReplaceVideo is the explicit way to upload over a video that
+// already has a file.
+func (cfg *apiConfig) handlerReplaceVideo(w http.ResponseWriter, r *http.Request) {
+	cfg.uploadVideo(w, r, true)
+}
+
+// uploadVideo processes and stores an uploaded video file. Unless
+// overwrite is set it refuses to replace a file the video already has.
+func (cfg *apiConfig) uploadVideo(w http.ResponseWriter, r *http.Request, overwrite bool) {
 	videoIDString := r.PathValue("videoID")
 	videoID, err := uuid.Parse(videoIDString)
 	if err != nil {
@@ -30,27 +76,58 @@ func (cfg *apiConfig) handlerUploadVideo(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret, cfg.jwtExpectations)
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		respondWithJWTError(w, err)
+		return
+	}
+	if !cfg.allowUpload(w, userID) {
 		return
 	}
 
-
-	fmt.Println("uploading video", videoID, "by user", userID)
+	started := time.Now()
+	logger := cfg.logger.With("video_id", videoID, "user_id", userID)
+	logger.Info("uploading video")
 
 	video, err := cfg.db.GetVideo(videoID)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Error while getting video", err)
 		return
 	}
+	// GetVideo reports a missing row as a zero Video, not an error
+	if video.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
 	if userID != video.UserID {
 		respondWithError(w, http.StatusUnauthorized, "Unauthorized", err)
 		return
 	}
+	if video.VideoURL != nil && !overwrite {
+		respondWithError(w, http.StatusConflict, "Video already has a file; replace it with PUT or ?overwrite=true", nil)
+		return
+	}
+
+	// Cap the body before anything reads it so an oversized upload can't
+	// fill the disk
+	if cfg.maxUploadSize > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, cfg.maxUploadSize)
+	}
+
+	// Trusted clients that already know the dimensions skip local
+	// processing; anyone else's upload is processed as usual
+	if r.Header.Get(directUploadDimensionsHeader) != "" && cfg.trustedUploader(userID) {
+		cfg.uploadVideoDirect(w, r, video)
+		return
+	}
+
+	timings := cfg.uploadTimingsFor(r)
 
 	const maxMemory = 1 << 30
-	r.ParseMultipartForm(maxMemory)
+	if err := r.ParseMultipartForm(maxMemory); isBodyTooLarge(err) {
+		respondWithError(w, http.StatusRequestEntityTooLarge, "Video is too large", err)
+		return
+	}
 
 	// "thumbnail" should match the HTML form input name
 	file, header, err := r.FormFile("video")
@@ -60,113 +137,681 @@ func (cfg *apiConfig) handlerUploadVideo(w http.ResponseWriter, r *http.Request)
 	}
 	defer file.Close()
 
-	mediaType := header.Header.Get("Content-Type")
+	// An optional "poster_timestamp" picks the second the poster is taken
+	// at, now and whenever the video is uploaded again
+	if raw := r.FormValue("poster_timestamp"); raw != "" {
+		at, err := strconv.ParseFloat(raw, 64)
+		if err != nil || !(at >= 0) || math.IsInf(at, 1) {
+			respondWithError(w, http.StatusBadRequest, "poster_timestamp must be a number of seconds", err)
+			return
+		}
+		video.PosterTimestamp = &at
+	}
+
+	// Identical uploads share a key: the client's Idempotency-Key when sent,
+	// otherwise the same user sending the same file to the same video
+	uploadKey := userID.String() + "/" + r.Header.Get("Idempotency-Key")
+	if r.Header.Get("Idempotency-Key") == "" {
+		uploadKey = fmt.Sprintf("%s/%s/%s/%d", userID, videoID, header.Filename, header.Size)
+	}
+
+	cfg.ingestVideo(w, r, videoUpload{
+		video:     video,
+		body:      file,
+		filename:  header.Filename,
+		mediaType: header.Header.Get("Content-Type"),
+		codec:     r.FormValue("codec"),
+		key:       uploadKey,
+		started:   started,
+		timings:   timings,
+		logger:    logger,
+	})
+}
+
+// videoUpload is a video file on its way in, however it was sent.
+type videoUpload struct {
+	video     database.Video
+	body      io.Reader
+	filename  string
+	mediaType string // the Content-Type it was sent with
+	codec     string // optional encoder to re-encode with
+	// key is the same for identical uploads, so only one runs at a time
+	key     string
+	started time.Time
+	timings *serverTimings
+	logger  *slog.Logger
+}
+
+// ingestVideo saves an incoming video file, checks it, and processes and
+// stores it, or queues it for processing when there are workers.
+func (cfg *apiConfig) ingestVideo(w http.ResponseWriter, r *http.Request, upload videoUpload) {
+	video, logger, timings := upload.video, upload.logger, upload.timings
+	videoID := video.ID
+
+	// The locks below are held until the upload is stored. A queued job
+	// is stored after this returns, so its worker releases them instead,
+	// along with the temp file.
+	var unlocks []func()
+	queued := false
+	defer func() {
+		if !queued {
+			releaseLocks(unlocks)
+		}
+	}()
+
+	releaseUpload, ok := cfg.inflightUploads.tryAcquire(upload.key)
+	if !ok {
+		respondWithError(w, http.StatusConflict, "An identical upload is already in progress", nil)
+		return
+	}
+	unlocks = append(unlocks, releaseUpload)
+
+	// Other instances may be handling the same upload; wait for them rather
+	// than processing it twice at once
+	unlockUpload, err := cfg.uploadLocker.Lock(r.Context(), upload.key)
+	if err != nil {
+		respondWithError(w, http.StatusServiceUnavailable, "Couldn't coordinate upload with other servers", err)
+		return
+	}
+	unlocks = append(unlocks, unlockUpload)
+
+	mediaType := upload.mediaType
 	if mediaType == "" {
 		respondWithError(w, http.StatusBadRequest, "Missing Content-Type for video", nil)
 		return
 	}
-	mimeType, _, err:= mime.ParseMediaType(mediaType)
+	mimeType, _, err := mime.ParseMediaType(mediaType)
 	if err != nil {
 		respondWithError(w, http.StatusBadRequest, "Error parsing mime type", err)
 		return
 	}
-	if mimeType != "video/mp4" {
-		respondWithError(w, http.StatusBadRequest, "Wrong file type. Will only accept mp4", err)
+	if !cfg.acceptedVideoTypes[mimeType] {
+		respondWithError(w, http.StatusBadRequest, "Unsupported video type "+mimeType, nil)
 		return
 	}
+	// Other containers are transcoded, so what's stored is always MP4
+	if !isMP4Type(mimeType) {
+		mediaType = "video/mp4"
+	}
 
-	tempVideoName := "tubely-upload.mp4"
-	dst, err := os.CreateTemp("", tempVideoName)
+	// An optional "codec" field asks for the video to be re-encoded
+	encoder, err := cfg.allowedCodecs.encoderFor(upload.codec)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Unsupported output codec", err)
+		return
+	}
+
+	// Any return before the file is stored marks the upload failed
+	stored := false
+	defer cfg.trackUploadStatus(&video, &stored)()
+
+	dst, err := os.CreateTemp(cfg.tempDir, "tubely-upload-*.mp4")
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Unable to create file on server", err)
 		return
 	}
-	defer os.Remove(tempVideoName)
+	// CreateTemp picks the name, so remove the file it actually created,
+	// unless it's been queued for processing
+	defer func() {
+		if !queued {
+			os.Remove(dst.Name())
+		}
+	}()
 	defer dst.Close()
 
-	if _, err = io.Copy(dst, file); err != nil {
+	// Hash while copying so the file is only read once
+	hasher := sha256.New()
+	written, err := io.Copy(dst, io.TeeReader(upload.body, hasher))
+	if isBodyTooLarge(err) {
+		respondWithError(w, http.StatusRequestEntityTooLarge, "Video is too large", err)
+		return
+	}
+	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Error saving file", err)
 		return
 	}
-
-	// Produce fast-start MP4 beside temp file
-	processedPath, err := processVideoForFastStart(dst.Name())
+	if written == 0 {
+		respondWithError(w, http.StatusBadRequest, "Uploaded video is an empty file", nil)
+		return
+	}
+	// Don't trust the Content-Type: junk never reaches ffprobe
+	container, err := sniffContainer(dst)
 	if err != nil {
-		_ = os.Remove(dst.Name())
-		respondWithError(w, http.StatusInternalServerError, "video processing failed", err)
+		respondWithError(w, http.StatusInternalServerError, "Error reading file", err)
+		return
+	}
+	if container == "" || container != videoTypeContainers[mimeType] {
+		respondWithError(w, http.StatusBadRequest, "Uploaded file is not a valid "+mimeType, nil)
 		return
 	}
-	_ = os.Remove(dst.Name())
+	// Make sure ffprobe/ffmpeg, which open the file by path, see every byte
+	if cfg.fsyncUploads {
+		if err := dst.Sync(); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Error flushing file", err)
+			return
+		}
+	}
+	contentHash := hex.EncodeToString(hasher.Sum(nil))
+	cfg.setVideoStatus(&video, database.VideoStatusProcessing)
 
-	f, err := os.Open(processedPath)
-	if err != nil {
-		_ = os.Remove(processedPath)
-		respondWithError(w, http.StatusInternalServerError, "could not open processed video", err)
+	// The same bytes processed with the default settings give the same
+	// objects, so point at those rather than processing again. A poster
+	// taken at a set time has to come from this upload, so that's only
+	// done without one
+	if cfg.dedupUploads && encoder == "" && video.PosterTimestamp == nil {
+		// Identical uploads to different videos have different upload
+		// keys; the one that gets here second waits until the first is
+		// stored, then reuses its objects instead of processing them too
+		unlockContent, err := cfg.uploadLocker.Lock(r.Context(), "content/"+contentHash)
+		if err != nil {
+			respondWithError(w, http.StatusServiceUnavailable, "Couldn't coordinate upload with other servers", err)
+			return
+		}
+		unlocks = append(unlocks, unlockContent)
+
+		if source, ok := cfg.duplicateUpload(r.Context(), contentHash, videoID); ok {
+			previous := video
+			reuseMedia(&video, source)
+			video.OriginalFilename = nil
+			if upload.filename != "" {
+				video.OriginalFilename = &upload.filename
+			}
+			// The objects are shared with source, so they're never deleted
+			// if this fails
+			if err := cfg.db.UpdateVideo(video); err != nil {
+				respondWithError(w, http.StatusInternalServerError, "Error while updating video", err)
+				return
+			}
+			if _, err := cfg.db.SetVideoRenditions(videoID, *video.VideoURL, video.Renditions); err != nil {
+				logger.Warn("copying renditions failed", "error", err)
+				video.Renditions = nil
+			}
+			if err := cfg.db.SetVideoReplicaURL(videoID, video.ReplicaURL); err != nil {
+				logger.Warn("copying replica failed", "error", err)
+				video.ReplicaURL = nil
+			}
+			cfg.deleteReplacedFiles(r.Context(), previous, video)
+			stored = true
+			cfg.setVideoStatus(&video, database.VideoStatusReady)
+			cfg.respondWithUploadedVideo(w, r, video, timings)
+			logger.Info("uploaded video", "size", written, "elapsed", time.Since(upload.started), "reused", source.ID)
+			return
+		}
+	}
+
+	job := uploadJob{
+		video:       video,
+		sourcePath:  dst.Name(),
+		filename:    upload.filename,
+		mimeType:    mimeType,
+		mediaType:   mediaType,
+		encoder:     encoder,
+		contentHash: contentHash,
+		size:        written,
+		started:     upload.started,
+		timings:     timings,
+		logger:      logger,
+	}
+
+	// With workers, processing happens after responding; the client polls
+	// the video's status
+	if cfg.videoQueue != nil {
+		// Nothing reads the timings once the response is sent
+		job.timings = nil
+		job.queued = true
+		job.unlock = func() { releaseLocks(unlocks) }
+		dst.Close()
+		cfg.processingProgress.queue(videoID)
+		if !cfg.videoQueue.enqueue(job) {
+			cfg.processingProgress.done(videoID)
+			respondWithUnavailable(w, cfg.processLimiter.retryAfter(), "Video processing is at capacity, try again later", nil)
+			return
+		}
+		queued = true
+		// The worker records how processing went
+		stored = true
+		videoSigned, err := cfg.dbVideoToSignedVideo(r.Context(), video)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "failed to generate presigned video", err)
+			return
+		}
+		w.Header().Set("Location", "/api/videos/"+videoID.String())
+		respondWithNegotiatedJSON(w, r, http.StatusAccepted, videoSigned)
 		return
 	}
-	defer f.Close()
 
-	// Get aspect ration
-	aspectRatio, err := getVideoAspectRatio(f.Name())
+	video, err = cfg.processUpload(r.Context(), job)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "could not extract aspect ratio", err)
+		respondWithProcessingError(w, err)
 		return
 	}
 
-	var orientation string
-	switch aspectRatio{
-	case "16:9":
-		orientation = "landscape"
-	case "9:16":
-		orientation = "portrait"
+	stored = true
+	cfg.setVideoStatus(&video, database.VideoStatusReady)
+	cfg.respondWithUploadedVideo(w, r, video, timings)
+}
+
+// processingError is a failed processing step and how to report it.
+type processingError struct {
+	code int
+	msg  string
+	err  error
+	// retryAfter is set when the pipeline is saturated.
+	retryAfter time.Duration
+}
+
+func (e *processingError) Error() string {
+	if e.err == nil {
+		return e.msg
+	}
+	return e.msg + ": " + e.err.Error()
+}
+
+func (e *processingError) Unwrap() error {
+	return e.err
+}
+
+// respondWithProcessingError reports a failed processUpload to the client.
+func respondWithProcessingError(w http.ResponseWriter, err error) {
+	var perr *processingError
+	switch {
+	case !errors.As(err, &perr):
+		respondWithError(w, http.StatusInternalServerError, "video processing failed", err)
+	case perr.retryAfter > 0:
+		respondWithUnavailable(w, perr.retryAfter, perr.msg, perr.err)
 	default:
-		orientation = "other"
+		respondWithError(w, perr.code, perr.msg, perr.err)
 	}
+}
 
-	// Reset pointer to the beginning so we can read from the start
-	if _, err := f.Seek(0, io.SeekStart); err != nil {
-		respondWithError(w, http.StatusInternalServerError, "could not reset file pointer", err)
-		return
+// uploadJob is a received upload waiting to be processed.
+type uploadJob struct {
+	video database.Video
+	// sourcePath is the uploaded file; processUpload removes it.
+	sourcePath  string
+	filename    string
+	mimeType    string
+	mediaType   string
+	encoder     string
+	contentHash string
+	size        int64
+	started     time.Time
+	timings     *serverTimings
+	logger      *slog.Logger
+	// queued jobs wait for processing slots rather than being turned
+	// away, and release the upload's locks through unlock when done.
+	queued bool
+	unlock func()
+}
+
+// releaseLocks runs unlock functions in the reverse of the order their
+// locks were taken.
+func releaseLocks(unlocks []func()) {
+	for i := len(unlocks) - 1; i >= 0; i-- {
+		unlocks[i]()
 	}
+}
 
-	// generate 16 random bytes (32 hex characters)
-	b := make([]byte, 16)
-	if _, err := rand.Read(b); err != nil {
-		respondWithError(w, http.StatusInternalServerError, "failed to generate random key", err)
-		return
+// processUpload probes, remuxes or transcodes, and stores an uploaded file,
+// then records it on the video and returns the updated video. It runs
+// either inside the upload request or on a processing worker.
+func (cfg *apiConfig) processUpload(ctx context.Context, job uploadJob) (database.Video, error) {
+	defer os.Remove(job.sourcePath)
+	video := job.video
+	mediaType := job.mediaType
+	cfg.processingProgress.start(video.ID)
+	defer cfg.processingProgress.done(video.ID)
+
+	// A queued job was already accepted, so it waits its turn however
+	// long the line; a request would rather be told to come back later
+	acquire := (*processLimiter).acquire
+	if job.queued {
+		acquire = (*processLimiter).wait
 	}
-	randomHex := hex.EncodeToString(b)
-	videoKey := orientation + "/" + randomHex + ".mp4"
 
-	// upload to S3
-	_, err = cfg.s3Client.PutObject(context.TODO(), &s3.PutObjectInput{
-		Bucket: aws.String(cfg.s3Bucket),
-		Key:    aws.String(videoKey),
-		Body:   f,
-		ContentType: aws.String(mediaType),
-	})
+	// Probing is cheap, so it has its own limit and never waits behind
+	// transcodes
+	releaseProbe, err := acquire(cfg.probeLimiter, ctx)
+	if errors.Is(err, errPipelineSaturated) {
+		return database.Video{}, &processingError{code: http.StatusServiceUnavailable, msg: "Video processing is at capacity, try again later", err: err, retryAfter: cfg.probeLimiter.retryAfter()}
+	}
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "upload to S3 failed", err)
-		return
+		return database.Video{}, &processingError{code: http.StatusServiceUnavailable, msg: "Request cancelled while waiting for processing", err: err}
+	}
+	// Get aspect ratio from the upload; remuxing doesn't change dimensions
+	stopProbe := job.timings.start("probe")
+	probeCtx, cancelProbe := commandContext(ctx, cfg.ffprobeTimeout)
+	meta, err := getVideoMetadata(probeCtx, job.sourcePath)
+	cancelProbe()
+	stopProbe()
+	releaseProbe()
+	if err != nil {
+		return database.Video{}, ffmpegProcessingError("could not extract video metadata", err)
 	}
+	cfg.processingProgress.probed(video.ID, meta.Duration)
+
+	if cfg.maxVideoFrames > 0 && meta.FrameCount > cfg.maxVideoFrames {
+		msg := fmt.Sprintf("Video has %d frames, more than the limit of %d", meta.FrameCount, cfg.maxVideoFrames)
+		return database.Video{}, &processingError{code: http.StatusUnprocessableEntity, msg: msg}
+	}
+
+	// Audio-only uploads are podcasts: no orientation, and served as audio
+	var orientation string
+	extension := fastStartExtension
+	switch {
+	case meta.AudioOnly:
+		orientation = "audio"
+		extension = ".m4a"
+		mediaType = "audio/mp4"
+	default:
+		orientation = cfg.orientationPrefix(meta.DisplayWidth, meta.DisplayHeight)
+	}
+
+	release, err := acquire(cfg.processLimiter, ctx)
+	if errors.Is(err, errPipelineSaturated) {
+		return database.Video{}, &processingError{code: http.StatusServiceUnavailable, msg: "Video processing is at capacity, try again later", err: err, retryAfter: cfg.processLimiter.retryAfter()}
+	}
+	if err != nil {
+		return database.Video{}, &processingError{code: http.StatusServiceUnavailable, msg: "Request cancelled while waiting for processing", err: err}
+	}
+	defer release()
+
+	randomKey, err := cfg.objectKeys.newKey()
+	if err != nil {
+		return database.Video{}, &processingError{code: http.StatusInternalServerError, msg: "failed to generate random key", err: err}
+	}
+	// Both processing paths remux into fastStartMuxer, whatever came in
+	videoKey := orientation + "/" + randomKey + extension
+
+	// Nothing references what's stored from here on until the video row
+	// is updated, so any failure before that deletes it again
+	var videoUrl, iframeLocation, hlsLocation, posterURL string
+	keepObjects := false
+	defer func() {
+		if keepObjects {
+			return
+		}
+		cfg.deleteUploadedObjects(videoUrl, iframeLocation)
+		if hlsLocation != "" {
+			ctx, cancel := cfg.s3Context(context.Background())
+			if err := cfg.deleteHLS(ctx, hlsLocation); err != nil {
+				job.logger.Error("couldn't delete orphaned HLS stream", "location", hlsLocation, "error", err)
+			}
+			cancel()
+		}
+		if posterURL != "" {
+			cfg.deleteThumbnail(job.logger, video.ID, posterURL)
+		}
+	}()
+
+	// Quality problems are reported on the video, never rejected
+	var qualityWarnings []string
+	if cfg.qualityAnalysis {
+		stopAnalysis := job.timings.start("analysis")
+		analysisCtx, cancelAnalysis := commandContext(ctx, cfg.ffmpegRetry.Timeout)
+		qualityWarnings, err = analyzeQuality(analysisCtx, job.sourcePath, meta, cfg.qualityThresholds, cfg.ffmpegThreads)
+		cancelAnalysis()
+		stopAnalysis()
+		if err != nil {
+			job.logger.Warn("skipping quality analysis", "error", err)
+		}
+	}
+
+	// The preview track is optional; the upload goes ahead without it
+	if cfg.iframeInterval > 0 && !meta.AudioOnly {
+		iframeKey := orientation + "/" + randomKey + ".iframes.mp4"
+		stopIFrames := job.timings.start("iframes")
+		iframeLocation, err = cfg.uploadIFrameTrack(ctx, job.sourcePath, iframeKey)
+		stopIFrames()
+		if err != nil {
+			job.logger.Warn("skipping I-frame preview", "error", err)
+		}
+	}
+
+	// HLS is optional too; progressive playback still works without it
+	if cfg.hlsSegmentDuration > 0 {
+		stopHLS := job.timings.start("hls")
+		hlsLocation, err = cfg.uploadHLS(ctx, job.sourcePath, orientation+"/"+randomKey+"/hls/")
+		stopHLS()
+		if err != nil {
+			job.logger.Warn("skipping HLS", "error", err)
+		}
+	}
+
+	// Videos nobody gave a thumbnail get a poster frame, and a poster taken
+	// at a known time is taken again from the new file; clips too short
+	// for the offset just go without. Any other failure only fails the
+	// upload with strictPosters
+	wantsPoster := video.ThumbnailURL == nil && cfg.posterOffset.enabled()
+	if (wantsPoster || video.PosterTimestamp != nil) && !meta.AudioOnly {
+		stopPoster := job.timings.start("poster")
+		assetPath, posterTimestamp, err := cfg.savePoster(ctx, job.sourcePath, meta.Duration, video.PosterTimestamp)
+		stopPoster()
+		posterSkippable := errors.Is(err, errPosterOutOfRange) || errors.Is(err, errNoDuration)
+		if err != nil && cfg.strictPosters && !posterSkippable {
+			return database.Video{}, ffmpegProcessingError("could not generate poster", err)
+		}
+		if err != nil {
+			job.logger.Warn("skipping poster", "error", err)
+		} else {
+			thumbnailURL := cfg.getAssetURL(assetPath)
+			// An identical frame shares the file the video already uses,
+			// which a failed upload mustn't delete
+			if video.ThumbnailURL == nil || *video.ThumbnailURL != thumbnailURL {
+				posterURL = thumbnailURL
+			}
+			video.ThumbnailURL = &thumbnailURL
+			video.PosterTimestamp = posterTimestamp
+			video.ThumbnailWidth, video.ThumbnailHeight = nil, nil
+			video.ThumbnailPlaceholder = nil
+			if poster, err := os.Open(cfg.getAssetDiskPath(assetPath)); err == nil {
+				if placeholder, err := thumbnailPlaceholder(poster); err == nil {
+					video.ThumbnailPlaceholder = &placeholder
+				}
+				poster.Close()
+			}
+		}
+	}
+
+	streams := remuxStreams{
+		Encoder:       job.encoder,
+		AudioLanguage: audioLanguageFor(meta, cfg.audioLanguage),
+	}
+	// Non-MP4 uploads may have codecs an MP4 can't hold at all
+	if cfg.transcodeToPlayable || !isMP4Type(job.mimeType) {
+		// A requested codec wins over the automatic choice
+		videoEncoder, audioEncoder := playableEncoders(meta)
+		streams.Encoder = cmp.Or(streams.Encoder, videoEncoder)
+		streams.AudioEncoder = audioEncoder
+	}
+
+	// Renditions are made from the original after the video is stored, so
+	// keep a link to it that outlives the source file
+	var renditionSource string
+	if len(cfg.renditionHeights) > 0 && !meta.AudioOnly {
+		renditionSource = job.sourcePath + ".renditions"
+		if err := os.Link(job.sourcePath, renditionSource); err != nil {
+			job.logger.Warn("skipping renditions", "error", err)
+			renditionSource = ""
+		}
+	}
+	// Removed here unless it was handed to generateRenditions
+	defer func() {
+		if renditionSource != "" {
+			os.Remove(renditionSource)
+		}
+	}()
+
+	uploaded := false
+	if cfg.pipeFastStartToS3 {
+		// Transcoding and uploading overlap here, so they're timed together
+		stopPipe := job.timings.start("transcode_upload")
+		err = cfg.processVideoForFastStartToS3(ctx, job.sourcePath, videoKey, mediaType, streams)
+		stopPipe()
+		if err == nil {
+			uploaded = true
+			_ = os.Remove(job.sourcePath)
+		} else {
+			job.logger.Warn("piped faststart upload failed, falling back to temp file", "error", err)
+		}
+	}
+
+	if !uploaded {
+		// Produce fast-start MP4 beside temp file
+		stopTranscode := job.timings.start("transcode")
+		processedPath, err := processVideoForFastStart(cfg.tempDir, job.sourcePath, cfg.ffmpegThreads, cfg.fastStartMode, cfg.ffmpegRetry, streams)
+		stopTranscode()
+		if err != nil {
+			_ = os.Remove(job.sourcePath)
+			return database.Video{}, ffmpegProcessingError("video processing failed", err)
+		}
+		_ = os.Remove(job.sourcePath)
+		defer os.Remove(processedPath)
+
+		f, err := os.Open(processedPath)
+		if err != nil {
+			return database.Video{}, &processingError{code: http.StatusInternalServerError, msg: "could not open processed video", err: err}
+		}
+		defer f.Close()
+
+		info, err := f.Stat()
+		if err != nil {
+			return database.Video{}, &processingError{code: http.StatusInternalServerError, msg: "could not stat processed video", err: err}
+		}
+
+		// upload to S3; large files go in parts so a network blip only
+		// costs one part rather than the whole upload
+		stopUpload := job.timings.start("upload")
+		uploadCtx, cancel := cfg.s3Context(ctx)
+		defer cancel()
+		if info.Size() > cfg.multipartThreshold {
+			err = cfg.uploadMultipart(uploadCtx, videoKey, mediaType, f, info.Size())
+		} else {
+			err = cfg.putObject(uploadCtx, videoKey, mediaType, f)
+		}
+		stopUpload()
+		if err != nil {
+			return database.Video{}, &processingError{code: http.StatusInternalServerError, msg: "upload to S3 failed", err: err}
+		}
+	}
+	// Stored as bucket,key so it can be presigned
+	videoUrl = cfg.s3Bucket + "," + videoKey
 
 	// update the video URL
-	// videoUrl := fmt.Sprintf("https://%s.s3.%s.amazonaws.com/%s", cfg.s3Bucket, cfg.s3Region, videoKey)
-	videoUrl := cfg.s3Bucket + "," + videoKey
 	video.VideoURL = &videoUrl
+	video.OriginalFilename = nil
+	if job.filename != "" {
+		video.OriginalFilename = &job.filename
+	}
+	video.IFrameURL = nil
+	if iframeLocation != "" {
+		video.IFrameURL = &iframeLocation
+	}
+	video.HLSURL = nil
+	if hlsLocation != "" {
+		video.HLSURL = &hlsLocation
+	}
+	video.AudioOnly = meta.AudioOnly
+	video.QualityWarnings = qualityWarnings
+	video.AudioLanguages = meta.AudioLanguages
+	if streams.AudioLanguage != "" {
+		video.AudioLanguages = []string{streams.AudioLanguage}
+	}
+	video.Duration = nil
+	if meta.Duration > 0 {
+		video.Duration = &meta.Duration
+	}
+	video.Bitrate = nil
+	if meta.Bitrate > 0 {
+		video.Bitrate = &meta.Bitrate
+	}
+	// Only what the default pipeline made can stand in for a later upload
+	// of the same bytes
+	video.ContentHash = nil
+	if job.encoder == "" && streams.AudioLanguage == "" {
+		video.ContentHash = &job.contentHash
+	}
 
 	err = cfg.db.UpdateVideo(video)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Error while updating video", err)
-		return
+		// Left for reconciliation if asked to, rather than deleted
+		keepObjects = cfg.keepObjectsOnDBFailure
+		return database.Video{}, &processingError{code: http.StatusInternalServerError, msg: "Error while updating video", err: err}
 	}
+	keepObjects = true
+	cfg.clearFileRecords(&video)
+	cfg.deleteReplacedFiles(ctx, job.video, video)
+	if previous := job.video.ThumbnailURL; previous != nil && posterURL != "" {
+		cfg.deleteThumbnail(job.logger, video.ID, *previous)
+	}
+	cfg.replicateVideo(video.ID, videoKey)
+	if renditionSource != "" {
+		cfg.generateRenditions(video.ID, videoUrl, renditionSource, orientation+"/"+randomKey, meta.DisplayWidth, meta.DisplayHeight)
+		renditionSource = ""
+	}
+
+	job.logger.Info("processed video", "size", job.size, "elapsed", time.Since(job.started), "key", videoKey)
+	return video, nil
+}
 
-	videoUpdated, err := cfg.dbVideoToSignedVideo(video)
+// respondWithUploadedVideo sends the 201 receipt for a video whose file
+// has just been stored.
+func (cfg *apiConfig) respondWithUploadedVideo(w http.ResponseWriter, r *http.Request, video database.Video, timings *serverTimings) {
+	videoUpdated, err := cfg.dbVideoToSignedVideo(r.Context(), video)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "failed to generate presigned video", err)
 		return
 	}
-	respondWithJSON(w, http.StatusOK, videoUpdated)
-	fmt.Println("uploaded video", videoID, "by user", userID)
+	w.Header().Set("Location", "/api/videos/"+video.ID.String())
+	timings.write(w)
+	respondWithNegotiatedJSON(w, r, http.StatusCreated, newUploadReceipt(videoUpdated))
 }
 
+// deleteUploadedObjects removes objects stored by an upload that failed
+// afterwards. Failures are only logged; the reconciliation job is the
+// backstop for anything left behind.
+func (cfg *apiConfig) deleteUploadedObjects(locations ...string) {
+	for _, location := range locations {
+		if location == "" {
+			continue
+		}
+		bucket, key, err := parseVideoLocation(location)
+		if err != nil {
+			cfg.logger.Error("not deleting orphaned object", "location", location, "error", err)
+			continue
+		}
+		// The request may already be gone, so this doesn't use its context
+		ctx, cancel := cfg.s3Context(context.Background())
+		_, err = cfg.s3Client.DeleteObject(ctx, &s3.DeleteObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(key),
+		})
+		cancel()
+		if err != nil {
+			cfg.logger.Error("couldn't delete orphaned object", "bucket", bucket, "key", key, "error", err)
+			continue
+		}
+		cfg.logger.Info("deleted orphaned object", "bucket", bucket, "key", key)
+	}
+}
+
+// isBodyTooLarge reports whether err came from reading past the request
+// body limit set with http.MaxBytesReader.
+func isBodyTooLarge(err error) bool {
+	var maxBytesErr *http.MaxBytesError
+	return errors.As(err, &maxBytesErr)
+}
+
+// orientationPrefix is the key prefix for a video of the given dimensions.
+func (cfg *apiConfig) orientationPrefix(width, height int) string {
+	switch aspectRatio(width, height) {
+	case "16:9", "4:3", "21:9":
+		return "landscape"
+	case "9:16":
+		return "portrait"
+	case "1:1":
+		return "square"
+	default:
+		return otherAspectPrefix(cfg.otherAspectBucketing, width, height)
+	}
+}
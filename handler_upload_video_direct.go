@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// directUploadDimensionsHeader carries a video's "WIDTHxHEIGHT" for direct
+// uploads, standing in for what ffprobe would have found.
+const directUploadDimensionsHeader = "X-Video-Dimensions"
+
+// trustedUploader reports whether userID may upload without processing.
+func (cfg *apiConfig) trustedUploader(userID uuid.UUID) bool {
+	return cfg.directUploads && cfg.directUploadUsers[userID]
+}
+
+// isMP4Header reports whether head starts with an MP4's ftyp box. A
+// faststart MP4 always does, and nothing that skips processing gets
+// looked at more closely than this.
+func isMP4Header(head []byte) bool {
+	return len(head) >= 8 && string(head[4:8]) == "ftyp"
+}
+
+// parseVideoDimensions parses "1920x1080".
+func parseVideoDimensions(s string) (width, height int, err error) {
+	if _, err := fmt.Sscanf(s, "%dx%d", &width, &height); err != nil {
+		return 0, 0, fmt.Errorf("want WIDTHxHEIGHT, got %q", s)
+	}
+	if width <= 0 || height <= 0 {
+		return 0, 0, fmt.Errorf("dimensions must be positive, got %q", s)
+	}
+	return width, height, nil
+}
+
+// uploadVideoDirect streams the "video" form part straight into a multipart
+// S3 upload. Nothing is written to disk and neither ffprobe nor ffmpeg
+// run: the client is trusted to send a faststart MP4 and its dimensions.
+// Only enabled with DIRECT_UPLOADS, for the users in DIRECT_UPLOAD_USERS.
+func (cfg *apiConfig) uploadVideoDirect(w http.ResponseWriter, r *http.Request, video database.Video) {
+	width, height, err := parseVideoDimensions(r.Header.Get(directUploadDimensionsHeader))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid "+directUploadDimensionsHeader, err)
+		return
+	}
+
+	// Read the multipart body as a stream; ParseMultipartForm would spool
+	// the file to a temp file first
+	reader, err := r.MultipartReader()
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Expected a multipart upload", err)
+		return
+	}
+	var part io.ReadCloser
+	var filename, mediaType string
+	for {
+		p, err := reader.NextPart()
+		if errors.Is(err, io.EOF) {
+			respondWithError(w, http.StatusBadRequest, "Missing video form file", nil)
+			return
+		}
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Unable to parse form file", err)
+			return
+		}
+		if p.FormName() == "video" {
+			part, filename, mediaType = p, p.FileName(), p.Header.Get("Content-Type")
+			break
+		}
+		if p.FormName() == "codec" {
+			p.Close()
+			respondWithError(w, http.StatusBadRequest, "Direct uploads can't be re-encoded", nil)
+			return
+		}
+		p.Close()
+	}
+	defer part.Close()
+
+	mimeType, _, err := mime.ParseMediaType(mediaType)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Error parsing mime type", err)
+		return
+	}
+	if mimeType != "video/mp4" {
+		respondWithError(w, http.StatusBadRequest, "Wrong file type. Will only accept mp4", nil)
+		return
+	}
+	// Even trusted clients get the first bytes checked; Peek leaves them
+	// in place for the upload
+	body := bufio.NewReader(part)
+	head, err := body.Peek(8)
+	if err != nil && !errors.Is(err, io.EOF) {
+		respondWithError(w, http.StatusBadRequest, "Unable to read form file", err)
+		return
+	}
+	if !isMP4Header(head) {
+		respondWithError(w, http.StatusBadRequest, "Uploaded file is not a valid video/mp4", nil)
+		return
+	}
+
+	// The size isn't known yet, so the Idempotency-Key is the only way to
+	// tell identical direct uploads apart
+	uploadKey := fmt.Sprintf("%s/%s/direct", video.UserID, video.ID)
+	if key := r.Header.Get("Idempotency-Key"); key != "" {
+		uploadKey = video.UserID.String() + "/" + key
+	}
+	releaseUpload, ok := cfg.inflightUploads.tryAcquire(uploadKey)
+	if !ok {
+		respondWithError(w, http.StatusConflict, "An identical upload is already in progress", nil)
+		return
+	}
+	defer releaseUpload()
+	unlockUpload, err := cfg.uploadLocker.Lock(r.Context(), uploadKey)
+	if err != nil {
+		respondWithError(w, http.StatusServiceUnavailable, "Couldn't coordinate upload with other servers", err)
+		return
+	}
+	defer unlockUpload()
+
+	stored := false
+	defer cfg.trackUploadStatus(&video, &stored)()
+
+	randomKey, err := cfg.objectKeys.newKey()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "failed to generate random key", err)
+		return
+	}
+	videoKey := cfg.orientationPrefix(width, height) + "/" + randomKey + fastStartExtension
+
+	timings := cfg.uploadTimingsFor(r)
+	stopUpload := timings.start("upload")
+	uploadCtx, cancel := cfg.s3Context(r.Context())
+	defer cancel()
+	err = cfg.uploadMultipart(uploadCtx, videoKey, mediaType, body, -1)
+	stopUpload()
+	if isBodyTooLarge(err) {
+		respondWithError(w, http.StatusRequestEntityTooLarge, "Video is too large", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "upload to S3 failed", err)
+		return
+	}
+
+	videoURL := cfg.s3Bucket + "," + videoKey
+	previous := video
+	video.VideoURL = &videoURL
+	video.OriginalFilename = nil
+	if filename != "" {
+		video.OriginalFilename = &filename
+	}
+	clearProbedFields(&video)
+
+	if err := cfg.db.UpdateVideo(video); err != nil {
+		if !cfg.keepObjectsOnDBFailure {
+			cfg.deleteUploadedObjects(videoURL)
+		}
+		respondWithError(w, http.StatusInternalServerError, "Error while updating video", err)
+		return
+	}
+	cfg.clearFileRecords(&video)
+	cfg.deleteReplacedFiles(r.Context(), previous, video)
+	cfg.replicateVideo(video.ID, videoKey)
+
+	stored = true
+	cfg.setVideoStatus(&video, database.VideoStatusReady)
+	cfg.respondWithUploadedVideo(w, r, video, timings)
+	cfg.logger.Info("uploaded video", "video_id", video.ID, "user_id", video.UserID, "key", videoKey)
+}
+
+// clearProbedFields drops everything learned from processing a previous
+// file, for uploads stored without looking at them.
+func clearProbedFields(video *database.Video) {
+	video.IFrameURL = nil
+	video.HLSURL = nil
+	video.Bitrate = nil
+	video.Duration = nil
+	video.AudioOnly = false
+	video.QualityWarnings = nil
+	video.AudioLanguages = nil
+	video.ContentHash = nil
+}
@@ -0,0 +1,385 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// Presigned uploads let a client send a video straight to S3 in parts it
+// can retry one at a time, which suits flaky mobile networks. Like direct
+// uploads they skip processing, so they're only enabled with
+// DIRECT_UPLOADS. Nothing is stored until completion: the token handed out
+// at the start ties the S3 upload to the video instead.
+
+type presignedUploadPart struct {
+	PartNumber int32  `json:"part_number"`
+	Size       int64  `json:"size,omitempty"`
+	URL        string `json:"url,omitempty"`
+	ETag       string `json:"etag,omitempty"`
+}
+
+// presignedUpload identifies an S3 multipart upload in progress.
+// ExpiresAt is when its part URLs stop working.
+type presignedUpload struct {
+	UploadID  string    `json:"upload_id"`
+	Key       string    `json:"key"`
+	ExpiresAt time.Time `json:"expires_at"`
+	Token     string    `json:"token"`
+}
+
+// presignedUploadTokenPurpose is signed into every upload token, so the
+// JWT secret it shares can't produce a MAC that's valid anywhere else.
+const presignedUploadTokenPurpose = "tubely-presigned-upload"
+
+// presignedUploadGrace is how long after its part URLs expire an upload
+// can still be completed or aborted, for parts sent just in time.
+const presignedUploadGrace = time.Hour
+
+// presignedUploadToken signs an upload to a video so a client can't finish
+// or abort an upload it wasn't given, attach it to another video, or use
+// it after it expires.
+func (cfg *apiConfig) presignedUploadToken(videoID uuid.UUID, upload presignedUpload) string {
+	mac := hmac.New(sha256.New, []byte(cfg.jwtSecret))
+	fmt.Fprintf(mac, "%s\n%s\n%s\n%s\n%d", presignedUploadTokenPurpose, videoID, upload.UploadID, upload.Key, upload.ExpiresAt.Unix())
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (cfg *apiConfig) validPresignedUpload(videoID uuid.UUID, upload presignedUpload) bool {
+	if upload.UploadID == "" || upload.Key == "" || time.Now().After(upload.ExpiresAt.Add(presignedUploadGrace)) {
+		return false
+	}
+	want := cfg.presignedUploadToken(videoID, upload)
+	return hmac.Equal([]byte(want), []byte(upload.Token))
+}
+
+// ownedVideoForUpload authenticates the request and loads the video it
+// names, responding with an error and returning false if the caller can't
+// upload to it.
+func (cfg *apiConfig) ownedVideoForUpload(w http.ResponseWriter, r *http.Request) (database.Video, bool) {
+	if !cfg.directUploads {
+		respondWithError(w, http.StatusNotFound, "Presigned uploads are disabled", nil)
+		return database.Video{}, false
+	}
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return database.Video{}, false
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return database.Video{}, false
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret, cfg.jwtExpectations)
+	if err != nil {
+		respondWithJWTError(w, err)
+		return database.Video{}, false
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error while getting video", err)
+		return database.Video{}, false
+	}
+	if video.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return database.Video{}, false
+	}
+	if userID != video.UserID {
+		respondWithError(w, http.StatusUnauthorized, "Unauthorized", nil)
+		return database.Video{}, false
+	}
+	if !cfg.trustedUploader(userID) {
+		respondWithError(w, http.StatusForbidden, "Presigned uploads are limited to trusted clients", nil)
+		return database.Video{}, false
+	}
+	return video, true
+}
+
+// handlerStartPresignedUpload starts an S3 multipart upload for a video of
+// the given size and returns a presigned URL for each part. The client
+// PUTs each part to its URL and keeps the ETag S3 responds with.
+func (cfg *apiConfig) handlerStartPresignedUpload(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Size int64 `json:"size"`
+	}
+	type response struct {
+		presignedUpload
+		Parts []presignedUploadPart `json:"parts"`
+	}
+
+	video, ok := cfg.ownedVideoForUpload(w, r)
+	if !ok {
+		return
+	}
+	if !cfg.allowUpload(w, video.UserID) {
+		return
+	}
+	if video.VideoURL != nil && r.URL.Query().Get("overwrite") != "true" {
+		respondWithError(w, http.StatusConflict, "Video already has a file; replace it with ?overwrite=true", nil)
+		return
+	}
+	width, height, err := parseVideoDimensions(r.Header.Get(directUploadDimensionsHeader))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid "+directUploadDimensionsHeader, err)
+		return
+	}
+
+	params := parameters{}
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+	if params.Size <= 0 {
+		respondWithError(w, http.StatusBadRequest, "Size must be positive", nil)
+		return
+	}
+	if cfg.maxUploadSize > 0 && params.Size > cfg.maxUploadSize {
+		respondWithError(w, http.StatusRequestEntityTooLarge, "Video is too large", nil)
+		return
+	}
+	partSize, err := cfg.multipartSizing.plan(params.Size)
+	if err != nil {
+		respondWithError(w, http.StatusRequestEntityTooLarge, "Video is too large", err)
+		return
+	}
+
+	randomKey, err := cfg.objectKeys.newKey()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "failed to generate random key", err)
+		return
+	}
+	videoKey := cfg.orientationPrefix(width, height) + "/" + randomKey + fastStartExtension
+
+	ctx, cancel := cfg.s3Context(r.Context())
+	defer cancel()
+	var created *s3.CreateMultipartUploadOutput
+	err = retryS3(ctx, cfg.s3Retry, "create multipart upload", func() (err error) {
+		created, err = cfg.s3Client.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
+			Bucket:               aws.String(cfg.s3Bucket),
+			Key:                  aws.String(videoKey),
+			ContentType:          aws.String("video/mp4"),
+			ServerSideEncryption: cfg.objectEncryption.mode(),
+			SSEKMSKeyId:          cfg.objectEncryption.kmsKeyID(),
+		})
+		return err
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't start upload", err)
+		return
+	}
+	uploadID := aws.ToString(created.UploadId)
+	cfg.setVideoStatus(&video, database.VideoStatusUploading)
+
+	// Whole seconds, so the token still matches after a JSON round trip
+	// through clients that drop fractions
+	upload := presignedUpload{
+		UploadID:  uploadID,
+		Key:       videoKey,
+		ExpiresAt: time.Now().Add(cfg.uploadPresignExpiry).Truncate(time.Second),
+	}
+	upload.Token = cfg.presignedUploadToken(video.ID, upload)
+	resp := response{presignedUpload: upload}
+	presigner := s3.NewPresignClient(cfg.s3Client)
+	for partNumber, remaining := int32(1), params.Size; remaining > 0; partNumber++ {
+		size := min(partSize(partNumber), remaining)
+		remaining -= size
+		req, err := presigner.PresignUploadPart(ctx, &s3.UploadPartInput{
+			Bucket:     aws.String(cfg.s3Bucket),
+			Key:        aws.String(videoKey),
+			UploadId:   aws.String(uploadID),
+			PartNumber: aws.Int32(partNumber),
+		}, s3.WithPresignExpires(cfg.uploadPresignExpiry))
+		if err != nil {
+			cfg.abortPresignedUpload(resp.presignedUpload)
+			respondWithError(w, http.StatusInternalServerError, "Couldn't presign upload part", err)
+			return
+		}
+		resp.Parts = append(resp.Parts, presignedUploadPart{PartNumber: partNumber, Size: size, URL: req.URL})
+	}
+
+	respondWithJSON(w, http.StatusCreated, resp)
+}
+
+// handlerCompletePresignedUpload assembles the uploaded parts and attaches
+// the result to the video.
+func (cfg *apiConfig) handlerCompletePresignedUpload(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		presignedUpload
+		Filename string                `json:"filename"`
+		Parts    []presignedUploadPart `json:"parts"`
+	}
+
+	video, ok := cfg.ownedVideoForUpload(w, r)
+	if !ok {
+		return
+	}
+	params := parameters{}
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+	if !cfg.validPresignedUpload(video.ID, params.presignedUpload) {
+		respondWithError(w, http.StatusForbidden, "Invalid or expired upload token", nil)
+		return
+	}
+	if len(params.Parts) == 0 {
+		respondWithError(w, http.StatusBadRequest, "No parts to complete", nil)
+		return
+	}
+
+	stored := false
+	defer func() {
+		if !stored {
+			cfg.setVideoStatus(&video, database.VideoStatusFailed)
+		}
+	}()
+
+	// S3 wants the parts in order
+	sort.Slice(params.Parts, func(i, j int) bool { return params.Parts[i].PartNumber < params.Parts[j].PartNumber })
+	completed := make([]types.CompletedPart, 0, len(params.Parts))
+	for _, part := range params.Parts {
+		completed = append(completed, types.CompletedPart{
+			ETag:       aws.String(part.ETag),
+			PartNumber: aws.Int32(part.PartNumber),
+		})
+	}
+
+	ctx, cancel := cfg.s3Context(r.Context())
+	defer cancel()
+	err := retryS3(ctx, cfg.s3Retry, "complete multipart upload", func() error {
+		_, err := cfg.s3Client.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+			Bucket:          aws.String(cfg.s3Bucket),
+			Key:             aws.String(params.Key),
+			UploadId:        aws.String(params.UploadID),
+			MultipartUpload: &types.CompletedMultipartUpload{Parts: completed},
+		})
+		return err
+	})
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't complete upload", err)
+		return
+	}
+
+	videoURL := cfg.s3Bucket + "," + params.Key
+	// S3 took whatever the client sent; at least make sure it's an MP4
+	prefix, err := cfg.readObjectHead(ctx, params.Key, 8)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check uploaded video", err)
+		return
+	}
+	if !isMP4Header(prefix) {
+		cfg.deleteUploadedObjects(videoURL)
+		respondWithError(w, http.StatusBadRequest, "Uploaded file is not a valid video/mp4", nil)
+		return
+	}
+	// The declared size was checked up front, but nothing stops a client
+	// from uploading bigger parts than it asked for
+	if cfg.maxUploadSize > 0 {
+		head, err := cfg.s3Client.HeadObject(ctx, &s3.HeadObjectInput{
+			Bucket: aws.String(cfg.s3Bucket),
+			Key:    aws.String(params.Key),
+		})
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't check uploaded video", err)
+			return
+		}
+		if aws.ToInt64(head.ContentLength) > cfg.maxUploadSize {
+			cfg.deleteUploadedObjects(videoURL)
+			respondWithError(w, http.StatusRequestEntityTooLarge, "Video is too large", nil)
+			return
+		}
+	}
+
+	previous := video
+	video.VideoURL = &videoURL
+	video.OriginalFilename = nil
+	if params.Filename != "" {
+		video.OriginalFilename = &params.Filename
+	}
+	clearProbedFields(&video)
+
+	if err := cfg.db.UpdateVideo(video); err != nil {
+		if !cfg.keepObjectsOnDBFailure {
+			cfg.deleteUploadedObjects(videoURL)
+		}
+		respondWithError(w, http.StatusInternalServerError, "Error while updating video", err)
+		return
+	}
+	cfg.clearFileRecords(&video)
+	cfg.deleteReplacedFiles(r.Context(), previous, video)
+	cfg.replicateVideo(video.ID, params.Key)
+
+	stored = true
+	cfg.setVideoStatus(&video, database.VideoStatusReady)
+	cfg.respondWithUploadedVideo(w, r, video, nil)
+	cfg.logger.Info("uploaded video", "video_id", video.ID, "user_id", video.UserID, "key", params.Key)
+}
+
+// handlerAbortPresignedUpload cancels an upload the client gave up on, so
+// S3 drops the parts it already has.
+func (cfg *apiConfig) handlerAbortPresignedUpload(w http.ResponseWriter, r *http.Request) {
+	video, ok := cfg.ownedVideoForUpload(w, r)
+	if !ok {
+		return
+	}
+	params := presignedUpload{}
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+	if !cfg.validPresignedUpload(video.ID, params) {
+		respondWithError(w, http.StatusForbidden, "Invalid or expired upload token", nil)
+		return
+	}
+	if err := cfg.abortPresignedUpload(params); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't abort upload", err)
+		return
+	}
+	// An abandoned upload never finishes
+	cfg.setVideoStatus(&video, database.VideoStatusFailed)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// readObjectHead returns the first n bytes of an object in the primary
+// bucket, or fewer if it's shorter.
+func (cfg *apiConfig) readObjectHead(ctx context.Context, key string, n int) ([]byte, error) {
+	out, err := cfg.s3Client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(cfg.s3Bucket),
+		Key:    aws.String(key),
+		Range:  aws.String(fmt.Sprintf("bytes=0-%d", n-1)),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer out.Body.Close()
+	return io.ReadAll(io.LimitReader(out.Body, int64(n)))
+}
+
+func (cfg *apiConfig) abortPresignedUpload(upload presignedUpload) error {
+	// The request may be why this is happening, so don't use its context
+	ctx, cancel := cfg.s3Context(context.Background())
+	defer cancel()
+	_, err := cfg.s3Client.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(cfg.s3Bucket),
+		Key:      aws.String(upload.Key),
+		UploadId: aws.String(upload.UploadID),
+	})
+	return err
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	imagepng "image/png"
+	"io"
+	"log/slog"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// newUploadTestConfig returns a config backed by a fresh database with one
+// video in it, and a token for the video's owner.
+func newUploadTestConfig(t *testing.T) (*apiConfig, database.Video, string) {
+	t.Helper()
+	db, err := database.NewClient(filepath.Join(t.TempDir(), "tubely.db"))
+	if err != nil {
+		t.Fatalf("open database: %v", err)
+	}
+	user, err := db.CreateUser(database.CreateUserParams{Email: "owner@example.com", Password: "password"})
+	if err != nil {
+		t.Fatalf("create user: %v", err)
+	}
+	video, err := db.CreateVideo(database.CreateVideoParams{Title: "test", UserID: user.ID})
+	if err != nil {
+		t.Fatalf("create video: %v", err)
+	}
+
+	cfg := &apiConfig{
+		db:                 db,
+		logger:             slog.New(slog.DiscardHandler),
+		jwtSecret:          "test-secret",
+		inflightUploads:    newInflightUploads(),
+		uploadLocker:       newLocalLocker(),
+		acceptedVideoTypes: map[string]bool{"video/mp4": true},
+	}
+	token, err := auth.MakeJWT(user.ID, cfg.jwtSecret, time.Hour, cfg.jwtExpectations)
+	if err != nil {
+		t.Fatalf("make token: %v", err)
+	}
+	return cfg, video, token
+}
+
+// newVideoUploadRequest builds a multipart upload of body as an mp4.
+func newVideoUploadRequest(t *testing.T, method, videoID, token string, body io.Reader) *http.Request {
+	t.Helper()
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	h := make(textproto.MIMEHeader)
+	h.Set("Content-Disposition", `form-data; name="video"; filename="video.mp4"`)
+	h.Set("Content-Type", "video/mp4")
+	part, err := mw.CreatePart(h)
+	if err != nil {
+		t.Fatalf("create part: %v", err)
+	}
+	if _, err := io.Copy(part, body); err != nil {
+		t.Fatalf("write part: %v", err)
+	}
+	if err := mw.Close(); err != nil {
+		t.Fatalf("close multipart writer: %v", err)
+	}
+
+	r := httptest.NewRequest(method, "/api/video_upload/"+videoID, &buf)
+	r.SetPathValue("videoID", videoID)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	r.Header.Set("Authorization", "Bearer "+token)
+	return r
+}
+
+func TestUploadVideoRejectsEmptyFile(t *testing.T) {
+	cfg, video, token := newUploadTestConfig(t)
+
+	w := httptest.NewRecorder()
+	cfg.handlerUploadVideo(w, newVideoUploadRequest(t, http.MethodPost, video.ID.String(), token, strings.NewReader("")))
+
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+	if !strings.Contains(w.Body.String(), "empty file") {
+		t.Errorf("body = %s, want the empty file error", w.Body.String())
+	}
+}
+
+func TestUploadVideoRequiresOverwrite(t *testing.T) {
+	cfg, video, token := newUploadTestConfig(t)
+	existing := "https://example.com/existing.mp4"
+	video.VideoURL = &existing
+	if err := cfg.db.UpdateVideo(video); err != nil {
+		t.Fatalf("update video: %v", err)
+	}
+	id := video.ID.String()
+
+	w := httptest.NewRecorder()
+	cfg.handlerUploadVideo(w, newVideoUploadRequest(t, http.MethodPost, id, token, strings.NewReader("")))
+	if w.Code != http.StatusConflict {
+		t.Fatalf("POST status = %d, want %d", w.Code, http.StatusConflict)
+	}
+
+	// Opting in gets past the guard to the empty file check
+	r := newVideoUploadRequest(t, http.MethodPost, id, token, strings.NewReader(""))
+	r.URL.RawQuery = "overwrite=true"
+	w = httptest.NewRecorder()
+	cfg.handlerUploadVideo(w, r)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("POST ?overwrite=true status = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+
+	w = httptest.NewRecorder()
+	cfg.handlerReplaceVideo(w, newVideoUploadRequest(t, http.MethodPut, id, token, strings.NewReader("")))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("PUT status = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
+
+func TestUploadUnknownVideoNotFound(t *testing.T) {
+	cfg, _, token := newUploadTestConfig(t)
+	cfg.assetsRoot = t.TempDir()
+	id := uuid.New().String()
+
+	w := httptest.NewRecorder()
+	cfg.handlerUploadVideo(w, newVideoUploadRequest(t, http.MethodPost, id, token, strings.NewReader("")))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("video upload status = %d, want %d", w.Code, http.StatusNotFound)
+	}
+
+	var png bytes.Buffer
+	if err := imagepng.Encode(&png, image.NewRGBA(image.Rect(0, 0, 4, 4))); err != nil {
+		t.Fatalf("encode thumbnail: %v", err)
+	}
+	w = httptest.NewRecorder()
+	cfg.handlerUploadThumbnail(w, newThumbnailUploadRequest(t, id, token, &png))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("thumbnail upload status = %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
+
+// newThumbnailUploadRequest builds a multipart upload of body as a png.
+func newThumbnailUploadRequest(t *testing.T, videoID, token string, body io.Reader) *http.Request {
+	t.Helper()
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	h := make(textproto.MIMEHeader)
+	h.Set("Content-Disposition", `form-data; name="thumbnail"; filename="thumbnail.png"`)
+	h.Set("Content-Type", "image/png")
+	part, err := mw.CreatePart(h)
+	if err != nil {
+		t.Fatalf("create part: %v", err)
+	}
+	if _, err := io.Copy(part, body); err != nil {
+		t.Fatalf("write part: %v", err)
+	}
+	if err := mw.Close(); err != nil {
+		t.Fatalf("close multipart writer: %v", err)
+	}
+
+	r := httptest.NewRequest(http.MethodPost, "/api/thumbnail_upload/"+videoID, &buf)
+	r.SetPathValue("videoID", videoID)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	r.Header.Set("Authorization", "Bearer "+token)
+	return r
+}
+
+func TestUploadThumbnailRespondsWithVideoJSON(t *testing.T) {
+	cfg, video, token := newUploadTestConfig(t)
+	cfg.assetsRoot = t.TempDir()
+
+	var png bytes.Buffer
+	if err := imagepng.Encode(&png, image.NewRGBA(image.Rect(0, 0, 4, 4))); err != nil {
+		t.Fatalf("encode thumbnail: %v", err)
+	}
+	w := httptest.NewRecorder()
+	cfg.handlerUploadThumbnail(w, newThumbnailUploadRequest(t, video.ID.String(), token, &png))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusOK, w.Body.String())
+	}
+
+	// A double-encoded body would be a quoted base64 string, not an object
+	var body map[string]any
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("body is not a JSON object: %v: %s", err, w.Body.String())
+	}
+	if url, _ := body["thumbnail_url"].(string); url == "" {
+		t.Errorf("thumbnail_url = %v, want a URL", body["thumbnail_url"])
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"path"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/google/uuid"
+)
+
+// handlerUploadVideoFromURL ingests a video hosted elsewhere: the server
+// downloads it from an https URL and runs it through the same pipeline as
+// an upload. Like POST /api/video_upload, it won't replace an existing
+// file without ?overwrite=true.
+func (cfg *apiConfig) handlerUploadVideoFromURL(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		URL   string `json:"url"`
+		Codec string `json:"codec"`
+	}
+
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret, cfg.jwtExpectations)
+	if err != nil {
+		respondWithJWTError(w, err)
+		return
+	}
+	if !cfg.allowUpload(w, userID) {
+		return
+	}
+
+	started := time.Now()
+	logger := cfg.logger.With("video_id", videoID, "user_id", userID)
+
+	var params parameters
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+	source, err := parseFetchURL(params.URL)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid video URL", err)
+		return
+	}
+	logger.Info("uploading video from URL", "host", source.Host)
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error while getting video", err)
+		return
+	}
+	// GetVideo reports a missing row as a zero Video, not an error
+	if video.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
+	if userID != video.UserID {
+		respondWithError(w, http.StatusUnauthorized, "Unauthorized", nil)
+		return
+	}
+	if video.VideoURL != nil && r.URL.Query().Get("overwrite") != "true" {
+		respondWithError(w, http.StatusConflict, "Video already has a file; replace it with ?overwrite=true", nil)
+		return
+	}
+
+	timings := cfg.uploadTimingsFor(r)
+	stopFetch := timings.start("fetch")
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, source.String(), nil)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid video URL", err)
+		return
+	}
+	resp, err := cfg.urlFetchClient.Do(req)
+	stopFetch()
+	if errors.Is(err, errNonPublicAddress) {
+		respondWithError(w, http.StatusBadRequest, "Video URL must point at a public address", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusBadGateway, "Couldn't fetch video", err)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		respondWithError(w, http.StatusBadGateway, fmt.Sprintf("Fetching video returned %s", resp.Status), nil)
+		return
+	}
+
+	// Check what's coming before downloading any of it; the file itself is
+	// still sniffed once it's on disk
+	mediaType := resp.Header.Get("Content-Type")
+	mimeType, _, err := mime.ParseMediaType(mediaType)
+	if err != nil || !cfg.acceptedVideoTypes[mimeType] {
+		respondWithError(w, http.StatusBadRequest, "Video URL doesn't serve a supported video type", err)
+		return
+	}
+	body := resp.Body
+	if cfg.maxUploadSize > 0 {
+		if resp.ContentLength > cfg.maxUploadSize {
+			respondWithError(w, http.StatusRequestEntityTooLarge, "Video is too large", nil)
+			return
+		}
+		// The length can be missing or wrong, so cap the read too
+		body = http.MaxBytesReader(nil, resp.Body, cfg.maxUploadSize)
+	}
+
+	uploadKey := userID.String() + "/" + r.Header.Get("Idempotency-Key")
+	if r.Header.Get("Idempotency-Key") == "" {
+		uploadKey = fmt.Sprintf("%s/%s/%s", userID, videoID, source)
+	}
+	filename := path.Base(source.Path)
+	if filename == "/" || filename == "." {
+		filename = ""
+	}
+
+	cfg.ingestVideo(w, r, videoUpload{
+		video:     video,
+		body:      body,
+		filename:  filename,
+		mediaType: mediaType,
+		codec:     params.Codec,
+		key:       uploadKey,
+		started:   started,
+		timings:   timings,
+		logger:    logger,
+	})
+}
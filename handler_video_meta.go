@@ -1,9 +1,19 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
 	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
 	"github.com/google/uuid"
@@ -19,9 +29,9 @@ func (cfg *apiConfig) handlerVideoMetaCreate(w http.ResponseWriter, r *http.Requ
 		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
 		return
 	}
-	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret, cfg.jwtExpectations)
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		respondWithJWTError(w, err)
 		return
 	}
 
@@ -40,7 +50,7 @@ func (cfg *apiConfig) handlerVideoMetaCreate(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
-	respondWithJSON(w, http.StatusCreated, video)
+	respondWithNegotiatedJSON(w, r, http.StatusCreated, video)
 }
 
 func (cfg *apiConfig) handlerVideoMetaDelete(w http.ResponseWriter, r *http.Request) {
@@ -56,19 +66,23 @@ func (cfg *apiConfig) handlerVideoMetaDelete(w http.ResponseWriter, r *http.Requ
 		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
 		return
 	}
-	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret, cfg.jwtExpectations)
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		respondWithJWTError(w, err)
 		return
 	}
 
 	video, err := cfg.db.GetVideo(videoID)
 	if err != nil {
-		respondWithError(w, http.StatusNotFound, "Couldn't get video", err)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if video.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
 		return
 	}
 	if video.UserID != userID {
-		respondWithError(w, http.StatusForbidden, "You can't delete this video", err)
+		respondWithError(w, http.StatusUnauthorized, "You can't delete this video", nil)
 		return
 	}
 
@@ -78,9 +92,104 @@ func (cfg *apiConfig) handlerVideoMetaDelete(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
+	// The video is gone as far as clients are concerned; leftover files
+	// are only logged, for reconciliation to clean up
+	cfg.deleteVideoFiles(r.Context(), video)
+
 	w.WriteHeader(http.StatusNoContent)
 }
 
+// deleteVideoFiles removes a deleted video's objects from S3 and its
+// thumbnail from the assets directory. Objects shared with another video
+// through upload dedup are left alone.
+func (cfg *apiConfig) deleteVideoFiles(ctx context.Context, video database.Video) {
+	logger := cfg.logger.With("video_id", video.ID)
+	if video.ThumbnailURL != nil {
+		cfg.deleteThumbnail(logger, video.ID, *video.ThumbnailURL)
+	}
+	cfg.deleteVideoObjects(ctx, logger, video)
+}
+
+// deleteReplacedFiles removes the objects of the file previous had, once
+// the video's row points at current's instead. The thumbnail stays; it
+// belongs to the video rather than the file.
+func (cfg *apiConfig) deleteReplacedFiles(ctx context.Context, previous, current database.Video) {
+	if previous.VideoURL == nil {
+		return
+	}
+	// A reused upload can land on the very objects it replaces
+	if current.VideoURL != nil && *current.VideoURL == *previous.VideoURL {
+		return
+	}
+	logger := cfg.logger.With("video_id", previous.ID)
+	cfg.deleteVideoObjects(context.WithoutCancel(ctx), logger, previous)
+}
+
+// deleteVideoObjects removes a video file's objects from S3: the video,
+// its I-frame track, HLS stream, replica, and renditions. Objects shared
+// with another video through upload dedup are left alone.
+func (cfg *apiConfig) deleteVideoObjects(ctx context.Context, logger *slog.Logger, video database.Video) {
+	if video.VideoURL != nil {
+		inUse, err := cfg.db.VideoURLInUse(*video.VideoURL, video.ID)
+		if err != nil {
+			logger.Error("not deleting objects, couldn't check for sharing", "error", err)
+			return
+		}
+		if inUse {
+			return
+		}
+	}
+
+	ctx, cancel := cfg.s3Context(ctx)
+	defer cancel()
+	var locations []string
+	for _, location := range []*string{video.VideoURL, video.IFrameURL, video.ReplicaURL} {
+		if location != nil {
+			locations = append(locations, *location)
+		}
+	}
+	locations = append(locations, renditionLocations(video.Renditions)...)
+	if video.HLSURL != nil {
+		if err := cfg.deleteHLS(ctx, *video.HLSURL); err != nil {
+			logger.Error("couldn't delete HLS stream", "location", *video.HLSURL, "error", err)
+		}
+	}
+	for _, location := range locations {
+		bucket, key, err := parseVideoLocation(location)
+		if err != nil {
+			logger.Error("not deleting object", "location", location, "error", err)
+			continue
+		}
+		_, err = cfg.s3ClientForBucket(bucket).DeleteObject(ctx, &s3.DeleteObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(key),
+		})
+		if err != nil {
+			logger.Error("couldn't delete object", "bucket", bucket, "key", key, "error", err)
+		}
+	}
+}
+
+// deleteThumbnail removes a thumbnail from the assets directory unless a
+// video other than videoID still uses it: identical thumbnails share a
+// file.
+func (cfg *apiConfig) deleteThumbnail(logger *slog.Logger, videoID uuid.UUID, thumbnailURL string) {
+	inUse, err := cfg.db.ThumbnailInUse(thumbnailURL, videoID)
+	if err != nil {
+		logger.Error("not deleting thumbnail, couldn't check for sharing", "error", err)
+		return
+	}
+	assetPath, err := thumbnailAssetPath(thumbnailURL)
+	if err != nil || inUse {
+		return
+	}
+	if err := os.Remove(cfg.getAssetDiskPath(assetPath)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		logger.Error("couldn't delete thumbnail", "path", assetPath, "error", err)
+	}
+}
+
+// handlerVideoGet returns one of the caller's videos with freshly signed
+// URLs, and when they expire, like an item of the list response.
 func (cfg *apiConfig) handlerVideoGet(w http.ResponseWriter, r *http.Request) {
 	videoIDString := r.PathValue("videoID")
 	videoID, err := uuid.Parse(videoIDString)
@@ -89,50 +198,200 @@ func (cfg *apiConfig) handlerVideoGet(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret, cfg.jwtExpectations)
+	if err != nil {
+		respondWithJWTError(w, err)
+		return
+	}
+
 	video, err := cfg.db.GetVideo(videoID)
 	if err != nil {
-		respondWithError(w, http.StatusNotFound, "Couldn't get video", err)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if video.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
+	if video.UserID != userID {
+		respondWithError(w, http.StatusUnauthorized, "You can't view this video", nil)
+		return
+	}
+
+	disposition := r.URL.Query().Get("disposition")
+	if disposition == "" {
+		disposition = dispositionInline
+	}
+	if disposition != dispositionInline && disposition != dispositionAttachment {
+		respondWithError(w, http.StatusBadRequest, "disposition must be inline or attachment", nil)
 		return
 	}
 
-	videoUpdated, err := cfg.dbVideoToSignedVideo(video)
+	videoUpdated, expiresAt, err := cfg.signVideo(r.Context(), video, disposition)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "failed to generate presigned video", err)
 		return
 	}
 
-	respondWithJSON(w, http.StatusOK, videoUpdated)
+	item := listedVideo{Video: videoUpdated}
+	if !expiresAt.IsZero() {
+		item.URLsExpireAt = &expiresAt
+		item.CacheMaxAge = max(int64(time.Until(expiresAt).Seconds()), 0)
+		w.Header().Set("Cache-Control", fmt.Sprintf("private, max-age=%d", item.CacheMaxAge))
+	} else {
+		w.Header().Set("Cache-Control", "private, no-cache")
+	}
+	respondWithNegotiatedJSON(w, r, http.StatusOK, item)
+}
+
+// listedVideo is a video in the list response, with when its signed URLs
+// expire so clients can schedule a refresh. Both are left out when
+// nothing in the item expires.
+type listedVideo struct {
+	database.Video
+	URLsExpireAt *time.Time `json:"urls_expire_at,omitempty"`
+	CacheMaxAge  int64      `json:"cache_max_age,omitempty"`
 }
 
+const (
+	defaultVideoPageSize = 50
+	maxVideoPageSize     = 100
+)
+
+// listOrientations are the key prefixes the list can be filtered by.
+var listOrientations = map[string]bool{
+	"landscape": true,
+	"portrait":  true,
+	"square":    true,
+	"audio":     true,
+	"other":     true,
+}
+
+// videoPage is the slice of the video list a request asked for.
+type videoPage struct {
+	Limit       int
+	Offset      int
+	Orientation string
+}
+
+// parseVideoPage reads the limit, offset and orientation query params. A
+// cursor from a previous page's next_cursor stands in for offset.
+func parseVideoPage(query url.Values) (videoPage, error) {
+	page := videoPage{Limit: defaultVideoPageSize, Orientation: query.Get("orientation")}
+	if raw := query.Get("limit"); raw != "" {
+		limit, err := strconv.Atoi(raw)
+		if err != nil || limit < 1 || limit > maxVideoPageSize {
+			return videoPage{}, fmt.Errorf("limit must be between 1 and %d", maxVideoPageSize)
+		}
+		page.Limit = limit
+	}
+	if raw := query.Get("offset"); raw != "" {
+		offset, err := strconv.Atoi(raw)
+		if err != nil || offset < 0 {
+			return videoPage{}, errors.New("offset must be a non-negative integer")
+		}
+		page.Offset = offset
+	} else if raw := query.Get("cursor"); raw != "" {
+		offset, err := strconv.Atoi(raw)
+		if err != nil || offset < 0 {
+			return videoPage{}, errors.New("invalid cursor")
+		}
+		page.Offset = offset
+	}
+	if page.Orientation != "" && !listOrientations[page.Orientation] {
+		return videoPage{}, fmt.Errorf("unknown orientation %q", page.Orientation)
+	}
+	return page, nil
+}
+
+// nextCursor is the cursor for the page after this one.
+func (p videoPage) nextCursor() string {
+	return strconv.Itoa(p.Offset + p.Limit)
+}
+
+// next is the URL of the page after this one.
+func (p videoPage) next(current *url.URL) string {
+	query := current.Query()
+	query.Del("cursor")
+	query.Set("limit", strconv.Itoa(p.Limit))
+	query.Set("offset", p.nextCursor())
+	return current.Path + "?" + query.Encode()
+}
+
+// videoList is one page of the video list. NextCursor is left out on the
+// last page.
+type videoList struct {
+	Videos     []listedVideo `json:"videos"`
+	NextCursor string        `json:"next_cursor,omitempty"`
+}
+
+// handlerVideosRetrieve lists the caller's videos, newest first, a page at
+// a time. When there are more, the body's next_cursor and a Link header
+// with rel="next" both point at the next page.
 func (cfg *apiConfig) handlerVideosRetrieve(w http.ResponseWriter, r *http.Request) {
 	token, err := auth.GetBearerToken(r.Header)
 	if err != nil {
 		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
 		return
 	}
-	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret, cfg.jwtExpectations)
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		respondWithJWTError(w, err)
 		return
 	}
 
-	videos, err := cfg.db.GetVideos(userID)
+	page, err := parseVideoPage(r.URL.Query())
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error(), err)
+		return
+	}
+	// One extra row says whether there's another page
+	videos, err := cfg.db.GetVideos(database.GetVideosParams{
+		UserID:      userID,
+		Orientation: page.Orientation,
+		Limit:       page.Limit + 1,
+		Offset:      page.Offset,
+	})
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve videos", err)
 		return
 	}
+	list := videoList{Videos: []listedVideo{}}
+	if len(videos) > page.Limit {
+		videos = videos[:page.Limit]
+		list.NextCursor = page.nextCursor()
+		w.Header().Set("Link", fmt.Sprintf("<%s>; rel=\"next\"", page.next(r.URL)))
+	}
 
-	var videosPresigned []database.Video
+	var listExpiresAt time.Time
 	for _, video := range videos {
-		videoUpdated, err := cfg.dbVideoToSignedVideo(video)
+		videoUpdated, expiresAt, err := cfg.signVideo(r.Context(), video, dispositionInline)
 		if err != nil {
-			break
+			respondWithError(w, http.StatusInternalServerError, "failed to generate presigned video", err)
+			return
 		}
-		videosPresigned = append(videosPresigned, videoUpdated)
+		item := listedVideo{Video: videoUpdated}
+		if !expiresAt.IsZero() {
+			item.URLsExpireAt = &expiresAt
+			item.CacheMaxAge = max(int64(time.Until(expiresAt).Seconds()), 0)
+			if listExpiresAt.IsZero() || expiresAt.Before(listExpiresAt) {
+				listExpiresAt = expiresAt
+			}
+		}
+		list.Videos = append(list.Videos, item)
 	}
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "failed to generate presigned video", err)
-		return
+
+	// The list is only good for as long as its shortest-lived URL
+	if !listExpiresAt.IsZero() {
+		maxAge := max(int64(time.Until(listExpiresAt).Seconds()), 0)
+		w.Header().Set("Cache-Control", fmt.Sprintf("private, max-age=%d", maxAge))
+	} else {
+		w.Header().Set("Cache-Control", "private, no-cache")
 	}
-	respondWithJSON(w, http.StatusOK, videosPresigned)
+	respondWithNegotiatedJSON(w, r, http.StatusOK, list)
 }
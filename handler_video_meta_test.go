@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestParseVideoPage(t *testing.T) {
+	tests := []struct {
+		name    string
+		query   string
+		want    videoPage
+		wantErr bool
+	}{
+		{name: "defaults", query: "", want: videoPage{Limit: defaultVideoPageSize}},
+		{name: "limit and offset", query: "limit=10&offset=20", want: videoPage{Limit: 10, Offset: 20}},
+		{name: "largest limit", query: "limit=100", want: videoPage{Limit: maxVideoPageSize}},
+		{name: "orientation", query: "orientation=portrait", want: videoPage{Limit: defaultVideoPageSize, Orientation: "portrait"}},
+		{name: "zero limit", query: "limit=0", wantErr: true},
+		{name: "limit too large", query: "limit=101", wantErr: true},
+		{name: "limit not a number", query: "limit=ten", wantErr: true},
+		{name: "negative offset", query: "offset=-1", wantErr: true},
+		{name: "offset not a number", query: "offset=1.5", wantErr: true},
+		{name: "cursor", query: "limit=10&cursor=30", want: videoPage{Limit: 10, Offset: 30}},
+		{name: "offset wins over cursor", query: "offset=20&cursor=30", want: videoPage{Limit: defaultVideoPageSize, Offset: 20}},
+		{name: "bad cursor", query: "cursor=abc", wantErr: true},
+		{name: "unknown orientation", query: "orientation=diagonal", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query, err := url.ParseQuery(tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := parseVideoPage(query)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parseVideoPage(%q) = %+v, want an error", tt.query, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseVideoPage(%q) error = %v", tt.query, err)
+			}
+			if got != tt.want {
+				t.Errorf("parseVideoPage(%q) = %+v, want %+v", tt.query, got, tt.want)
+			}
+		})
+	}
+}
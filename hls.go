@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+const hlsManifestName = "index.m3u8"
+
+// generateHLS segments the video at inputPath into an HLS stream of
+// segmentDuration-second .ts segments plus index.m3u8, written to a new
+// temporary directory. The caller is responsible for removing the
+// directory.
+func generateHLS(tempDir, inputPath string, segmentDuration float64, threads int, retry retryPolicy) (string, error) {
+	if segmentDuration <= 0 {
+		return "", fmt.Errorf("segment duration must be positive")
+	}
+	dir, err := os.MkdirTemp(tempDir, "tubely-hls-*")
+	if err != nil {
+		return "", fmt.Errorf("create HLS directory: %w", err)
+	}
+	input, err := ffmpegPath(inputPath)
+	if err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+	manifest, err := ffmpegPath(filepath.Join(dir, hlsManifestName))
+	if err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+	segments, err := ffmpegPath(filepath.Join(dir, "segment_%05d.ts"))
+	if err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+
+	duration := strconv.FormatFloat(segmentDuration, 'f', -1, 64)
+	err = runFFmpeg(func(ctx context.Context) *exec.Cmd {
+		return exec.CommandContext(ctx,
+			"ffmpeg",
+			"-y",
+			"-v", "error",
+			"-i", input,
+			"-threads", strconv.Itoa(threads),
+			"-map", "0:v:0?", "-map", "0:a:0?",
+			"-c:v", "libx264", "-c:a", "aac",
+			// Keyframes on every boundary, so segments come out even
+			"-force_key_frames", "expr:gte(t,n_forced*"+duration+")",
+			"-f", "hls",
+			"-hls_time", duration,
+			"-hls_playlist_type", "vod",
+			"-hls_segment_filename", segments,
+			manifest,
+		)
+	}, retry)
+	if err != nil {
+		os.RemoveAll(dir)
+		return "", fmt.Errorf("ffmpeg HLS segmenting failed: %w", err)
+	}
+	return dir, nil
+}
+
+// uploadHLS segments inputPath and stores the manifest and segments under
+// prefix, returning the manifest's "bucket,key" location. Segments keep
+// the relative names the manifest refers to them by. If any piece fails
+// to upload, the ones already stored are deleted again.
+func (cfg *apiConfig) uploadHLS(ctx context.Context, inputPath, prefix string) (string, error) {
+	dir, err := generateHLS(cfg.tempDir, inputPath, cfg.hlsSegmentDuration, cfg.ffmpegThreads, cfg.ffmpegRetry)
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(dir)
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return "", fmt.Errorf("read HLS directory: %w", err)
+	}
+
+	ctx, cancel := cfg.s3Context(ctx)
+	defer cancel()
+	var stored []string
+	upload := func(name, contentType string) error {
+		f, err := os.Open(filepath.Join(dir, name))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		key := prefix + name
+		if err := cfg.putObject(ctx, key, contentType, f); err != nil {
+			return fmt.Errorf("upload HLS %s: %w", name, err)
+		}
+		stored = append(stored, cfg.s3Bucket+","+key)
+		return nil
+	}
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), ".ts") {
+			continue
+		}
+		if err := upload(entry.Name(), "video/mp2t"); err != nil {
+			cfg.deleteUploadedObjects(stored...)
+			return "", err
+		}
+	}
+	// The manifest goes last, so it never points at missing segments
+	if err := upload(hlsManifestName, "application/vnd.apple.mpegurl"); err != nil {
+		cfg.deleteUploadedObjects(stored...)
+		return "", err
+	}
+	return cfg.s3Bucket + "," + prefix + hlsManifestName, nil
+}
+
+// deleteHLS removes an HLS manifest and every segment stored beside it.
+func (cfg *apiConfig) deleteHLS(ctx context.Context, manifestLocation string) error {
+	bucket, key, err := parseVideoLocation(manifestLocation)
+	if err != nil {
+		return err
+	}
+	client := cfg.s3ClientForBucket(bucket)
+	keys, err := listObjectKeys(ctx, client, bucket, path.Dir(key)+"/")
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		_, err := client.DeleteObject(ctx, &s3.DeleteObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(key),
+		})
+		if err != nil {
+			cfg.logger.Error("couldn't delete HLS object", "bucket", bucket, "key", key, "error", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+)
+
+// generateIFrameTrack writes a small MP4 where every frame is a keyframe,
+// sampled every keyframeInterval seconds at 360p, so players can show scrub
+// previews without fetching full segments. It returns the new file path;
+// the caller is responsible for removing it.
+func generateIFrameTrack(tempDir, inputPath string, keyframeInterval float64, threads int, retry retryPolicy) (string, error) {
+	if keyframeInterval <= 0 {
+		return "", fmt.Errorf("keyframe interval must be positive")
+	}
+	out, err := os.CreateTemp(tempDir, "tubely-iframes-*.mp4")
+	if err != nil {
+		return "", fmt.Errorf("create I-frame track file: %w", err)
+	}
+	outPath := out.Name()
+	out.Close()
+	input, err := ffmpegPath(inputPath)
+	if err != nil {
+		os.Remove(outPath)
+		return "", err
+	}
+	output, err := ffmpegPath(outPath)
+	if err != nil {
+		os.Remove(outPath)
+		return "", err
+	}
+
+	err = runFFmpeg(func(ctx context.Context) *exec.Cmd {
+		return exec.CommandContext(ctx,
+			"ffmpeg",
+			"-y",
+			"-v", "error",
+			"-i", input,
+			"-threads", strconv.Itoa(threads),
+			"-an",
+			"-vf", fmt.Sprintf("fps=1/%s,scale=-2:360", strconv.FormatFloat(keyframeInterval, 'f', -1, 64)),
+			"-c:v", "libx264",
+			"-g", "1",
+			"-b:v", "200k",
+			"-pix_fmt", "yuv420p",
+			"-movflags", "faststart",
+			"-f", "mp4",
+			output,
+		)
+	}, retry)
+	if err != nil {
+		os.Remove(outPath)
+		return "", fmt.Errorf("ffmpeg I-frame track failed: %w", err)
+	}
+	return outPath, nil
+}
+
+// uploadIFrameTrack generates the preview track for inputPath and stores it
+// at key, returning its "bucket,key" location.
+func (cfg *apiConfig) uploadIFrameTrack(ctx context.Context, inputPath, key string) (string, error) {
+	trackPath, err := generateIFrameTrack(cfg.tempDir, inputPath, cfg.iframeInterval, cfg.ffmpegThreads, cfg.ffmpegRetry)
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(trackPath)
+
+	f, err := os.Open(trackPath)
+	if err != nil {
+		return "", fmt.Errorf("open I-frame track: %w", err)
+	}
+	defer f.Close()
+
+	ctx, cancel := cfg.s3Context(ctx)
+	defer cancel()
+	if err := cfg.putObject(ctx, key, "video/mp4", f); err != nil {
+		return "", fmt.Errorf("upload I-frame track: %w", err)
+	}
+	return cfg.s3Bucket + "," + key, nil
+}
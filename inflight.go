@@ -0,0 +1,32 @@
+package main
+
+import "sync"
+
+// inflightUploads remembers which uploads are being processed right now, so
+// an identical second request (a double-clicked upload button, a client
+// retrying too eagerly) is turned away instead of racing the first one.
+type inflightUploads struct {
+	mu   sync.Mutex
+	keys map[string]struct{}
+}
+
+func newInflightUploads() *inflightUploads {
+	return &inflightUploads{keys: make(map[string]struct{})}
+}
+
+// tryAcquire claims key. It reports false if another request holds it;
+// otherwise the returned func must be called once the upload finishes,
+// whether it succeeded or not.
+func (u *inflightUploads) tryAcquire(key string) (release func(), ok bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if _, busy := u.keys[key]; busy {
+		return nil, false
+	}
+	u.keys[key] = struct{}{}
+	return func() {
+		u.mu.Lock()
+		delete(u.keys, key)
+		u.mu.Unlock()
+	}, true
+}
@@ -22,6 +22,30 @@ const (
 
 var ErrNoAuthHeaderIncluded = errors.New("no auth header included in request")
 
+var (
+	ErrInvalidIssuer   = errors.New("token issuer not accepted")
+	ErrInvalidAudience = errors.New("token audience not accepted")
+	ErrTokenExpired    = errors.New("token has expired")
+	// ErrMissingExpiry rejects tokens without an exp claim, which the JWT
+	// library would otherwise accept forever.
+	ErrMissingExpiry = errors.New("token has no expiry")
+)
+
+// TokenExpectations are the issuer and audience stamped into access tokens
+// and required when validating them. An empty Issuer means TokenTypeAccess;
+// an empty Audience leaves the audience unset and unchecked.
+type TokenExpectations struct {
+	Issuer   string
+	Audience string
+}
+
+func (e TokenExpectations) issuer() string {
+	if e.Issuer == "" {
+		return string(TokenTypeAccess)
+	}
+	return e.Issuer
+}
+
 func HashPassword(password string) (string, error) {
 	dat, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
 	if err != nil {
@@ -38,40 +62,60 @@ func MakeJWT(
 	userID uuid.UUID,
 	tokenSecret string,
 	expiresIn time.Duration,
+	expect TokenExpectations,
 ) (string, error) {
 	signingKey := []byte(tokenSecret)
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{
-		Issuer:    string(TokenTypeAccess),
+	claims := jwt.RegisteredClaims{
+		Issuer:    expect.issuer(),
 		IssuedAt:  jwt.NewNumericDate(time.Now().UTC()),
 		ExpiresAt: jwt.NewNumericDate(time.Now().UTC().Add(expiresIn)),
 		Subject:   userID.String(),
-	})
+	}
+	if expect.Audience != "" {
+		claims.Audience = jwt.ClaimStrings{expect.Audience}
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
 	return token.SignedString(signingKey)
 }
 
-func ValidateJWT(tokenString, tokenSecret string) (uuid.UUID, error) {
+// ValidateJWT checks an access token's signature, expiry, issuer and
+// audience and returns the user it was issued to. Only HS256 tokens are
+// accepted, so a token can't pick a weaker algorithm for itself.
+func ValidateJWT(tokenString, tokenSecret string, expect TokenExpectations) (uuid.UUID, error) {
+	opts := []jwt.ParserOption{
+		jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}),
+		jwt.WithIssuer(expect.issuer()),
+	}
+	if expect.Audience != "" {
+		opts = append(opts, jwt.WithAudience(expect.Audience))
+	}
+
 	claimsStruct := jwt.RegisteredClaims{}
 	token, err := jwt.ParseWithClaims(
 		tokenString,
 		&claimsStruct,
 		func(token *jwt.Token) (interface{}, error) { return []byte(tokenSecret), nil },
+		opts...,
 	)
 	if err != nil {
+		switch {
+		case errors.Is(err, jwt.ErrTokenInvalidIssuer):
+			return uuid.Nil, ErrInvalidIssuer
+		case errors.Is(err, jwt.ErrTokenInvalidAudience):
+			return uuid.Nil, ErrInvalidAudience
+		case errors.Is(err, jwt.ErrTokenExpired):
+			return uuid.Nil, ErrTokenExpired
+		}
 		return uuid.Nil, err
 	}
-
-	userIDString, err := token.Claims.GetSubject()
-	if err != nil {
-		return uuid.Nil, err
+	if claimsStruct.ExpiresAt == nil {
+		return uuid.Nil, ErrMissingExpiry
 	}
 
-	issuer, err := token.Claims.GetIssuer()
+	userIDString, err := token.Claims.GetSubject()
 	if err != nil {
 		return uuid.Nil, err
 	}
-	if issuer != string(TokenTypeAccess) {
-		return uuid.Nil, errors.New("invalid issuer")
-	}
 
 	id, err := uuid.Parse(userIDString)
 	if err != nil {
@@ -102,6 +146,29 @@ func MakeRefreshToken() (string, error) {
 	return hex.EncodeToString(token), nil
 }
 
+var (
+	ErrRefreshTokenExpired = errors.New("refresh token has expired")
+	ErrRefreshTokenRevoked = errors.New("refresh token has been revoked")
+	// ErrRefreshTokenReused means a token that was already exchanged came
+	// back, so it has probably leaked. Callers should revoke its family.
+	ErrRefreshTokenReused = errors.New("refresh token was already used")
+)
+
+// ValidateRefreshToken checks a stored refresh token's state at now.
+// Reuse is reported ahead of revocation, so replaying a token from a
+// revoked family is still flagged as reuse.
+func ValidateRefreshToken(expiresAt time.Time, revokedAt, rotatedAt *time.Time, now time.Time) error {
+	switch {
+	case rotatedAt != nil:
+		return ErrRefreshTokenReused
+	case revokedAt != nil:
+		return ErrRefreshTokenRevoked
+	case !now.Before(expiresAt):
+		return ErrRefreshTokenExpired
+	}
+	return nil
+}
+
 func GetAPIKey(headers http.Header) (string, error) {
 	authHeader := headers.Get("Authorization")
 	if authHeader == "" {
@@ -0,0 +1,112 @@
+package auth
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+func TestValidateJWT(t *testing.T) {
+	userID := uuid.New()
+	const secret = "correct-secret"
+
+	mustMake := func(secret string, expiresIn time.Duration, expect TokenExpectations) string {
+		t.Helper()
+		token, err := MakeJWT(userID, secret, expiresIn, expect)
+		if err != nil {
+			t.Fatalf("MakeJWT: %v", err)
+		}
+		return token
+	}
+	noExpiry, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{
+		Issuer:  string(TokenTypeAccess),
+		Subject: userID.String(),
+	}).SignedString([]byte(secret))
+	if err != nil {
+		t.Fatalf("signing token without expiry: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		token   string
+		secret  string
+		expect  TokenExpectations
+		wantErr error
+		anyErr  bool
+	}{
+		{
+			name:   "valid",
+			token:  mustMake(secret, time.Hour, TokenExpectations{}),
+			secret: secret,
+		},
+		{
+			name:   "valid with audience",
+			token:  mustMake(secret, time.Hour, TokenExpectations{Audience: "tubely-web"}),
+			secret: secret,
+			expect: TokenExpectations{Audience: "tubely-web"},
+		},
+		{
+			name:    "expired",
+			token:   mustMake(secret, -time.Minute, TokenExpectations{}),
+			secret:  secret,
+			wantErr: ErrTokenExpired,
+		},
+		{
+			name:    "wrong issuer",
+			token:   mustMake(secret, time.Hour, TokenExpectations{Issuer: "someone-else"}),
+			secret:  secret,
+			wantErr: ErrInvalidIssuer,
+		},
+		{
+			name:    "wrong audience",
+			token:   mustMake(secret, time.Hour, TokenExpectations{Audience: "tubely-admin"}),
+			secret:  secret,
+			expect:  TokenExpectations{Audience: "tubely-web"},
+			wantErr: ErrInvalidAudience,
+		},
+		{
+			name:    "wrong secret",
+			token:   mustMake(secret, time.Hour, TokenExpectations{}),
+			secret:  "wrong-secret",
+			wantErr: jwt.ErrTokenSignatureInvalid,
+		},
+		{
+			name:    "no expiry",
+			token:   noExpiry,
+			secret:  secret,
+			wantErr: ErrMissingExpiry,
+		},
+		{
+			name:   "malformed",
+			token:  "not-a-jwt",
+			secret: secret,
+			anyErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ValidateJWT(tt.token, tt.secret, tt.expect)
+			switch {
+			case tt.wantErr != nil:
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("ValidateJWT() error = %v, want %v", err, tt.wantErr)
+				}
+			case tt.anyErr:
+				if err == nil {
+					t.Fatal("ValidateJWT() error = nil, want an error")
+				}
+			default:
+				if err != nil {
+					t.Fatalf("ValidateJWT() error = %v", err)
+				}
+				if got != userID {
+					t.Fatalf("ValidateJWT() = %v, want %v", got, userID)
+				}
+			}
+		})
+	}
+}
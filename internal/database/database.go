@@ -1,6 +1,7 @@
 package database
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 
@@ -54,6 +55,14 @@ func (c *Client) autoMigrate() error {
 	if err != nil {
 		return err
 	}
+	// Rotation ties every refresh token to the login it descends from.
+	// Tokens from before rotation have no family and stand for their own
+	if err := c.addColumnIfMissing("refresh_tokens", "family_id", "TEXT"); err != nil {
+		return err
+	}
+	if err := c.addColumnIfMissing("refresh_tokens", "rotated_at", "TIMESTAMP"); err != nil {
+		return err
+	}
 
 	videoTable := `
 	CREATE TABLE IF NOT EXISTS videos (
@@ -72,9 +81,84 @@ func (c *Client) autoMigrate() error {
 	if err != nil {
 		return err
 	}
+
+	videoColumnsAdded := []struct{ name, definition string }{
+		{"chapters", "TEXT"},
+		{"bitrate", "INTEGER"},
+		{"replica_url", "TEXT"},
+		{"iframe_url", "TEXT"},
+		{"original_filename", "TEXT"},
+		{"audio_only", "BOOLEAN NOT NULL DEFAULT 0"},
+		{"quality_warnings", "TEXT"},
+		{"duration", "REAL"},
+		{"audio_languages", "TEXT"},
+		{"thumbnail_placeholder", "TEXT"},
+		{"content_hash", "TEXT"},
+		{"renditions", "TEXT"},
+		{"hls_url", "TEXT"},
+		{"status", "TEXT NOT NULL DEFAULT ''"},
+		{"thumbnail_width", "INTEGER"},
+		{"thumbnail_height", "INTEGER"},
+		{"poster_timestamp", "REAL"},
+	}
+	for _, col := range videoColumnsAdded {
+		if err := c.addColumnIfMissing("videos", col.name, col.definition); err != nil {
+			return err
+		}
+	}
+
+	_, err = c.db.Exec(`CREATE INDEX IF NOT EXISTS videos_content_hash ON videos(content_hash)`)
+	if err != nil {
+		return err
+	}
+
+	// Videos uploaded before statuses were tracked are finished
+	_, err = c.db.Exec(`UPDATE videos SET status = 'ready' WHERE status = '' AND video_url IS NOT NULL`)
+	return err
+}
+
+// addColumnIfMissing grows a table created by an older version of the app.
+// CREATE TABLE IF NOT EXISTS never touches existing tables, so new columns
+// have to be added explicitly.
+func (c *Client) addColumnIfMissing(table, column, definition string) error {
+	rows, err := c.db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			cid       int
+			name      string
+			colType   string
+			notNull   int
+			dfltValue sql.NullString
+			pk        int
+		)
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &dfltValue, &pk); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	_, err = c.db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	if err != nil {
+		return fmt.Errorf("failed to add column %s.%s: %w", table, column, err)
+	}
 	return nil
 }
 
+// Ping checks the database can still be queried.
+func (c Client) Ping(ctx context.Context) error {
+	return c.db.PingContext(ctx)
+}
+
 func (c Client) Reset() error {
 	if _, err := c.db.Exec("DELETE FROM refresh_tokens"); err != nil {
 		return fmt.Errorf("failed to reset table refresh_tokens: %w", err)
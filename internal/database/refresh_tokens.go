@@ -12,12 +12,18 @@ type RefreshToken struct {
 	CreatedAt time.Time  `json:"created_at"`
 	UpdatedAt time.Time  `json:"updated_at"`
 	RevokedAt *time.Time `json:"revoked_at"`
+	// RotatedAt is when the token was exchanged for its successor. A
+	// rotated token presented again has been replayed.
+	RotatedAt *time.Time `json:"rotated_at"`
 }
 
 type CreateRefreshTokenParams struct {
 	Token     string    `json:"token"`
 	UserID    uuid.UUID `json:"user_id"`
 	ExpiresAt time.Time `json:"expires_at"`
+	// FamilyID is shared by every token rotated from the same login. It
+	// defaults to the token itself, starting a new family.
+	FamilyID string `json:"family_id"`
 }
 
 func (c Client) CreateRefreshToken(params CreateRefreshTokenParams) (RefreshToken, error) {
@@ -27,10 +33,11 @@ func (c Client) CreateRefreshToken(params CreateRefreshTokenParams) (RefreshToke
 			created_at,
 			updated_at,
 			user_id,
-			expires_at
-		) VALUES (?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?, ?)
+			expires_at,
+			family_id
+		) VALUES (?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?, ?, ?)
 	`
-	_, err := c.db.Exec(query, params.Token, params.UserID.String(), params.ExpiresAt)
+	_, err := c.db.Exec(query, params.Token, params.UserID.String(), params.ExpiresAt, params.familyID())
 	if err != nil {
 		return RefreshToken{}, err
 	}
@@ -38,6 +45,63 @@ func (c Client) CreateRefreshToken(params CreateRefreshTokenParams) (RefreshToke
 	return c.GetRefreshToken(params.Token)
 }
 
+func (p CreateRefreshTokenParams) familyID() string {
+	if p.FamilyID == "" {
+		return p.Token
+	}
+	return p.FamilyID
+}
+
+// RotateRefreshToken marks old as used and stores next in its place. It
+// returns false, storing nothing, if old was already rotated or revoked,
+// e.g. by a concurrent request presenting the same token.
+func (c Client) RotateRefreshToken(old string, next CreateRefreshTokenParams) (bool, error) {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`
+		UPDATE refresh_tokens
+		SET rotated_at = CURRENT_TIMESTAMP, updated_at = CURRENT_TIMESTAMP
+		WHERE token = ? AND rotated_at IS NULL AND revoked_at IS NULL
+	`, old)
+	if err != nil {
+		return false, err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return false, err
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO refresh_tokens (
+			token,
+			created_at,
+			updated_at,
+			user_id,
+			expires_at,
+			family_id
+		) VALUES (?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?, ?, ?)
+	`, next.Token, next.UserID.String(), next.ExpiresAt, next.familyID())
+	if err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// RevokeRefreshTokenFamily revokes every token rotated from the same
+// login, ending that session everywhere.
+func (c Client) RevokeRefreshTokenFamily(familyID string) error {
+	query := `
+		UPDATE refresh_tokens
+		SET revoked_at = CURRENT_TIMESTAMP, updated_at = CURRENT_TIMESTAMP
+		WHERE COALESCE(family_id, token) = ? AND revoked_at IS NULL
+	`
+	_, err := c.db.Exec(query, familyID)
+	return err
+}
+
 func (c Client) RevokeRefreshToken(token string) error {
 	query := `
 		UPDATE refresh_tokens
@@ -50,14 +114,14 @@ func (c Client) RevokeRefreshToken(token string) error {
 
 func (c Client) GetRefreshToken(token string) (RefreshToken, error) {
 	query := `
-		SELECT token, created_at, updated_at, user_id, expires_at, revoked_at
+		SELECT token, created_at, updated_at, user_id, expires_at, revoked_at, COALESCE(family_id, token), rotated_at
 		FROM refresh_tokens
 		WHERE token = ?
 	`
 	var rt RefreshToken
 	var userID string
 	err := c.db.QueryRow(query, token).
-		Scan(&rt.Token, &rt.CreatedAt, &rt.UpdatedAt, &userID, &rt.ExpiresAt, &rt.RevokedAt)
+		Scan(&rt.Token, &rt.CreatedAt, &rt.UpdatedAt, &userID, &rt.ExpiresAt, &rt.RevokedAt, &rt.FamilyID, &rt.RotatedAt)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return RefreshToken{}, nil
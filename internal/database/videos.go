@@ -2,6 +2,7 @@ package database
 
 import (
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"time"
 
@@ -14,6 +15,48 @@ type Video struct {
 	UpdatedAt    time.Time `json:"updated_at"`
 	ThumbnailURL *string   `json:"thumbnail_url"`
 	VideoURL     *string   `json:"video_url"`
+	Chapters     []Chapter `json:"chapters,omitempty"`
+	Bitrate      *int64    `json:"bitrate"`
+	// Duration is the length in seconds, nil when the file doesn't say.
+	Duration *float64 `json:"duration"`
+	// IFrameURL is a keyframe-only preview track for scrubbing.
+	IFrameURL *string `json:"iframe_url,omitempty"`
+	// HLSURL is the "bucket,key" of an HLS manifest; its segments sit
+	// beside it under the same prefix.
+	HLSURL *string `json:"hls_url,omitempty"`
+	// OriginalFilename is the name the video was uploaded with, used for
+	// download links.
+	OriginalFilename *string `json:"original_filename,omitempty"`
+	// AudioOnly marks podcast-style uploads with no video stream.
+	AudioOnly bool `json:"audio_only"`
+	// QualityWarnings flag likely recording failures, e.g. "mostly_black".
+	QualityWarnings []string `json:"quality_warnings,omitempty"`
+	// ThumbnailPlaceholder is a tiny data URI to show while the thumbnail
+	// loads.
+	ThumbnailPlaceholder *string `json:"thumbnail_placeholder,omitempty"`
+	// ThumbnailWidth and ThumbnailHeight are the stored thumbnail's size
+	// in pixels, nil for thumbnails saved before they were recorded.
+	ThumbnailWidth  *int `json:"thumbnail_width,omitempty"`
+	ThumbnailHeight *int `json:"thumbnail_height,omitempty"`
+	// PosterTimestamp is the second of the video the thumbnail was taken
+	// from, when it's a poster frame grabbed at a known time. It's nil for
+	// uploaded thumbnails, which a new upload of the video leaves alone.
+	PosterTimestamp *float64 `json:"poster_timestamp,omitempty"`
+	// AudioLanguages lists the language of each audio track, e.g.
+	// ["eng", "spa"].
+	AudioLanguages []string `json:"audio_languages,omitempty"`
+	// Renditions are lower resolution copies for adaptive playback. They
+	// are made in the background, so a new upload starts without them.
+	Renditions []Rendition `json:"renditions,omitempty"`
+	// ContentHash is the hex SHA-256 of the uploaded file, before any
+	// processing.
+	ContentHash *string `json:"content_hash,omitempty"`
+	// Status is where the video's latest upload is, one of the
+	// VideoStatus values, or empty if nothing was ever uploaded. It's only
+	// written by SetVideoStatus.
+	Status VideoStatus `json:"status,omitempty"`
+	// ReplicaURL is the "bucket,key" of the copy in the secondary region.
+	ReplicaURL *string `json:"-"`
 	CreateVideoParams
 }
 
@@ -23,9 +66,36 @@ type CreateVideoParams struct {
 	UserID      uuid.UUID `json:"user_id"`
 }
 
-func (c Client) GetVideos(userID uuid.UUID) ([]Video, error) {
-	query := `
-	SELECT
+// Chapter is a named section of a video, in seconds from the start.
+type Chapter struct {
+	Start float64 `json:"start"`
+	End   float64 `json:"end"`
+	Title string  `json:"title"`
+}
+
+// VideoStatus tracks an upload through processing.
+type VideoStatus string
+
+const (
+	VideoStatusUploading  VideoStatus = "uploading"
+	VideoStatusProcessing VideoStatus = "processing"
+	VideoStatusReady      VideoStatus = "ready"
+	// VideoStatusFailed means the latest upload failed. VideoURL still
+	// points at the previous file, if there was one.
+	VideoStatusFailed VideoStatus = "failed"
+)
+
+// Rendition is a copy of a video scaled down to a given height, stored
+// in S3 as "bucket,key" like VideoURL until it's signed.
+type Rendition struct {
+	Name   string `json:"name"`
+	Height int    `json:"height"`
+	URL    string `json:"url"`
+}
+
+// videoColumns is the column list every video query selects, in the order
+// scanVideo expects.
+const videoColumns = `
 		id,
 		created_at,
 		updated_at,
@@ -33,13 +103,120 @@ func (c Client) GetVideos(userID uuid.UUID) ([]Video, error) {
 		description,
 		thumbnail_url,
 		video_url,
-		user_id
+		user_id,
+		chapters,
+		bitrate,
+		replica_url,
+		iframe_url,
+		original_filename,
+		audio_only,
+		quality_warnings,
+		duration,
+		audio_languages,
+		thumbnail_placeholder,
+		content_hash,
+		renditions,
+		hls_url,
+		status,
+		thumbnail_width,
+		thumbnail_height,
+		poster_timestamp`
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanVideo(row rowScanner) (Video, error) {
+	var video Video
+	var chapters, qualityWarnings, audioLanguages, renditions sql.NullString
+	if err := row.Scan(
+		&video.ID,
+		&video.CreatedAt,
+		&video.UpdatedAt,
+		&video.Title,
+		&video.Description,
+		&video.ThumbnailURL,
+		&video.VideoURL,
+		&video.UserID,
+		&chapters,
+		&video.Bitrate,
+		&video.ReplicaURL,
+		&video.IFrameURL,
+		&video.OriginalFilename,
+		&video.AudioOnly,
+		&qualityWarnings,
+		&video.Duration,
+		&audioLanguages,
+		&video.ThumbnailPlaceholder,
+		&video.ContentHash,
+		&renditions,
+		&video.HLSURL,
+		&video.Status,
+		&video.ThumbnailWidth,
+		&video.ThumbnailHeight,
+		&video.PosterTimestamp,
+	); err != nil {
+		return Video{}, err
+	}
+	if chapters.Valid && chapters.String != "" {
+		if err := json.Unmarshal([]byte(chapters.String), &video.Chapters); err != nil {
+			return Video{}, err
+		}
+	}
+	if qualityWarnings.Valid && qualityWarnings.String != "" {
+		if err := json.Unmarshal([]byte(qualityWarnings.String), &video.QualityWarnings); err != nil {
+			return Video{}, err
+		}
+	}
+	if audioLanguages.Valid && audioLanguages.String != "" {
+		if err := json.Unmarshal([]byte(audioLanguages.String), &video.AudioLanguages); err != nil {
+			return Video{}, err
+		}
+	}
+	if renditions.Valid && renditions.String != "" {
+		if err := json.Unmarshal([]byte(renditions.String), &video.Renditions); err != nil {
+			return Video{}, err
+		}
+	}
+	return video, nil
+}
+
+// GetVideosParams selects a page of one user's videos.
+type GetVideosParams struct {
+	UserID uuid.UUID
+	// Orientation keeps only videos stored under that key prefix, e.g.
+	// "landscape". Empty means all of them.
+	Orientation string
+	// Limit of 0 means no limit.
+	Limit  int
+	Offset int
+}
+
+// GetVideos returns a user's videos, newest first.
+func (c Client) GetVideos(params GetVideosParams) ([]Video, error) {
+	query := `
+	SELECT` + videoColumns + `
 	FROM videos
 	WHERE user_id = ?
-	ORDER BY created_at DESC
 	`
+	args := []any{params.UserID}
+	if params.Orientation != "" {
+		// video_url is "bucket,orientation/key"
+		query += `AND video_url LIKE ?
+	`
+		args = append(args, "%,"+params.Orientation+"/%")
+	}
+	limit := params.Limit
+	if limit <= 0 {
+		limit = -1
+	}
+	// id breaks ties so pages never overlap
+	query += `ORDER BY created_at DESC, id
+	LIMIT ? OFFSET ?
+	`
+	args = append(args, limit, params.Offset)
 
-	rows, err := c.db.Query(query, userID)
+	rows, err := c.db.Query(query, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -47,17 +224,8 @@ func (c Client) GetVideos(userID uuid.UUID) ([]Video, error) {
 
 	videos := []Video{}
 	for rows.Next() {
-		var video Video
-		if err := rows.Scan(
-			&video.ID,
-			&video.CreatedAt,
-			&video.UpdatedAt,
-			&video.Title,
-			&video.Description,
-			&video.ThumbnailURL,
-			&video.VideoURL,
-			&video.UserID,
-		); err != nil {
+		video, err := scanVideo(rows)
+		if err != nil {
 			return nil, err
 		}
 		videos = append(videos, video)
@@ -88,29 +256,12 @@ func (c Client) CreateVideo(params CreateVideoParams) (Video, error) {
 
 func (c Client) GetVideo(id uuid.UUID) (Video, error) {
 	query := `
-	SELECT
-		id,
-		created_at,
-		updated_at,
-		title,
-		description,
-		thumbnail_url,
-		video_url,
-		user_id
+	SELECT` + videoColumns + `
 	FROM videos
 	WHERE id = ?
 	`
 
-	var video Video
-	err := c.db.QueryRow(query, id).Scan(
-		&video.ID,
-		&video.CreatedAt,
-		&video.UpdatedAt,
-		&video.Title,
-		&video.Description,
-		&video.ThumbnailURL,
-		&video.VideoURL,
-		&video.UserID)
+	video, err := scanVideo(c.db.QueryRow(query, id))
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return Video{}, nil
@@ -121,7 +272,81 @@ func (c Client) GetVideo(id uuid.UUID) (Video, error) {
 	return video, nil
 }
 
+// GetVideoByContentHash finds the most recently updated video, other than
+// exclude, whose uploaded file had the given hash. Like GetVideo, no match
+// is a zero Video rather than an error.
+func (c Client) GetVideoByContentHash(hash string, exclude uuid.UUID) (Video, error) {
+	query := `
+	SELECT` + videoColumns + `
+	FROM videos
+	WHERE content_hash = ? AND id != ? AND video_url IS NOT NULL
+	ORDER BY updated_at DESC
+	LIMIT 1
+	`
+
+	video, err := scanVideo(c.db.QueryRow(query, hash, exclude))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Video{}, nil
+		}
+		return Video{}, err
+	}
+	return video, nil
+}
+
+// ThumbnailInUse reports whether any video other than exclude has the
+// given thumbnail URL. Identical thumbnails share one file.
+func (c Client) ThumbnailInUse(thumbnailURL string, exclude uuid.UUID) (bool, error) {
+	query := `
+	SELECT EXISTS(SELECT 1 FROM videos WHERE thumbnail_url = ? AND id != ?)
+	`
+	var inUse bool
+	err := c.db.QueryRow(query, thumbnailURL, exclude).Scan(&inUse)
+	return inUse, err
+}
+
+// VideoURLInUse reports whether any video other than exclude points at
+// the given video location. Deduplicated uploads share their objects.
+func (c Client) VideoURLInUse(videoURL string, exclude uuid.UUID) (bool, error) {
+	query := `
+	SELECT EXISTS(SELECT 1 FROM videos WHERE video_url = ? AND id != ?)
+	`
+	var inUse bool
+	err := c.db.QueryRow(query, videoURL, exclude).Scan(&inUse)
+	return inUse, err
+}
+
 func (c Client) UpdateVideo(video Video) error {
+	var chapters *string
+	if len(video.Chapters) > 0 {
+		dat, err := json.Marshal(video.Chapters)
+		if err != nil {
+			return err
+		}
+		s := string(dat)
+		chapters = &s
+	}
+
+	var qualityWarnings *string
+	if len(video.QualityWarnings) > 0 {
+		dat, err := json.Marshal(video.QualityWarnings)
+		if err != nil {
+			return err
+		}
+		s := string(dat)
+		qualityWarnings = &s
+	}
+
+	var audioLanguages *string
+	if len(video.AudioLanguages) > 0 {
+		dat, err := json.Marshal(video.AudioLanguages)
+		if err != nil {
+			return err
+		}
+		s := string(dat)
+		audioLanguages = &s
+	}
+
 	query := `
 	UPDATE videos
 	SET
@@ -129,7 +354,21 @@ func (c Client) UpdateVideo(video Video) error {
 		description = ?,
 		thumbnail_url = ?,
 		video_url = ?,
-		user_id = ?
+		user_id = ?,
+		chapters = ?,
+		bitrate = ?,
+		iframe_url = ?,
+		original_filename = ?,
+		audio_only = ?,
+		quality_warnings = ?,
+		duration = ?,
+		audio_languages = ?,
+		thumbnail_placeholder = ?,
+		content_hash = ?,
+		hls_url = ?,
+		thumbnail_width = ?,
+		thumbnail_height = ?,
+		poster_timestamp = ?
 	WHERE id = ?
 	`
 
@@ -140,11 +379,94 @@ func (c Client) UpdateVideo(video Video) error {
 		&video.ThumbnailURL,
 		&video.VideoURL,
 		video.UserID,
+		chapters,
+		video.Bitrate,
+		video.IFrameURL,
+		video.OriginalFilename,
+		video.AudioOnly,
+		qualityWarnings,
+		video.Duration,
+		audioLanguages,
+		video.ThumbnailPlaceholder,
+		video.ContentHash,
+		video.HLSURL,
+		video.ThumbnailWidth,
+		video.ThumbnailHeight,
+		video.PosterTimestamp,
 		video.ID,
 	)
 	return err
 }
 
+// SetVideoRenditions replaces a video's renditions without touching the
+// rest of the row, like SetVideoReplicaURL. nil clears them. Renditions
+// belong to one file, so nothing is stored, and false is returned, unless
+// the video is still at videoURL.
+func (c Client) SetVideoRenditions(id uuid.UUID, videoURL string, renditions []Rendition) (bool, error) {
+	var encoded *string
+	if len(renditions) > 0 {
+		dat, err := json.Marshal(renditions)
+		if err != nil {
+			return false, err
+		}
+		s := string(dat)
+		encoded = &s
+	}
+
+	query := `
+	UPDATE videos
+	SET renditions = ?
+	WHERE id = ? AND video_url = ?
+	`
+	res, err := c.db.Exec(query, encoded, id, videoURL)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// SetVideoStatus records how far a video's upload has got, without
+// touching the rest of the row.
+func (c Client) SetVideoStatus(id uuid.UUID, status VideoStatus) error {
+	query := `
+	UPDATE videos
+	SET status = ?
+	WHERE id = ?
+	`
+	_, err := c.db.Exec(query, status, id)
+	return err
+}
+
+// FailInterruptedVideos marks every video still uploading or processing as
+// failed and returns how many there were. It's for startup, when nothing
+// can still be working on them.
+func (c Client) FailInterruptedVideos() (int64, error) {
+	query := `
+	UPDATE videos
+	SET status = ?
+	WHERE status IN (?, ?)
+	`
+	res, err := c.db.Exec(query, VideoStatusFailed, VideoStatusUploading, VideoStatusProcessing)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// SetVideoReplicaURL records a replica location without touching the rest
+// of the row, so a background copy can't overwrite concurrent edits.
+// nil clears it.
+func (c Client) SetVideoReplicaURL(id uuid.UUID, replicaURL *string) error {
+	query := `
+	UPDATE videos
+	SET replica_url = ?
+	WHERE id = ?
+	`
+	_, err := c.db.Exec(query, replicaURL, id)
+	return err
+}
+
 func (c Client) DeleteVideo(id uuid.UUID) error {
 	query := `
 	DELETE FROM videos
@@ -2,16 +2,24 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"log"
+	"log/slog"
+	"math"
 	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
 )
 
 func respondWithError(w http.ResponseWriter, code int, msg string, err error) {
-	if err != nil {
-		log.Println(err)
-	}
+	// Server errors always need a look; client errors only matter when
+	// there's an underlying error to explain them
 	if code > 499 {
-		log.Printf("Responding with 5XX error: %s", msg)
+		slog.Error("responding with error", "status", code, "message", msg, "error", err)
+	} else if err != nil {
+		slog.Info("responding with error", "status", code, "message", msg, "error", err)
 	}
 	type errorResponse struct {
 		Error string `json:"error"`
@@ -21,6 +29,41 @@ func respondWithError(w http.ResponseWriter, code int, msg string, err error) {
 	})
 }
 
+// respondWithUnavailable sends a 503 with a Retry-After hint so clients back
+// off instead of retrying straight into an overloaded server.
+func respondWithUnavailable(w http.ResponseWriter, retryAfter time.Duration, msg string, err error) {
+	respondWithRetryAfter(w, http.StatusServiceUnavailable, retryAfter, msg, err)
+}
+
+// respondWithRetryAfter sends an error with a Retry-After header, rounded
+// up to whole seconds and at least one.
+func respondWithRetryAfter(w http.ResponseWriter, code int, retryAfter time.Duration, msg string, err error) {
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	respondWithError(w, code, msg, err)
+}
+
+// respondWithJWTError answers a failed token validation with a 401, naming
+// issuer and audience mismatches so clients can tell a token minted for
+// another service from an expired or forged one.
+func respondWithJWTError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, auth.ErrInvalidIssuer):
+		respondWithError(w, http.StatusUnauthorized, "JWT issuer not accepted", err)
+	case errors.Is(err, auth.ErrInvalidAudience):
+		respondWithError(w, http.StatusUnauthorized, "JWT audience not accepted", err)
+	case errors.Is(err, auth.ErrTokenExpired):
+		respondWithError(w, http.StatusUnauthorized, "JWT has expired", err)
+	case errors.Is(err, auth.ErrMissingExpiry):
+		respondWithError(w, http.StatusUnauthorized, "JWT has no expiry", err)
+	default:
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+	}
+}
+
 func respondWithJSON(w http.ResponseWriter, code int, payload interface{}) {
 	w.Header().Set("Content-Type", "application/json")
 	dat, err := json.Marshal(payload)
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+const (
+	jsonNamingSnake = "snake_case"
+	jsonNamingCamel = "camelCase"
+)
+
+// jsonNamingFor reads the field naming a client asked for through the
+// profile parameter of its Accept header, e.g.
+// `Accept: application/json; profile=camelCase`. Anything else gets the
+// default snake_case names.
+func jsonNamingFor(r *http.Request) string {
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(accept))
+		if err != nil || (mediaType != "application/json" && mediaType != "*/*") {
+			continue
+		}
+		if strings.EqualFold(params["profile"], jsonNamingCamel) {
+			return jsonNamingCamel
+		}
+	}
+	return jsonNamingSnake
+}
+
+// respondWithNegotiatedJSON is respondWithJSON with the field naming the
+// client asked for.
+func respondWithNegotiatedJSON(w http.ResponseWriter, r *http.Request, code int, payload interface{}) {
+	w.Header().Add("Vary", "Accept")
+	if jsonNamingFor(r) != jsonNamingCamel {
+		respondWithJSON(w, code, payload)
+		return
+	}
+
+	dat, err := json.Marshal(payload)
+	if err != nil {
+		log.Printf("Error marshalling JSON: %s", err)
+		w.WriteHeader(500)
+		return
+	}
+	decoder := json.NewDecoder(bytes.NewReader(dat))
+	decoder.UseNumber()
+	var generic interface{}
+	if err := decoder.Decode(&generic); err != nil {
+		log.Printf("Error re-reading JSON: %s", err)
+		w.WriteHeader(500)
+		return
+	}
+	respondWithJSON(w, code, camelCaseKeys(generic))
+}
+
+func camelCaseKeys(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(v))
+		for k, val := range v {
+			out[snakeToCamel(k)] = camelCaseKeys(val)
+		}
+		return out
+	case []interface{}:
+		for i := range v {
+			v[i] = camelCaseKeys(v[i])
+		}
+		return v
+	default:
+		return v
+	}
+}
+
+func snakeToCamel(s string) string {
+	parts := strings.Split(s, "_")
+	for i := 1; i < len(parts); i++ {
+		if parts[i] != "" {
+			parts[i] = strings.ToUpper(parts[i][:1]) + parts[i][1:]
+		}
+	}
+	return strings.Join(parts, "")
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math"
+	"runtime"
+	"sync"
+	"time"
+)
+
+var errPipelineSaturated = errors.New("processing pipeline is saturated")
+
+// processLimiter bounds how many jobs of one kind (ffprobe calls, ffmpeg
+// transcodes) run at once and how many more may wait for a slot. Anything beyond that is turned away so the
+// pipeline sheds load instead of piling up blocked requests.
+type processLimiter struct {
+	slots         chan struct{}
+	maxQueue      int
+	jobEstimate   time.Duration
+	maxRetryAfter time.Duration
+
+	mu      sync.Mutex
+	waiting int
+}
+
+func newProcessLimiter(concurrency, maxQueue int, jobEstimate, maxRetryAfter time.Duration) *processLimiter {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	if maxQueue < 0 {
+		maxQueue = 0
+	}
+	return &processLimiter{
+		slots:         make(chan struct{}, concurrency),
+		maxQueue:      maxQueue,
+		jobEstimate:   jobEstimate,
+		maxRetryAfter: maxRetryAfter,
+	}
+}
+
+// acquire blocks until a processing slot is free. It returns
+// errPipelineSaturated right away when the wait queue is already full.
+func (l *processLimiter) acquire(ctx context.Context) (func(), error) {
+	select {
+	case l.slots <- struct{}{}:
+		return l.release, nil
+	default:
+	}
+
+	l.mu.Lock()
+	if l.waiting >= l.maxQueue {
+		l.mu.Unlock()
+		return nil, errPipelineSaturated
+	}
+	l.waiting++
+	l.mu.Unlock()
+
+	defer func() {
+		l.mu.Lock()
+		l.waiting--
+		l.mu.Unlock()
+	}()
+
+	select {
+	case l.slots <- struct{}{}:
+		return l.release, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// wait blocks until a processing slot is free, however many are already
+// waiting. It's for work that has already been accepted and has nobody
+// to turn away: queued uploads and background renditions.
+func (l *processLimiter) wait(ctx context.Context) (func(), error) {
+	l.mu.Lock()
+	l.waiting++
+	l.mu.Unlock()
+	defer func() {
+		l.mu.Lock()
+		l.waiting--
+		l.mu.Unlock()
+	}()
+
+	select {
+	case l.slots <- struct{}{}:
+		return l.release, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (l *processLimiter) release() {
+	<-l.slots
+}
+
+// retryAfter estimates how long the current backlog needs to drain: every
+// running and queued job is assumed to take jobEstimate, spread across all
+// slots. The result is at least one second and at most maxRetryAfter.
+func (l *processLimiter) retryAfter() time.Duration {
+	l.mu.Lock()
+	depth := l.waiting + len(l.slots)
+	l.mu.Unlock()
+
+	rounds := math.Ceil(float64(depth+1) / float64(cap(l.slots)))
+	estimate := time.Duration(rounds) * l.jobEstimate
+	if estimate < time.Second {
+		estimate = time.Second
+	}
+	if l.maxRetryAfter > 0 && estimate > l.maxRetryAfter {
+		estimate = l.maxRetryAfter
+	}
+	return estimate
+}
+
+// defaultFFmpegThreads splits the cores between the allowed concurrent
+// ffmpeg runs, holding one core back so the HTTP server stays responsive.
+func defaultFFmpegThreads(concurrency int) int {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	threads := (runtime.NumCPU() - 1) / concurrency
+	if threads < 1 {
+		threads = 1
+	}
+	return threads
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestProcessLimiterRetryAfter(t *testing.T) {
+	l := newProcessLimiter(2, 10, 10*time.Second, time.Minute)
+	for i := 0; i < 2; i++ {
+		if _, err := l.acquire(context.Background()); err != nil {
+			t.Fatalf("acquire slot %d: %v", i, err)
+		}
+	}
+
+	tests := []struct {
+		waiting int
+		want    time.Duration
+	}{
+		{waiting: 0, want: 20 * time.Second},
+		{waiting: 2, want: 30 * time.Second},
+		{waiting: 4, want: 40 * time.Second},
+		{waiting: 20, want: time.Minute},
+	}
+	for _, tt := range tests {
+		l.waiting = tt.waiting
+		if got := l.retryAfter(); got != tt.want {
+			t.Errorf("retryAfter with %d waiting = %s, want %s", tt.waiting, got, tt.want)
+		}
+	}
+}
+
+func TestProcessLimiterSaturated(t *testing.T) {
+	l := newProcessLimiter(1, 0, 10*time.Second, time.Minute)
+	release, err := l.acquire(context.Background())
+	if err != nil {
+		t.Fatalf("acquire: %v", err)
+	}
+	if _, err := l.acquire(context.Background()); !errors.Is(err, errPipelineSaturated) {
+		t.Fatalf("acquire with a full queue = %v, want errPipelineSaturated", err)
+	}
+
+	release()
+	if _, err := l.acquire(context.Background()); err != nil {
+		t.Fatalf("acquire after release: %v", err)
+	}
+}
+
+func TestRespondWithUnavailable(t *testing.T) {
+	w := httptest.NewRecorder()
+	respondWithUnavailable(w, 1500*time.Millisecond, "busy", errPipelineSaturated)
+
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusServiceUnavailable)
+	}
+	if got := w.Header().Get("Retry-After"); got != "2" {
+		t.Errorf("Retry-After = %q, want %q", got, "2")
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Locker serializes work on a key. Lock blocks until the key is free or ctx
+// is done; the returned func releases it.
+type Locker interface {
+	Lock(ctx context.Context, key string) (unlock func(), err error)
+}
+
+// localLocker is the fallback when no shared locker is configured. It only
+// coordinates requests within this process.
+type localLocker struct {
+	mu    sync.Mutex
+	locks map[string]chan struct{}
+}
+
+func newLocalLocker() *localLocker {
+	return &localLocker{locks: make(map[string]chan struct{})}
+}
+
+func (l *localLocker) Lock(ctx context.Context, key string) (func(), error) {
+	for {
+		l.mu.Lock()
+		held, busy := l.locks[key]
+		if !busy {
+			done := make(chan struct{})
+			l.locks[key] = done
+			l.mu.Unlock()
+			return func() {
+				l.mu.Lock()
+				delete(l.locks, key)
+				l.mu.Unlock()
+				close(done)
+			}, nil
+		}
+		l.mu.Unlock()
+
+		select {
+		case <-held:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// redisUnlockScript deletes the lock only if it still holds our token, so
+// an instance whose lock expired can't release someone else's.
+var redisUnlockScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+// redisRenewScript extends the lock's expiry only if it still holds our
+// token.
+var redisRenewScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return 0
+`)
+
+// redisLocker coordinates uploads across every instance sharing a Redis
+// server. Locks expire after ttl so a crashed instance can't hold one
+// forever, and are renewed while held so a slow upload keeps its lock.
+type redisLocker struct {
+	client       *redis.Client
+	ttl          time.Duration
+	pollInterval time.Duration
+}
+
+func newRedisLocker(redisURL string, ttl time.Duration) (*redisLocker, error) {
+	opts, err := redis.ParseURL(redisURL)
+	if err != nil {
+		return nil, fmt.Errorf("parse redis URL: %w", err)
+	}
+	if ttl < time.Second {
+		return nil, fmt.Errorf("lock ttl %s is too short", ttl)
+	}
+	return &redisLocker{
+		client:       redis.NewClient(opts),
+		ttl:          ttl,
+		pollInterval: 250 * time.Millisecond,
+	}, nil
+}
+
+func (l *redisLocker) Lock(ctx context.Context, key string) (func(), error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	token := hex.EncodeToString(b)
+	redisKey := "tubely:upload-lock:" + key
+
+	for {
+		ok, err := l.client.SetNX(ctx, redisKey, token, l.ttl).Result()
+		if err != nil {
+			return nil, fmt.Errorf("acquire redis lock: %w", err)
+		}
+		if ok {
+			stop := make(chan struct{})
+			go l.renew(key, redisKey, token, stop)
+			return func() {
+				close(stop)
+				// Release even if the request was cancelled meanwhile
+				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				defer cancel()
+				err := redisUnlockScript.Run(ctx, l.client, []string{redisKey}, token).Err()
+				if err != nil && !errors.Is(err, redis.Nil) {
+					slog.Error("releasing upload lock failed", "key", key, "error", err)
+				}
+			}, nil
+		}
+
+		select {
+		case <-time.After(l.pollInterval):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// renew pushes the lock's expiry back every third of its ttl until stop is
+// closed. It gives up if the lock has already passed to someone else.
+func (l *redisLocker) renew(key, redisKey, token string, stop <-chan struct{}) {
+	ticker := time.NewTicker(l.ttl / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		renewed, err := redisRenewScript.Run(ctx, l.client, []string{redisKey}, token, l.ttl.Milliseconds()).Int()
+		cancel()
+		if err != nil {
+			// The next tick tries again before the lock runs out
+			slog.Warn("renewing upload lock failed", "key", key, "error", err)
+			continue
+		}
+		if renewed == 0 {
+			slog.Error("upload lock expired while held", "key", key)
+			return
+		}
+	}
+}
+
+// uploadLockerFromEnv uses Redis when UPLOAD_LOCK_REDIS_URL is set and
+// falls back to a process-local lock otherwise.
+func uploadLockerFromEnv() (Locker, error) {
+	redisURL := os.Getenv("UPLOAD_LOCK_REDIS_URL")
+	if redisURL == "" {
+		return newLocalLocker(), nil
+	}
+	return newRedisLocker(redisURL, envDuration("UPLOAD_LOCK_TTL", time.Minute))
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"log"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// newLogger builds the server's logger. LOG_LEVEL is debug, info (the
+// default), warn or error; LOG_FORMAT is text (the default) or json.
+func newLogger() *slog.Logger {
+	var level slog.Level
+	if raw := os.Getenv("LOG_LEVEL"); raw != "" {
+		if err := level.UnmarshalText([]byte(raw)); err != nil {
+			log.Printf("Invalid LOG_LEVEL %q, using info", raw)
+			level = slog.LevelInfo
+		}
+	}
+
+	opts := &slog.HandlerOptions{Level: level}
+	var handler slog.Handler
+	switch strings.ToLower(os.Getenv("LOG_FORMAT")) {
+	case "json":
+		handler = slog.NewJSONHandler(os.Stderr, opts)
+	default:
+		handler = slog.NewTextHandler(os.Stderr, opts)
+	}
+	return slog.New(handler)
+}
@@ -2,29 +2,114 @@ package main
 
 import (
 	"context"
+	"errors"
 	"log"
+	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"text/template"
+	"time"
 
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
 
-	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/google/uuid"
 	"github.com/joho/godotenv"
 	_ "github.com/lib/pq"
 )
 
 type apiConfig struct {
 	db               database.Client
+	logger           *slog.Logger
 	jwtSecret        string
+	jwtExpectations  auth.TokenExpectations
 	platform         string
 	filepathRoot     string
 	assetsRoot       string
-	s3Client		 *s3.Client
+	s3Client         *s3.Client
+	awsCredentials   awsCredentialsConfig
 	s3Bucket         string
 	s3Region         string
 	s3CfDistribution string
+	cloudFront       *cloudFrontSigner
+	s3Timeout        time.Duration
+	s3Retry          retryPolicy
+	objectEncryption objectEncryption
 	port             string
+
+	secondaryS3Client   *s3.Client
+	secondaryS3Bucket   string
+	secondaryEncryption objectEncryption
+
+	processLimiter     *processLimiter
+	probeLimiter       *processLimiter
+	uploadRateLimiter  *uploadRateLimiter
+	videoQueue         *videoQueue
+	processingProgress *processingProgress
+	processingETA      etaEstimator
+	inflightUploads    *inflightUploads
+	uploadLocker       Locker
+	objectKeys         objectKeyFormat
+	ffmpegThreads      int
+	ffmpegRetry        retryPolicy
+	ffprobeTimeout     time.Duration
+	allowedCodecs      codecAllowlist
+	acceptedVideoTypes map[string]bool
+	audioLanguage      string
+	streamHeaders      http.Header
+	streamRateLimits   streamRateLimits
+	presignCache       *presignCache
+	presignExpiry      time.Duration
+	// uploadPresignExpiry is how long presigned upload part URLs last.
+	uploadPresignExpiry time.Duration
+	// maxPresignedURLLength is the longest presigned URL handed out; 0
+	// means no limit.
+	maxPresignedURLLength int
+	videoURLTemplate      *template.Template
+
+	pipeFastStartToS3    bool
+	directUploads        bool
+	directUploadUsers    map[uuid.UUID]bool
+	adminUsers           map[uuid.UUID]bool
+	dedupUploads         bool
+	uploadTimings        bool
+	fastStartMode        string
+	transcodeToPlayable  bool
+	multipartSizing      partSizing
+	multipartThreshold   int64
+	otherAspectBucketing string
+	fsyncUploads         bool
+	maxVideoFrames       int64
+	maxUploadSize        int64
+	iframeInterval       float64
+	hlsSegmentDuration   float64
+	posterOffset         posterOffset
+	renditionHeights     []int
+	// strictPosters fails an upload whose automatic poster can't be made,
+	// instead of storing the video without one.
+	strictPosters bool
+	// keepObjectsOnDBFailure leaves uploaded objects in S3 when the video
+	// row can't be updated, for reconciliation to pick up.
+	keepObjectsOnDBFailure bool
+	reconcileConcurrency   int
+
+	sniffThumbnailType      bool
+	qualityAnalysis         bool
+	qualityThresholds       qualityThresholds
+	thumbnailCandidates     int
+	thumbnailSceneThreshold float64
+	thumbnailFormats        []string
+	thumbnailQuality        int
+	thumbnailMaxDimension   int
+	// tempDir holds uploads and ffmpeg output while they're processed;
+	// empty means the system default.
+	tempDir string
+	// urlFetchClient downloads videos uploaded by URL; nil when
+	// URL_UPLOADS is off.
+	urlFetchClient *http.Client
 }
 
 type thumbnail struct {
@@ -35,6 +120,10 @@ type thumbnail struct {
 func main() {
 	godotenv.Load(".env")
 
+	// Everything still using the log package goes through it too
+	logger := newLogger()
+	slog.SetDefault(logger)
+
 	pathToDB := os.Getenv("DB_PATH")
 	if pathToDB == "" {
 		log.Fatal("DB_URL must be set")
@@ -79,35 +168,205 @@ func main() {
 	if s3CfDistribution == "" {
 		log.Fatal("S3_CF_DISTRO environment variable is not set")
 	}
+	cloudFront, err := cloudFrontSignerFromEnv(s3CfDistribution)
+	if err != nil {
+		log.Fatalf("Invalid CloudFront signing config: %v", err)
+	}
+
+	// The SDK picks partition endpoints and signing from the region; this
+	// only catches a region that contradicts AWS_PARTITION.
+	if _, err := resolvePartition(s3Region, os.Getenv("AWS_PARTITION")); err != nil {
+		log.Fatalf("Invalid S3 region/partition: %v", err)
+	}
 
 	port := os.Getenv("PORT")
 	if port == "" {
 		log.Fatal("PORT environment variable is not set")
 	}
 
-		// Load default AWS SDK config (uses credentials from `aws configure`)
-	awsCfg, err := config.LoadDefaultConfig(
-		context.TODO(),
-		config.WithRegion(s3Region),
-	)
+	awsCredentials := awsCredentialsConfigFromEnv()
+	s3Client, err := newS3Client(context.Background(), s3Region, awsCredentials)
+	if err != nil {
+		log.Fatalf("Couldn't create S3 client: %v", err)
+	}
+
+	encryption := objectEncryptionFromEnv()
+
+	// Optional second bucket in another region for disaster recovery
+	var secondaryS3Client *s3.Client
+	secondaryEncryption := objectEncryption{KMSKeyID: os.Getenv("S3_SECONDARY_SSE_KMS_KEY_ID")}
+	secondaryS3Bucket := os.Getenv("S3_SECONDARY_BUCKET")
+	if secondaryS3Bucket != "" {
+		secondaryS3Region := os.Getenv("S3_SECONDARY_REGION")
+		if secondaryS3Region == "" {
+			log.Fatal("S3_SECONDARY_REGION must be set with S3_SECONDARY_BUCKET")
+		}
+		// KMS keys don't cross regions, so the replicas need their own
+		if encryption.KMSKeyID != "" && secondaryEncryption.KMSKeyID == "" {
+			log.Fatal("S3_SECONDARY_SSE_KMS_KEY_ID must be set with S3_SSE_KMS_KEY_ID and S3_SECONDARY_BUCKET")
+		}
+		secondaryS3Client, err = newS3Client(context.Background(), secondaryS3Region, awsCredentials)
+		if err != nil {
+			log.Fatalf("Couldn't create secondary S3 client: %v", err)
+		}
+	}
+
+	videoURLTemplate, err := parseVideoURLTemplate(os.Getenv("VIDEO_URL_TEMPLATE"))
+	if err != nil {
+		log.Fatalf("Invalid VIDEO_URL_TEMPLATE: %v", err)
+	}
+
+	// The system temp dir is often a small tmpfs that can't hold a video
+	tempDir := os.Getenv("TEMP_DIR")
+	if err := checkTempDir(tempDir); err != nil {
+		log.Fatalf("Unusable TEMP_DIR %q: %v", tempDir, err)
+	}
+
+	uploadLocker, err := uploadLockerFromEnv()
+	if err != nil {
+		log.Fatalf("Couldn't configure upload locking: %v", err)
+	}
+
+	directUploads := envBool("DIRECT_UPLOADS", false)
+	directUploadUsers, err := envUserIDs("DIRECT_UPLOAD_USERS")
+	if err != nil {
+		log.Fatalf("Invalid DIRECT_UPLOAD_USERS: %v", err)
+	}
+	if directUploads && len(directUploadUsers) == 0 {
+		log.Fatal("DIRECT_UPLOAD_USERS must list the trusted users with DIRECT_UPLOADS")
+	}
+	adminUsers, err := envUserIDs("ADMIN_USERS")
 	if err != nil {
-		log.Fatalf("load AWS config: %w", err)
+		log.Fatalf("Invalid ADMIN_USERS: %v", err)
 	}
 
-	// Create S3 client from config
-	s3Client := s3.NewFromConfig(awsCfg)
+	objectKeys, err := objectKeyFormatFromEnv()
+	if err != nil {
+		log.Fatalf("Invalid object key settings: %v", err)
+	}
+
+	fastStartMode := os.Getenv("FASTSTART_MODE")
+	switch fastStartMode {
+	case "":
+		fastStartMode = fastStartModeFaststart
+	case fastStartModeFaststart, fastStartModeFragmented:
+	default:
+		log.Fatalf("Invalid FASTSTART_MODE %q (want faststart or fragmented)", fastStartMode)
+	}
+
+	processConcurrency := envInt("PROCESS_CONCURRENCY", 2)
+	processJobEstimate := envDuration("PROCESS_JOB_ESTIMATE", 30*time.Second)
+	processWorkers := envInt("PROCESS_WORKERS", 0)
 
 	cfg := apiConfig{
-		db:               db,
-		jwtSecret:        jwtSecret,
+		db:        db,
+		logger:    logger,
+		jwtSecret: jwtSecret,
+		jwtExpectations: auth.TokenExpectations{
+			Issuer:   os.Getenv("JWT_ISSUER"),
+			Audience: os.Getenv("JWT_AUDIENCE"),
+		},
 		platform:         platform,
 		filepathRoot:     filepathRoot,
 		assetsRoot:       assetsRoot,
-		s3Client: 		  s3Client,
+		s3Client:         s3Client,
+		awsCredentials:   awsCredentials,
 		s3Bucket:         s3Bucket,
 		s3Region:         s3Region,
 		s3CfDistribution: s3CfDistribution,
-		port:             port,
+		cloudFront:       cloudFront,
+		s3Timeout:        envDuration("S3_TIMEOUT", 30*time.Minute),
+		objectEncryption: encryption,
+		s3Retry: retryPolicy{
+			Attempts: envInt("S3_ATTEMPTS", 3),
+			Backoff:  envDuration("S3_RETRY_BACKOFF", 500*time.Millisecond),
+		},
+		port: port,
+
+		secondaryS3Client:   secondaryS3Client,
+		secondaryS3Bucket:   secondaryS3Bucket,
+		secondaryEncryption: secondaryEncryption,
+
+		processLimiter: newProcessLimiter(
+			processConcurrency,
+			envInt("PROCESS_QUEUE_LIMIT", 8),
+			processJobEstimate,
+			envDuration("RETRY_AFTER_MAX", 5*time.Minute),
+		),
+		probeLimiter: newProcessLimiter(
+			envInt("PROBE_CONCURRENCY", 8),
+			envInt("PROBE_QUEUE_LIMIT", 32),
+			envDuration("PROBE_JOB_ESTIMATE", time.Second),
+			envDuration("RETRY_AFTER_MAX", 5*time.Minute),
+		),
+		uploadRateLimiter:  newUploadRateLimiter(envFloat("UPLOAD_RATE_LIMIT", 0), envInt("UPLOAD_RATE_BURST", 5)),
+		processingProgress: newProcessingProgress(),
+		processingETA: etaEstimator{
+			speedFactor: envFloat("PROCESSING_SPEED_FACTOR", 0.5),
+			jobEstimate: processJobEstimate,
+			parallel:    min(max(processWorkers, 1), processConcurrency),
+			maxETA:      envDuration("PROCESSING_ETA_MAX", time.Hour),
+		},
+		inflightUploads:    newInflightUploads(),
+		uploadLocker:       uploadLocker,
+		objectKeys:         objectKeys,
+		ffmpegThreads:      envInt("FFMPEG_THREADS", defaultFFmpegThreads(processConcurrency)),
+		allowedCodecs:      codecAllowlistFromEnv(),
+		acceptedVideoTypes: acceptedVideoTypesFromEnv(),
+		audioLanguage:      os.Getenv("AUDIO_DEFAULT_LANGUAGE"),
+		ffmpegRetry: retryPolicy{
+			Attempts: envInt("FFMPEG_ATTEMPTS", 3),
+			Backoff:  envDuration("FFMPEG_RETRY_BACKOFF", 2*time.Second),
+			Timeout:  envDuration("FFMPEG_TIMEOUT", time.Hour),
+		},
+		ffprobeTimeout:        envDuration("FFPROBE_TIMEOUT", time.Minute),
+		streamHeaders:         streamHeadersFromEnv(),
+		streamRateLimits:      streamRateLimitsFromEnv(),
+		presignCache:          newPresignCache(envDuration("PRESIGN_REUSE_WINDOW", 0)),
+		presignExpiry:         presignExpiryFromEnv("PRESIGN_EXPIRY", defaultPresignExpiry),
+		uploadPresignExpiry:   presignExpiryFromEnv("UPLOAD_PRESIGN_EXPIRY", defaultUploadPresignExpiry),
+		maxPresignedURLLength: envInt("MAX_PRESIGNED_URL_LENGTH", 0),
+		videoURLTemplate:      videoURLTemplate,
+		pipeFastStartToS3:     envBool("FASTSTART_PIPE_TO_S3", false),
+		directUploads:         directUploads,
+		directUploadUsers:     directUploadUsers,
+		adminUsers:            adminUsers,
+		dedupUploads:          envBool("DEDUP_UPLOADS", false),
+		uploadTimings:         envBool("UPLOAD_TIMINGS", false),
+		fastStartMode:         fastStartMode,
+		transcodeToPlayable:   envBool("TRANSCODE_TO_PLAYABLE", true),
+		multipartSizing: partSizing{
+			Initial: int64(envInt("MULTIPART_PART_SIZE", defaultPartSize)),
+			Max:     int64(envInt("MULTIPART_MAX_PART_SIZE", 512<<20)),
+		},
+		multipartThreshold:     int64(envInt("MULTIPART_THRESHOLD", 64<<20)),
+		otherAspectBucketing:   os.Getenv("OTHER_ASPECT_BUCKETING"),
+		maxVideoFrames:         int64(envInt("MAX_VIDEO_FRAMES", 10_000_000)),
+		maxUploadSize:          int64(envInt("MAX_UPLOAD_SIZE", 1<<30)),
+		iframeInterval:         envFloat("IFRAME_TRACK_INTERVAL", 0),
+		hlsSegmentDuration:     envFloat("HLS_SEGMENT_DURATION", 0),
+		posterOffset:           posterOffsetFromEnv(),
+		strictPosters:          envBool("STRICT_POSTERS", false),
+		renditionHeights:       renditionHeightsFromEnv(),
+		fsyncUploads:           envBool("UPLOAD_FSYNC", true),
+		keepObjectsOnDBFailure: envBool("KEEP_OBJECTS_ON_DB_FAILURE", false),
+		reconcileConcurrency:   envInt("RECONCILE_CONCURRENCY", 8),
+		sniffThumbnailType:     envBool("THUMBNAIL_SNIFF_CONTENT_TYPE", true),
+		qualityAnalysis:        envBool("QUALITY_ANALYSIS", false),
+		qualityThresholds: qualityThresholds{
+			MaxRatio:   envFloat("QUALITY_MAX_RATIO", 0.9),
+			BlackPixel: envFloat("QUALITY_BLACK_PIXEL_THRESHOLD", 0.1),
+			SilenceDB:  envFloat("QUALITY_SILENCE_DB", -50),
+		},
+		thumbnailCandidates:     envInt("THUMBNAIL_CANDIDATES", 3),
+		thumbnailSceneThreshold: envFloat("THUMBNAIL_SCENE_THRESHOLD", 0.4),
+		thumbnailFormats:        thumbnailFormatsFromEnv(),
+		thumbnailQuality:        envInt("THUMBNAIL_QUALITY", 80),
+		thumbnailMaxDimension:   envInt("THUMBNAIL_MAX_DIMENSION", 1280),
+		tempDir:                 tempDir,
+	}
+	if envBool("URL_UPLOADS", false) {
+		cfg.urlFetchClient = newURLFetchClient(envDuration("URL_FETCH_TIMEOUT", 30*time.Minute))
 	}
 
 	err = cfg.ensureAssetsDir()
@@ -115,6 +374,19 @@ func main() {
 		log.Fatalf("Couldn't create assets directory: %v", err)
 	}
 
+	// Whatever was uploading or processing when the server last stopped
+	// never finished
+	interrupted, err := db.FailInterruptedVideos()
+	if err != nil {
+		log.Fatalf("Couldn't fail interrupted uploads: %v", err)
+	}
+	if interrupted > 0 {
+		log.Printf("Marked %d interrupted uploads as failed", interrupted)
+	}
+
+	// PROCESS_WORKERS > 0 processes uploads in the background
+	cfg.videoQueue = newVideoQueue(processWorkers, envInt("PROCESS_QUEUE_SIZE", 16), cfg.processQueuedUpload)
+
 	mux := http.NewServeMux()
 	appHandler := http.StripPrefix("/app", http.FileServer(http.Dir(filepathRoot)))
 	mux.Handle("/app/", appHandler)
@@ -122,6 +394,8 @@ func main() {
 	assetsHandler := http.StripPrefix("/assets", http.FileServer(http.Dir(assetsRoot)))
 	mux.Handle("/assets/", noCacheMiddleware(assetsHandler))
 
+	mux.HandleFunc("GET /healthz", cfg.handlerHealth)
+
 	mux.HandleFunc("POST /api/login", cfg.handlerLogin)
 	mux.HandleFunc("POST /api/refresh", cfg.handlerRefresh)
 	mux.HandleFunc("POST /api/revoke", cfg.handlerRevoke)
@@ -131,17 +405,52 @@ func main() {
 	mux.HandleFunc("POST /api/videos", cfg.handlerVideoMetaCreate)
 	mux.HandleFunc("POST /api/thumbnail_upload/{videoID}", cfg.handlerUploadThumbnail)
 	mux.HandleFunc("POST /api/video_upload/{videoID}", cfg.handlerUploadVideo)
+	mux.HandleFunc("PUT /api/video_upload/{videoID}", cfg.handlerReplaceVideo)
+	mux.HandleFunc("POST /api/video_upload/{videoID}/multipart", cfg.handlerStartPresignedUpload)
+	mux.HandleFunc("POST /api/video_upload/{videoID}/multipart/complete", cfg.handlerCompletePresignedUpload)
+	mux.HandleFunc("POST /api/video_upload/{videoID}/multipart/abort", cfg.handlerAbortPresignedUpload)
+	if cfg.urlFetchClient != nil {
+		mux.HandleFunc("POST /api/video_upload/{videoID}/url", cfg.handlerUploadVideoFromURL)
+	}
+	mux.HandleFunc("POST /api/chapters_upload/{videoID}", cfg.handlerUploadChapters)
 	mux.HandleFunc("GET /api/videos", cfg.handlerVideosRetrieve)
 	mux.HandleFunc("GET /api/videos/{videoID}", cfg.handlerVideoGet)
+	mux.HandleFunc("GET /api/videos/{videoID}/stream", cfg.handlerStreamVideo)
+	mux.HandleFunc("GET /api/videos/{videoID}/hls/index.m3u8", cfg.handlerStreamHLS)
+	mux.HandleFunc("GET /api/videos/{videoID}/status", cfg.handlerVideoStatus)
 	mux.HandleFunc("DELETE /api/videos/{videoID}", cfg.handlerVideoMetaDelete)
+	mux.HandleFunc("GET /api/thumbnails/{videoID}", cfg.handlerServeThumbnail)
 
 	mux.HandleFunc("POST /admin/reset", cfg.handlerReset)
+	mux.HandleFunc("GET /admin/videos/{videoID}/reconcile", cfg.handlerAdminReconcileVideo)
+	mux.HandleFunc("POST /admin/presign-cache/flush", cfg.handlerAdminFlushPresignCache)
 
 	srv := &http.Server{
 		Addr:    ":" + port,
 		Handler: mux,
 	}
 
-	log.Printf("Serving on: http://localhost:%s/app/\n", port)
-	log.Fatal(srv.ListenAndServe())
+	// On SIGINT or SIGTERM, stop taking requests and let queued processing
+	// finish before exiting
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		log.Printf("Serving on: http://localhost:%s/app/\n", port)
+		if err := srv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal(err)
+		}
+	}()
+	<-ctx.Done()
+
+	log.Printf("Shutting down")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), envDuration("SHUTDOWN_TIMEOUT", 5*time.Minute))
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Shutting down HTTP server: %v", err)
+	}
+	if cfg.videoQueue != nil {
+		if err := cfg.videoQueue.shutdown(shutdownCtx); err != nil {
+			log.Printf("Gave up waiting for video processing: %v", err)
+		}
+	}
 }
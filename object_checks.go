@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// objectsExist checks which of the given "bucket,key" locations exist,
+// running up to concurrency HeadObject calls at once. A missing object is
+// a result, not an error; any other failure, or ctx ending, stops the
+// remaining checks and is returned.
+func (cfg *apiConfig) objectsExist(ctx context.Context, locations []string, concurrency int) (map[string]bool, error) {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		mu       sync.Mutex
+		exists   = make(map[string]bool, len(locations))
+		firstErr error
+	)
+	fail := func(err error) {
+		mu.Lock()
+		if firstErr == nil {
+			firstErr = err
+			cancel()
+		}
+		mu.Unlock()
+	}
+
+	jobs := make(chan string)
+	var wg sync.WaitGroup
+	for range min(concurrency, len(locations)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for location := range jobs {
+				found, err := cfg.objectExists(ctx, location)
+				if err != nil {
+					fail(err)
+					continue
+				}
+				mu.Lock()
+				exists[location] = found
+				mu.Unlock()
+			}
+		}()
+	}
+
+feed:
+	for _, location := range locations {
+		select {
+		case jobs <- location:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return exists, nil
+}
+
+// objectExists runs a HeadObject for one "bucket,key" location.
+func (cfg *apiConfig) objectExists(ctx context.Context, location string) (bool, error) {
+	bucket, key, err := parseVideoLocation(location)
+	if err != nil {
+		return false, err
+	}
+	_, err = cfg.s3ClientForBucket(bucket).HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	var notFound *types.NotFound
+	if errors.As(err, &notFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("head %s/%s: %w", bucket, key, err)
+	}
+	return true, nil
+}
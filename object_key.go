@@ -0,0 +1,91 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// minObjectKeyBits is the least randomness a key may carry. At 64 bits a
+// collision is unlikely before billions of uploads.
+const minObjectKeyBits = 64
+
+// objectKeyFormat controls how the random part of an object key is
+// encoded. Length is in characters; zero keeps the full 128-bit key.
+type objectKeyFormat struct {
+	Encoding string
+	Length   int
+}
+
+var base32Lower = base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567").WithPadding(base32.NoPadding)
+
+// bitsPerChar is the randomness each character of an encoding carries.
+func (f objectKeyFormat) bitsPerChar() int {
+	switch f.Encoding {
+	case "hex":
+		return 4
+	case "base32":
+		return 5
+	case "base64url":
+		return 6
+	}
+	return 0
+}
+
+func (f objectKeyFormat) validate() error {
+	bits := f.bitsPerChar()
+	if bits == 0 {
+		return fmt.Errorf("unknown object key encoding %q (want hex, base32 or base64url)", f.Encoding)
+	}
+	if f.Length < 0 {
+		return fmt.Errorf("object key length must not be negative")
+	}
+	if f.Length > 0 && f.Length*bits < minObjectKeyBits {
+		minChars := (minObjectKeyBits + bits - 1) / bits
+		return fmt.Errorf("%d %s characters is only %d bits; use at least %d", f.Length, f.Encoding, f.Length*bits, minChars)
+	}
+	return nil
+}
+
+// newKey returns a random key in this format.
+func (f objectKeyFormat) newKey() (string, error) {
+	n := 16
+	if f.Length > 0 {
+		n = (f.Length*f.bitsPerChar() + 7) / 8
+	}
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	var key string
+	switch f.Encoding {
+	case "base32":
+		key = base32Lower.EncodeToString(b)
+	case "base64url":
+		key = base64.RawURLEncoding.EncodeToString(b)
+	default:
+		key = hex.EncodeToString(b)
+	}
+	if f.Length > 0 && len(key) > f.Length {
+		key = key[:f.Length]
+	}
+	return key, nil
+}
+
+// objectKeyFormatFromEnv reads OBJECT_KEY_ENCODING and OBJECT_KEY_LENGTH.
+// The default is 32 hex characters, as keys have always been.
+func objectKeyFormatFromEnv() (objectKeyFormat, error) {
+	f := objectKeyFormat{
+		Encoding: strings.ToLower(os.Getenv("OBJECT_KEY_ENCODING")),
+		Length:   envInt("OBJECT_KEY_LENGTH", 0),
+	}
+	if f.Encoding == "" {
+		f.Encoding = "hex"
+	}
+	return f, f.validate()
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// awsPartition is the slice of AWS a region belongs to. Partitions have
+// separate credentials and their own DNS suffix, so a bucket in GovCloud or
+// China can't be reached through the commercial amazonaws.com hostnames.
+type awsPartition struct {
+	ID        string
+	DNSSuffix string
+}
+
+var awsPartitions = []struct {
+	regionPrefix string
+	partition    awsPartition
+}{
+	{"cn-", awsPartition{ID: "aws-cn", DNSSuffix: "amazonaws.com.cn"}},
+	{"us-gov-", awsPartition{ID: "aws-us-gov", DNSSuffix: "amazonaws.com"}},
+	{"us-isob-", awsPartition{ID: "aws-iso-b", DNSSuffix: "sc2s.sgov.gov"}},
+	{"us-iso-", awsPartition{ID: "aws-iso", DNSSuffix: "c2s.ic.gov"}},
+}
+
+var commercialPartition = awsPartition{ID: "aws", DNSSuffix: "amazonaws.com"}
+
+func partitionForRegion(region string) awsPartition {
+	for _, p := range awsPartitions {
+		if strings.HasPrefix(region, p.regionPrefix) {
+			return p.partition
+		}
+	}
+	return commercialPartition
+}
+
+// resolvePartition returns the partition for region, checking it against
+// an explicitly configured partition ID when one is given.
+func resolvePartition(region, configured string) (awsPartition, error) {
+	p := partitionForRegion(region)
+	if configured != "" && configured != p.ID {
+		return awsPartition{}, fmt.Errorf("region %q belongs to partition %q, not %q", region, p.ID, configured)
+	}
+	return p, nil
+}
+
+// parseS3ObjectURL splits a virtual-hosted-style S3 URL in any partition
+// into bucket and key. It also understands the legacy "bucket.s3-region"
+// and "bucket.s3" hosts and path-style URLs such as
+// "https://s3.us-east-1.amazonaws.com/bucket/key".
+func parseS3ObjectURL(raw string) (bucket, key string, err error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid S3 URL %q: %w", raw, err)
+	}
+	host := u.Hostname()
+	path := strings.TrimPrefix(u.Path, "/")
+
+	// Bucket names may contain dots, so the last ".s3" label marks the end
+	i := max(strings.LastIndex(host, ".s3."), strings.LastIndex(host, ".s3-"))
+	switch {
+	case i > 0:
+		bucket, key = host[:i], path
+	case strings.HasPrefix(host, "s3.") || strings.HasPrefix(host, "s3-"):
+		bucket, key, _ = strings.Cut(path, "/")
+	default:
+		return "", "", fmt.Errorf("not an S3 object URL: %q", raw)
+	}
+	if bucket == "" || key == "" {
+		return "", "", fmt.Errorf("invalid bucket/key parsed from S3 URL: bucket=%q key=%q", bucket, key)
+	}
+	return bucket, key, nil
+}
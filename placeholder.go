@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"image"
+	"image/color"
+	_ "image/jpeg"
+	"image/png"
+	"io"
+)
+
+// placeholderMaxSide is the longest edge of a thumbnail placeholder. At 8px
+// the PNG data URI stays around a few hundred bytes, small enough to inline
+// in every list response.
+const placeholderMaxSide = 8
+
+// thumbnailPlaceholder shrinks a thumbnail to a tiny PNG data URI the UI can
+// stretch and blur while the real image loads.
+func thumbnailPlaceholder(r io.Reader) (string, error) {
+	src, _, err := image.Decode(r)
+	if err != nil {
+		return "", err
+	}
+
+	b := src.Bounds()
+	w, h := placeholderMaxSide, placeholderMaxSide
+	if b.Dx() > b.Dy() {
+		h = max(1, placeholderMaxSide*b.Dy()/b.Dx())
+	} else {
+		w = max(1, placeholderMaxSide*b.Dx()/b.Dy())
+	}
+
+	// Average each source cell so the placeholder keeps the overall colours
+	// instead of whichever pixels a nearest-neighbour pick lands on
+	dst := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		y0 := b.Min.Y + y*b.Dy()/h
+		y1 := max(y0+1, b.Min.Y+(y+1)*b.Dy()/h)
+		for x := 0; x < w; x++ {
+			x0 := b.Min.X + x*b.Dx()/w
+			x1 := max(x0+1, b.Min.X+(x+1)*b.Dx()/w)
+			var sr, sg, sb, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					c := color.NRGBAModel.Convert(src.At(sx, sy)).(color.NRGBA)
+					sr += uint64(c.R)
+					sg += uint64(c.G)
+					sb += uint64(c.B)
+					n++
+				}
+			}
+			dst.SetNRGBA(x, y, color.NRGBA{uint8(sr / n), uint8(sg / n), uint8(sb / n), 0xff})
+		}
+	}
+
+	var buf bytes.Buffer
+	enc := png.Encoder{CompressionLevel: png.BestCompression}
+	if err := enc.Encode(&buf, dst); err != nil {
+		return "", err
+	}
+	return "data:image/png;base64," + base64.StdEncoding.EncodeToString(buf.Bytes()), nil
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// errPosterOutOfRange is returned when a video is too short to have a
+// frame at the poster offset.
+var errPosterOutOfRange = errors.New("video is shorter than the poster offset")
+
+// posterOffset is where in a video its automatic poster frame is taken:
+// a fixed time, or a fraction of the duration. The zero value disables
+// automatic posters.
+type posterOffset struct {
+	At       time.Duration
+	Fraction float64
+}
+
+// seconds returns the capture time for a video of the given length.
+func (o posterOffset) seconds(duration float64) (float64, error) {
+	if duration <= 0 {
+		return 0, errNoDuration
+	}
+	at := o.At.Seconds()
+	if o.Fraction > 0 {
+		at = duration * o.Fraction
+	}
+	if at >= duration {
+		return 0, fmt.Errorf("%w: %.3fs of %.3fs", errPosterOutOfRange, at, duration)
+	}
+	return at, nil
+}
+
+func (o posterOffset) enabled() bool {
+	return o.At > 0 || o.Fraction > 0
+}
+
+// posterOffsetFromEnv reads POSTER_OFFSET, either a duration such as "1s"
+// or a percentage of the video such as "10%". It defaults to 1s; "off"
+// disables automatic posters.
+func posterOffsetFromEnv() posterOffset {
+	fallback := posterOffset{At: time.Second}
+	raw := strings.TrimSpace(os.Getenv("POSTER_OFFSET"))
+	switch {
+	case raw == "":
+		return fallback
+	case raw == "off":
+		return posterOffset{}
+	case strings.HasSuffix(raw, "%"):
+		percent, err := strconv.ParseFloat(strings.TrimSuffix(raw, "%"), 64)
+		if err != nil || percent <= 0 || percent >= 100 {
+			log.Printf("Invalid POSTER_OFFSET %q, using default %s", raw, fallback.At)
+			return fallback
+		}
+		return posterOffset{Fraction: percent / 100}
+	default:
+		d, err := time.ParseDuration(raw)
+		if err != nil || d <= 0 {
+			log.Printf("Invalid POSTER_OFFSET %q, using default %s", raw, fallback.At)
+			return fallback
+		}
+		return posterOffset{At: d}
+	}
+}
+
+// extractPosterFrame writes the frame at the given second of the video to
+// outputPath as a JPEG.
+func extractPosterFrame(inputPath, outputPath string, at float64, threads int, retry retryPolicy) error {
+	input, err := ffmpegPath(inputPath)
+	if err != nil {
+		return err
+	}
+	output, err := ffmpegPath(outputPath)
+	if err != nil {
+		return err
+	}
+	err = runFFmpeg(func(ctx context.Context) *exec.Cmd {
+		return exec.CommandContext(ctx,
+			"ffmpeg",
+			"-y",
+			"-v", "error",
+			"-ss", strconv.FormatFloat(at, 'f', 3, 64),
+			"-i", input,
+			"-threads", strconv.Itoa(threads),
+			"-frames:v", "1",
+			"-q:v", "2",
+			"-f", "image2",
+			output,
+		)
+	}, retry)
+	if err != nil {
+		return fmt.Errorf("ffmpeg poster frame at %.3fs failed: %w", at, err)
+	}
+	return nil
+}
+
+// savePoster grabs a poster frame from the video into the assets directory,
+// the same place uploaded thumbnails live, and returns its asset path and
+// the second it was taken at. Like uploaded thumbnails, it's named by its
+// content hash.
+// A stored timestamp from an earlier poster is used again as long as the
+// video is still long enough for it. Otherwise, with THUMBNAIL_CANDIDATES
+// set it first tries scene-change frames, whose time isn't known, and only
+// falls back to the frame at the poster offset if that fails.
+func (cfg *apiConfig) savePoster(ctx context.Context, inputPath string, duration float64, stored *float64) (assetPath string, at *float64, err error) {
+	if stored != nil {
+		if *stored < duration {
+			return cfg.savePosterFrame(inputPath, *stored)
+		}
+		slog.Warn("stored poster timestamp is past the end of the video, using poster offset", "timestamp", *stored, "duration", duration)
+	} else if cfg.thumbnailCandidates > 0 {
+		assetPath, err := cfg.saveScenePoster(ctx, inputPath)
+		if err == nil {
+			return assetPath, nil, nil
+		}
+		slog.Warn("scene detection poster failed, using poster offset", "error", err)
+	}
+
+	seconds, err := cfg.posterOffset.seconds(duration)
+	if err != nil {
+		return "", nil, err
+	}
+	return cfg.savePosterFrame(inputPath, seconds)
+}
+
+// savePosterFrame saves the frame at the given second as a poster.
+func (cfg *apiConfig) savePosterFrame(inputPath string, at float64) (string, *float64, error) {
+	tmp, err := os.CreateTemp(cfg.assetsRoot, ".poster-*.jpg")
+	if err != nil {
+		return "", nil, err
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+	if err := extractPosterFrame(inputPath, tmp.Name(), at, cfg.ffmpegThreads, cfg.ffmpegRetry); err != nil {
+		return "", nil, err
+	}
+
+	frame, err := os.Open(tmp.Name())
+	if err != nil {
+		return "", nil, err
+	}
+	defer frame.Close()
+	assetPath, err := cfg.saveContentAddressedAsset(frame, "image/jpeg")
+	if err != nil {
+		return "", nil, err
+	}
+	return assetPath, &at, nil
+}
+
+// saveScenePoster picks the poster among scene-change candidates. It takes
+// the largest JPEG: black and faded frames compress to almost nothing, so
+// size is a cheap stand-in for how much is actually in the picture.
+func (cfg *apiConfig) saveScenePoster(ctx context.Context, inputPath string) (string, error) {
+	ctx, cancel := commandContext(ctx, cfg.ffmpegRetry.Timeout)
+	defer cancel()
+	dir, frames, err := extractThumbnailCandidates(ctx, cfg.tempDir, inputPath, cfg.thumbnailCandidates, cfg.thumbnailSceneThreshold, cfg.ffmpegThreads)
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(dir)
+
+	best, bestSize := "", int64(0)
+	for _, f := range frames {
+		info, err := os.Stat(f)
+		if err != nil {
+			continue
+		}
+		if info.Size() > bestSize {
+			best, bestSize = f, info.Size()
+		}
+	}
+	if best == "" {
+		return "", errors.New("no thumbnail candidates extracted")
+	}
+
+	frame, err := os.Open(best)
+	if err != nil {
+		return "", err
+	}
+	defer frame.Close()
+	return cfg.saveContentAddressedAsset(frame, "image/jpeg")
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// presignCache hands out the same presigned URL for an object to every
+// caller within a short reuse window, across requests and users, instead
+// of signing a fresh one each time. The window is capped at half the URL
+// expiry so a reused URL always has at least half its lifetime left.
+// A nil cache or a zero window disables reuse.
+type presignCache struct {
+	window time.Duration
+
+	mu        sync.Mutex
+	entries   map[string]presignEntry
+	lastSweep time.Time
+}
+
+type presignEntry struct {
+	url      string
+	signedAt time.Time
+}
+
+func newPresignCache(window time.Duration) *presignCache {
+	return &presignCache{
+		window:  window,
+		entries: make(map[string]presignEntry),
+	}
+}
+
+// get returns a URL for bucket/key valid for expiry, calling sign when no
+// recent enough URL is cached. URLs with different response overrides,
+// such as a Content-Disposition, are cached separately. signedAt is when
+// the returned URL was signed, so it expires at signedAt plus expiry.
+func (c *presignCache) get(bucket, key, disposition string, expiry time.Duration, sign func() (string, error)) (url string, signedAt time.Time, err error) {
+	if c == nil || c.window <= 0 {
+		signedAt = time.Now()
+		url, err = sign()
+		return url, signedAt, err
+	}
+	window := c.window
+	if window > expiry/2 {
+		window = expiry / 2
+	}
+
+	cacheKey := bucket + "\x00" + key + "\x00" + disposition + "\x00" + expiry.String()
+	now := time.Now()
+
+	c.mu.Lock()
+	entry, ok := c.entries[cacheKey]
+	c.mu.Unlock()
+	if ok && now.Sub(entry.signedAt) < window {
+		return entry.url, entry.signedAt, nil
+	}
+
+	url, err = sign()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[cacheKey] = presignEntry{url: url, signedAt: now}
+	if now.Sub(c.lastSweep) > c.window {
+		for k, e := range c.entries {
+			if now.Sub(e.signedAt) >= c.window {
+				delete(c.entries, k)
+			}
+		}
+		c.lastSweep = now
+	}
+	return url, now, nil
+}
+
+// flush drops cached URLs so they are signed again on next use, returning
+// how many were dropped. An empty bucket drops everything; otherwise only
+// URLs for bucket, and for key within it when key is set.
+func (c *presignCache) flush(bucket, key string) int {
+	if c == nil {
+		return 0
+	}
+	prefix := ""
+	if bucket != "" {
+		prefix = bucket + "\x00"
+		if key != "" {
+			prefix += key + "\x00"
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	evicted := 0
+	for k := range c.entries {
+		if strings.HasPrefix(k, prefix) {
+			delete(c.entries, k)
+			evicted++
+		}
+	}
+	return evicted
+}
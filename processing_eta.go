@@ -0,0 +1,126 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// processingProgress tracks the uploads this server is processing, so the
+// status endpoint can estimate how long each has left. Jobs are forgotten
+// once processed.
+type processingProgress struct {
+	mu   sync.Mutex
+	jobs map[uuid.UUID]jobProgress
+	next uint64
+}
+
+// jobProgress is how far one upload has got.
+type jobProgress struct {
+	// order is when the job was queued, relative to the others.
+	order uint64
+	// started is zero until processing begins.
+	started time.Time
+	// duration is the video's length in seconds, 0 until it's probed.
+	duration float64
+}
+
+func newProcessingProgress() *processingProgress {
+	return &processingProgress{jobs: make(map[uuid.UUID]jobProgress)}
+}
+
+// queue records a job waiting for a worker.
+func (p *processingProgress) queue(videoID uuid.UUID) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.next++
+	p.jobs[videoID] = jobProgress{order: p.next}
+}
+
+// start records that processing began, queued first or not.
+func (p *processingProgress) start(videoID uuid.UUID) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	job, ok := p.jobs[videoID]
+	if !ok {
+		p.next++
+		job.order = p.next
+	}
+	job.started = time.Now()
+	p.jobs[videoID] = job
+}
+
+// probed records the video's duration once it's known.
+func (p *processingProgress) probed(videoID uuid.UUID, duration float64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if job, ok := p.jobs[videoID]; ok {
+		job.duration = duration
+		p.jobs[videoID] = job
+	}
+}
+
+// done forgets a job, however it ended.
+func (p *processingProgress) done(videoID uuid.UUID) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.jobs, videoID)
+}
+
+// lookup returns a job's progress and how many queued jobs are ahead of
+// it. ok is false for jobs this server isn't processing.
+func (p *processingProgress) lookup(videoID uuid.UUID) (job jobProgress, ahead int, ok bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	job, ok = p.jobs[videoID]
+	if !ok || !job.started.IsZero() {
+		return job, 0, ok
+	}
+	for _, other := range p.jobs {
+		if other.started.IsZero() && other.order < job.order {
+			ahead++
+		}
+	}
+	return job, ahead, true
+}
+
+// etaEstimator turns a job's progress into a rough time left.
+type etaEstimator struct {
+	// speedFactor is seconds of processing per second of video.
+	speedFactor float64
+	// jobEstimate stands in for jobs whose duration isn't known yet.
+	jobEstimate time.Duration
+	// parallel is how many jobs are processed at once.
+	parallel int
+	// maxETA caps the estimate; 0 means no cap. It's never below a second.
+	maxETA time.Duration
+}
+
+// estimate returns how long job has left at now, with ahead jobs queued
+// before it. A job that has started counts down from its expected length,
+// so the estimate shrinks as processing goes on.
+func (e etaEstimator) estimate(job jobProgress, ahead int, now time.Time) time.Duration {
+	own := e.jobEstimate
+	if job.duration > 0 {
+		own = time.Duration(job.duration * e.speedFactor * float64(time.Second))
+	}
+
+	var remaining time.Duration
+	if job.started.IsZero() {
+		// Queued jobs go through the workers a round at a time, after
+		// the round already running
+		rounds := ahead/max(e.parallel, 1) + 1
+		remaining = time.Duration(rounds)*e.jobEstimate + own
+	} else {
+		remaining = own - now.Sub(job.started)
+	}
+
+	if e.maxETA > 0 && remaining > e.maxETA {
+		remaining = e.maxETA
+	}
+	if remaining < time.Second {
+		remaining = time.Second
+	}
+	return remaining
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestETAEstimate(t *testing.T) {
+	e := etaEstimator{
+		speedFactor: 0.5,
+		jobEstimate: 30 * time.Second,
+		parallel:    2,
+		maxETA:      10 * time.Minute,
+	}
+	started := time.Now()
+	running := jobProgress{started: started, duration: 120}
+
+	t.Run("decreases as processing advances", func(t *testing.T) {
+		var previous time.Duration
+		for i, elapsed := range []time.Duration{0, 10 * time.Second, 30 * time.Second, 50 * time.Second} {
+			got := e.estimate(running, 0, started.Add(elapsed))
+			if want := 60*time.Second - elapsed; got != want {
+				t.Errorf("estimate after %s = %s, want %s", elapsed, got, want)
+			}
+			if i > 0 && got >= previous {
+				t.Errorf("estimate after %s = %s, not below %s", elapsed, got, previous)
+			}
+			previous = got
+		}
+	})
+
+	t.Run("floored once overdue", func(t *testing.T) {
+		if got := e.estimate(running, 0, started.Add(5*time.Minute)); got != time.Second {
+			t.Errorf("overdue estimate = %s, want 1s", got)
+		}
+	})
+
+	t.Run("unknown duration uses the job estimate", func(t *testing.T) {
+		job := jobProgress{started: started}
+		if got := e.estimate(job, 0, started); got != 30*time.Second {
+			t.Errorf("estimate = %s, want 30s", got)
+		}
+	})
+
+	t.Run("grows with the queue", func(t *testing.T) {
+		queued := jobProgress{}
+		tests := []struct {
+			ahead int
+			want  time.Duration
+		}{
+			{ahead: 0, want: 60 * time.Second},
+			{ahead: 1, want: 60 * time.Second},
+			{ahead: 2, want: 90 * time.Second},
+			{ahead: 5, want: 120 * time.Second},
+		}
+		for _, tt := range tests {
+			if got := e.estimate(queued, tt.ahead, started); got != tt.want {
+				t.Errorf("estimate with %d ahead = %s, want %s", tt.ahead, got, tt.want)
+			}
+		}
+	})
+
+	t.Run("capped", func(t *testing.T) {
+		long := jobProgress{started: started, duration: 4 * 3600}
+		if got := e.estimate(long, 0, started); got != e.maxETA {
+			t.Errorf("estimate = %s, want the %s cap", got, e.maxETA)
+		}
+	})
+}
+
+func TestProcessingProgressLookup(t *testing.T) {
+	p := newProcessingProgress()
+	first, second, third := uuid.New(), uuid.New(), uuid.New()
+	p.queue(first)
+	p.queue(second)
+	p.queue(third)
+
+	if _, ahead, _ := p.lookup(third); ahead != 2 {
+		t.Errorf("ahead of third = %d, want 2", ahead)
+	}
+	p.start(first)
+	if _, ahead, _ := p.lookup(third); ahead != 1 {
+		t.Errorf("ahead of third once first started = %d, want 1", ahead)
+	}
+	p.probed(first, 42)
+	if job, _, _ := p.lookup(first); job.duration != 42 || job.started.IsZero() {
+		t.Errorf("first = %+v, want started with duration 42", job)
+	}
+	p.done(first)
+	if _, _, ok := p.lookup(first); ok {
+		t.Error("first still tracked after done")
+	}
+}
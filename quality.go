@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Quality warnings set on videos that look like failed recordings.
+const (
+	qualityWarningBlack  = "mostly_black"
+	qualityWarningSilent = "mostly_silent"
+)
+
+// qualityThresholds tune the black/silence analysis. A video is flagged
+// when more than MaxRatio of its duration is black or silent.
+type qualityThresholds struct {
+	MaxRatio float64
+	// BlackPixel is blackdetect's pix_th: how dark a pixel must be, 0-1.
+	BlackPixel float64
+	// SilenceDB is silencedetect's noise floor, e.g. -50.
+	SilenceDB float64
+}
+
+var (
+	blackDurationPattern   = regexp.MustCompile(`black_duration:\s*([0-9.]+)`)
+	silenceDurationPattern = regexp.MustCompile(`silence_duration:\s*([0-9.]+)`)
+)
+
+// analyzeQuality decodes the file once through ffmpeg's blackdetect and
+// silencedetect filters and returns the warnings that apply. Audio-only
+// files skip the black check and files without audio skip the silence
+// check.
+func analyzeQuality(ctx context.Context, filePath string, meta videoMetadata, thresholds qualityThresholds, threads int) ([]string, error) {
+	checkBlack := !meta.AudioOnly
+	checkSilence := meta.AudioCodec != ""
+	if !checkBlack && !checkSilence {
+		return nil, nil
+	}
+
+	// Without a duration there's nothing to compare against
+	duration := meta.Duration
+	if duration == 0 {
+		return nil, nil
+	}
+	input, err := ffmpegPath(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	args := []string{"-hide_banner", "-nostats", "-i", input, "-threads", strconv.Itoa(threads)}
+	if checkBlack {
+		args = append(args, "-vf", fmt.Sprintf("blackdetect=d=0.1:pix_th=%s", strconv.FormatFloat(thresholds.BlackPixel, 'f', -1, 64)))
+	} else {
+		args = append(args, "-vn")
+	}
+	if checkSilence {
+		args = append(args, "-af", fmt.Sprintf("silencedetect=n=%sdB:d=0.5", strconv.FormatFloat(thresholds.SilenceDB, 'f', -1, 64)))
+	} else {
+		args = append(args, "-an")
+	}
+	args = append(args, "-f", "null", "-")
+
+	cmd := exec.CommandContext(ctx, "ffmpeg", args...)
+	var errBuf bytes.Buffer
+	cmd.Stderr = &errBuf
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("ffmpeg quality analysis failed: %w", newFFmpegError(ctx, cmd, err, errBuf.String()))
+	}
+
+	// The filters log their findings on stderr
+	log := errBuf.String()
+	var warnings []string
+	if checkBlack && sumDurations(blackDurationPattern, log)/duration > thresholds.MaxRatio {
+		warnings = append(warnings, qualityWarningBlack)
+	}
+	if checkSilence && sumDurations(silenceDurationPattern, log)/duration > thresholds.MaxRatio {
+		warnings = append(warnings, qualityWarningSilent)
+	}
+	return warnings, nil
+}
+
+// sumDurations adds up every duration the pattern captures in log.
+func sumDurations(pattern *regexp.Regexp, log string) float64 {
+	var total float64
+	for _, line := range strings.Split(log, "\n") {
+		if m := pattern.FindStringSubmatch(line); m != nil {
+			if d, err := strconv.ParseFloat(m[1], 64); err == nil {
+				total += d
+			}
+		}
+	}
+	return total
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// renditionHeightsFromEnv reads RENDITION_HEIGHTS, a comma-separated list
+// of heights such as "480,720,1080" (the default). "off" disables
+// renditions.
+func renditionHeightsFromEnv() []int {
+	raw := strings.TrimSpace(os.Getenv("RENDITION_HEIGHTS"))
+	switch raw {
+	case "":
+		raw = "480,720,1080"
+	case "off":
+		return nil
+	}
+	var heights []int
+	for _, field := range strings.Split(raw, ",") {
+		field = strings.TrimSuffix(strings.TrimSpace(field), "p")
+		if field == "" {
+			continue
+		}
+		height, err := strconv.Atoi(field)
+		// libx264 needs even dimensions
+		if err != nil || height <= 0 || height%2 != 0 {
+			log.Printf("Ignoring invalid height %q in RENDITION_HEIGHTS", field)
+			continue
+		}
+		heights = append(heights, height)
+	}
+	slices.Sort(heights)
+	return slices.Compact(heights)
+}
+
+// generateRendition scales the video at inputPath down to the given height
+// and returns the path of a fast-start MP4 the caller must remove. For a
+// portrait video the height is applied to the short side, so 720p means
+// 720 pixels wide.
+func generateRendition(tempDir, inputPath string, height int, portrait bool, threads int, retry retryPolicy) (string, error) {
+	out, err := os.CreateTemp(tempDir, "tubely-rendition-*.mp4")
+	if err != nil {
+		return "", fmt.Errorf("create rendition file: %w", err)
+	}
+	outPath := out.Name()
+	out.Close()
+	input, err := ffmpegPath(inputPath)
+	if err != nil {
+		os.Remove(outPath)
+		return "", err
+	}
+	output, err := ffmpegPath(outPath)
+	if err != nil {
+		os.Remove(outPath)
+		return "", err
+	}
+
+	// -2 keeps the aspect ratio while rounding to an even size
+	scale := fmt.Sprintf("scale=-2:%d", height)
+	if portrait {
+		scale = fmt.Sprintf("scale=%d:-2", height)
+	}
+	err = runFFmpeg(func(ctx context.Context) *exec.Cmd {
+		return exec.CommandContext(ctx,
+			"ffmpeg",
+			"-y",
+			"-v", "error",
+			"-i", input,
+			"-threads", strconv.Itoa(threads),
+			"-map", "0:v:0", "-map", "0:a:0?",
+			"-vf", scale,
+			"-c:v", "libx264", "-c:a", "aac",
+			"-movflags", "faststart",
+			"-f", "mp4",
+			output,
+		)
+	}, retry)
+	if err != nil {
+		os.Remove(outPath)
+		return "", fmt.Errorf("ffmpeg %dp rendition failed: %w", height, err)
+	}
+	return outPath, nil
+}
+
+// generateRenditions makes a rendition of the video at sourcePath for each
+// configured height below the source's own, stores them beside the main
+// object as keyStem + "/720p.mp4" and so on, and records them on the video.
+// It runs in the background and takes ownership of sourcePath, removing it
+// when done. Renditions that fail are logged and left out, and all of them
+// are deleted if the video has moved on from videoURL in the meantime.
+func (cfg *apiConfig) generateRenditions(videoID uuid.UUID, videoURL, sourcePath, keyStem string, width, height int) {
+	go func() {
+		defer os.Remove(sourcePath)
+
+		// Renditions share the transcode slots, so they never starve uploads
+		// of more than their share
+		logger := cfg.logger.With("video_id", videoID)
+		release, err := cfg.processLimiter.wait(context.Background())
+		if err != nil {
+			logger.Warn("skipping renditions", "error", err)
+			return
+		}
+		defer release()
+
+		portrait := height > width
+		shortSide := min(width, height)
+		var renditions []database.Rendition
+		for _, target := range cfg.renditionHeights {
+			if target >= shortSide {
+				break
+			}
+			name := strconv.Itoa(target) + "p"
+			location, err := cfg.storeRendition(sourcePath, keyStem+"/"+name+".mp4", target, portrait)
+			if err != nil {
+				logger.Warn("skipping rendition", "rendition", name, "error", err)
+				continue
+			}
+			renditions = append(renditions, database.Rendition{Name: name, Height: target, URL: location})
+		}
+		if len(renditions) == 0 {
+			return
+		}
+
+		ok, err := cfg.db.SetVideoRenditions(videoID, videoURL, renditions)
+		if err != nil {
+			logger.Error("recording renditions failed", "error", err)
+			cfg.deleteUploadedObjects(renditionLocations(renditions)...)
+			return
+		}
+		if !ok {
+			logger.Info("video replaced or deleted before its renditions were stored")
+			cfg.deleteUploadedObjects(renditionLocations(renditions)...)
+			return
+		}
+		logger.Info("stored renditions", "count", len(renditions))
+	}()
+}
+
+// storeRendition generates one rendition and uploads it to key, returning
+// its "bucket,key" location.
+func (cfg *apiConfig) storeRendition(sourcePath, key string, height int, portrait bool) (string, error) {
+	renditionPath, err := generateRendition(cfg.tempDir, sourcePath, height, portrait, cfg.ffmpegThreads, cfg.ffmpegRetry)
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(renditionPath)
+
+	f, err := os.Open(renditionPath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	ctx, cancel := cfg.s3Context(context.Background())
+	defer cancel()
+	if err := cfg.putObject(ctx, key, "video/mp4", f); err != nil {
+		return "", err
+	}
+	return cfg.s3Bucket + "," + key, nil
+}
+
+// renditionLocations lists where renditions are stored.
+func renditionLocations(renditions []database.Rendition) []string {
+	locations := make([]string, 0, len(renditions))
+	for _, rendition := range renditions {
+		locations = append(locations, rendition.URL)
+	}
+	return locations
+}
+
+// clearFileRecords forgets the renditions and replica of a video's
+// previous file once it's been replaced. UpdateVideo leaves both alone, as
+// they're written in the background. deleteReplacedFiles removes the
+// objects.
+func (cfg *apiConfig) clearFileRecords(video *database.Video) {
+	if len(video.Renditions) > 0 {
+		if _, err := cfg.db.SetVideoRenditions(video.ID, *video.VideoURL, nil); err != nil {
+			cfg.logger.Error("clearing renditions failed", "video_id", video.ID, "error", err)
+		}
+		video.Renditions = nil
+	}
+	if video.ReplicaURL != nil {
+		if err := cfg.db.SetVideoReplicaURL(video.ID, nil); err != nil {
+			cfg.logger.Error("clearing replica failed", "video_id", video.ID, "error", err)
+		}
+		video.ReplicaURL = nil
+	}
+}
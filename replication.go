@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/google/uuid"
+)
+
+const replicationTimeout = 15 * time.Minute
+
+// replicateVideo copies a freshly uploaded object into the secondary
+// bucket in the background and records the copy on the video. It is best
+// effort: failures are logged and the upload is unaffected.
+func (cfg *apiConfig) replicateVideo(videoID uuid.UUID, key string) {
+	if cfg.secondaryS3Client == nil || cfg.secondaryS3Bucket == "" {
+		return
+	}
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), replicationTimeout)
+		defer cancel()
+
+		source := url.PathEscape(cfg.s3Bucket) + "/" + (&url.URL{Path: key}).EscapedPath()
+		_, err := cfg.secondaryS3Client.CopyObject(ctx, &s3.CopyObjectInput{
+			Bucket:     aws.String(cfg.secondaryS3Bucket),
+			Key:        aws.String(key),
+			CopySource: aws.String(source),
+			// Copies don't inherit the source's encryption settings
+			ServerSideEncryption: cfg.secondaryEncryption.mode(),
+			SSEKMSKeyId:          cfg.secondaryEncryption.kmsKeyID(),
+		})
+		if err != nil {
+			cfg.logger.Error("replicating video failed", "video_id", videoID, "bucket", cfg.secondaryS3Bucket, "key", key, "error", err)
+			return
+		}
+
+		location := cfg.secondaryS3Bucket + "," + key
+		if err := cfg.db.SetVideoReplicaURL(videoID, &location); err != nil {
+			cfg.logger.Error("recording replica failed", "video_id", videoID, "key", key, "error", err)
+		}
+	}()
+}
+
+// readableVideoLocation returns where a URL handed to a client should
+// point: the primary location unless it has gone missing and a replica
+// exists. A signed URL can't fall back by itself, so this checks the
+// primary with a HeadObject first. Reads the server makes itself go
+// straight to the primary and only try the replica when they fail.
+func (cfg *apiConfig) readableVideoLocation(ctx context.Context, primary string, replica *string) (bucket, key string, client *s3.Client, err error) {
+	bucket, key, err = parseVideoLocation(primary)
+	if err != nil {
+		return "", "", nil, err
+	}
+	if replica == nil || cfg.secondaryS3Client == nil {
+		return bucket, key, cfg.s3Client, nil
+	}
+
+	_, headErr := cfg.s3Client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if headErr == nil {
+		return bucket, key, cfg.s3Client, nil
+	}
+
+	replicaBucket, replicaKey, err := parseVideoLocation(*replica)
+	if err != nil {
+		return "", "", nil, fmt.Errorf("primary unavailable (%v) and replica invalid: %w", headErr, err)
+	}
+	cfg.logger.Warn("primary object unavailable, reading replica", "bucket", bucket, "key", key, "error", headErr)
+	return replicaBucket, replicaKey, cfg.secondaryS3Client, nil
+}
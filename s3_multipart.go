@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// S3 rejects parts smaller than 5 MiB, except for the last one, parts
+// larger than 5 GiB, and uploads with more than 10,000 parts.
+const (
+	minPartSize     = 5 << 20
+	maxPartSize     = 5 << 30
+	maxUploadParts  = 10000
+	defaultPartSize = 8 << 20
+)
+
+// partSizing controls multipart part sizes. Parts start at Initial and,
+// when the total size is known, double in steps so the upload fits in
+// S3's part limit. No part grows beyond Max, which bounds memory use.
+type partSizing struct {
+	Initial int64
+	Max     int64
+}
+
+// rampSteps are the candidate numbers of parts between doublings, from
+// "never grow" down to growing quickly.
+var rampSteps = []int32{maxUploadParts, 5000, 2000, 1000, 500, 250, 100, 50, 10, 1}
+
+// plan returns the part size for each part number of an upload of
+// totalSize bytes, or -1 if unknown. Unknown sizes use Initial throughout.
+// It picks the slowest ramp that still fits totalSize in maxUploadParts.
+func (p partSizing) plan(totalSize int64) (func(partNumber int32) int64, error) {
+	initial := max(p.Initial, minPartSize)
+	limit := min(max(p.Max, initial), maxPartSize)
+	if totalSize < 0 {
+		return func(int32) int64 { return initial }, nil
+	}
+
+	sizeAt := func(step, partNumber int32) int64 {
+		size := initial
+		for i := (partNumber - 1) / step; i > 0 && size < limit; i-- {
+			size *= 2
+		}
+		return min(size, limit)
+	}
+	for _, step := range rampSteps {
+		var capacity int64
+		for n := int32(1); n <= maxUploadParts && capacity < totalSize; n++ {
+			capacity += sizeAt(step, n)
+		}
+		if capacity >= totalSize {
+			return func(partNumber int32) int64 { return sizeAt(step, partNumber) }, nil
+		}
+	}
+	return nil, fmt.Errorf("%d bytes won't fit in %d parts of at most %d bytes", totalSize, maxUploadParts, limit)
+}
+
+// uploadMultipart streams body into key in the primary bucket as an S3
+// multipart upload, holding at most one part in memory. size is the body
+// length, or -1 if it isn't known up front, which is what makes it usable
+// with pipes. Any failure aborts the upload so no orphaned parts are left
+// behind. Each request is retried on its own; parts are buffered, so a
+// retry never needs to re-read body.
+func (cfg *apiConfig) uploadMultipart(ctx context.Context, key, contentType string, body io.Reader, size int64) error {
+	client, bucket, policy := cfg.s3Client, cfg.s3Bucket, cfg.s3Retry
+	partSize, err := cfg.multipartSizing.plan(size)
+	if err != nil {
+		return err
+	}
+
+	var created *s3.CreateMultipartUploadOutput
+	err = retryS3(ctx, policy, "create multipart upload", func() (err error) {
+		created, err = client.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
+			Bucket:               aws.String(bucket),
+			Key:                  aws.String(key),
+			ContentType:          aws.String(contentType),
+			ServerSideEncryption: cfg.objectEncryption.mode(),
+			SSEKMSKeyId:          cfg.objectEncryption.kmsKeyID(),
+		})
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("create multipart upload: %w", err)
+	}
+	uploadID := created.UploadId
+
+	abort := func(cause error) error {
+		// Use a fresh context: the request context may be the reason we failed.
+		_, abortErr := client.AbortMultipartUpload(context.Background(), &s3.AbortMultipartUploadInput{
+			Bucket:   aws.String(bucket),
+			Key:      aws.String(key),
+			UploadId: uploadID,
+		})
+		if abortErr != nil {
+			cfg.logger.Error("aborting multipart upload failed", "upload_id", aws.ToString(uploadID), "bucket", bucket, "key", key, "error", abortErr)
+		}
+		return cause
+	}
+
+	var completed []types.CompletedPart
+	var buf []byte
+	for partNumber := int32(1); ; partNumber++ {
+		if partNumber > maxUploadParts {
+			return abort(fmt.Errorf("body needs more than %d parts", maxUploadParts))
+		}
+		if want := partSize(partNumber); int64(len(buf)) != want {
+			buf = make([]byte, want)
+		}
+		n, readErr := io.ReadFull(body, buf)
+		if readErr != nil && !errors.Is(readErr, io.EOF) && !errors.Is(readErr, io.ErrUnexpectedEOF) {
+			return abort(fmt.Errorf("read part %d: %w", partNumber, readErr))
+		}
+		// An empty trailing read only counts as a part if nothing was sent yet.
+		if n == 0 && len(completed) > 0 {
+			break
+		}
+
+		var part *s3.UploadPartOutput
+		err := retryS3(ctx, policy, fmt.Sprintf("upload part %d", partNumber), func() (err error) {
+			part, err = client.UploadPart(ctx, &s3.UploadPartInput{
+				Bucket:     aws.String(bucket),
+				Key:        aws.String(key),
+				UploadId:   uploadID,
+				PartNumber: aws.Int32(partNumber),
+				Body:       bytes.NewReader(buf[:n]),
+			})
+			return err
+		})
+		if err != nil {
+			return abort(fmt.Errorf("upload part %d: %w", partNumber, err))
+		}
+		completed = append(completed, types.CompletedPart{
+			ETag:       part.ETag,
+			PartNumber: aws.Int32(partNumber),
+		})
+
+		if readErr != nil {
+			break
+		}
+	}
+
+	err = retryS3(ctx, policy, "complete multipart upload", func() error {
+		_, err := client.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+			Bucket:          aws.String(bucket),
+			Key:             aws.String(key),
+			UploadId:        uploadID,
+			MultipartUpload: &types.CompletedMultipartUpload{Parts: completed},
+		})
+		return err
+	})
+	if err != nil {
+		return abort(fmt.Errorf("complete multipart upload: %w", err))
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import "testing"
+
+func TestPartSizingPlan(t *testing.T) {
+	const mib = 1 << 20
+
+	tests := []struct {
+		name      string
+		sizing    partSizing
+		totalSize int64
+		// want maps part numbers to their expected sizes
+		want    map[int32]int64
+		wantErr bool
+	}{
+		{
+			name:      "unknown size uses initial throughout",
+			sizing:    partSizing{Initial: 8 * mib, Max: 64 * mib},
+			totalSize: -1,
+			want:      map[int32]int64{1: 8 * mib, 5000: 8 * mib, maxUploadParts: 8 * mib},
+		},
+		{
+			name:      "initial below the S3 minimum is raised",
+			sizing:    partSizing{Initial: mib, Max: 64 * mib},
+			totalSize: -1,
+			want:      map[int32]int64{1: minPartSize},
+		},
+		{
+			name:      "small upload never grows",
+			sizing:    partSizing{Initial: 8 * mib, Max: 64 * mib},
+			totalSize: 100 * mib,
+			want:      map[int32]int64{1: 8 * mib, 13: 8 * mib, maxUploadParts: 8 * mib},
+		},
+		{
+			name:      "large upload ramps up",
+			sizing:    partSizing{Initial: 8 * mib, Max: 64 * mib},
+			totalSize: 200 << 30,
+			want:      map[int32]int64{1: 8 * mib},
+		},
+		{
+			name:      "max below initial caps at initial",
+			sizing:    partSizing{Initial: 16 * mib, Max: 8 * mib},
+			totalSize: 100 * mib,
+			want:      map[int32]int64{1: 16 * mib, 7: 16 * mib},
+		},
+		{
+			name:      "too large for the part limit",
+			sizing:    partSizing{Initial: 8 * mib, Max: 8 * mib},
+			totalSize: 8 * mib * (maxUploadParts + 1),
+			wantErr:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			partSize, err := tt.sizing.plan(tt.totalSize)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("plan() error = nil, want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("plan() error = %v", err)
+			}
+			for partNumber, want := range tt.want {
+				if got := partSize(partNumber); got != want {
+					t.Errorf("part %d size = %d, want %d", partNumber, got, want)
+				}
+			}
+
+			// A known size has to fit in the part limit, with parts that
+			// never shrink and never pass Max
+			if tt.totalSize < 0 {
+				return
+			}
+			limit := min(max(tt.sizing.Max, tt.sizing.Initial, minPartSize), maxPartSize)
+			var capacity, previous int64
+			for n := int32(1); n <= maxUploadParts; n++ {
+				size := partSize(n)
+				if size < previous || size > limit {
+					t.Fatalf("part %d size = %d after %d, limit %d", n, size, previous, limit)
+				}
+				capacity += size
+				previous = size
+			}
+			if capacity < tt.totalSize {
+				t.Fatalf("parts hold %d bytes, want at least %d", capacity, tt.totalSize)
+			}
+		})
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// objectEncryption is the server-side encryption applied to every object
+// this server writes: SSE-KMS with KMSKeyID when one is set, otherwise
+// S3-managed AES256.
+type objectEncryption struct {
+	KMSKeyID string
+}
+
+func (e objectEncryption) mode() types.ServerSideEncryption {
+	if e.KMSKeyID != "" {
+		return types.ServerSideEncryptionAwsKms
+	}
+	return types.ServerSideEncryptionAes256
+}
+
+func (e objectEncryption) kmsKeyID() *string {
+	if e.KMSKeyID == "" {
+		return nil
+	}
+	return aws.String(e.KMSKeyID)
+}
+
+// objectEncryptionFromEnv reads S3_SSE_KMS_KEY_ID, a KMS key ID or ARN.
+func objectEncryptionFromEnv() objectEncryption {
+	return objectEncryption{KMSKeyID: os.Getenv("S3_SSE_KMS_KEY_ID")}
+}
+
+// putObject uploads a local file to key in the primary bucket in a single
+// request, retrying transient failures. The file is rewound before every
+// attempt.
+func (cfg *apiConfig) putObject(ctx context.Context, key, contentType string, f *os.File) error {
+	return retryS3(ctx, cfg.s3Retry, "upload "+key, func() error {
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		_, err := cfg.s3Client.PutObject(ctx, &s3.PutObjectInput{
+			Bucket:               aws.String(cfg.s3Bucket),
+			Key:                  aws.String(key),
+			Body:                 f,
+			ContentType:          aws.String(contentType),
+			ServerSideEncryption: cfg.objectEncryption.mode(),
+			SSEKMSKeyId:          cfg.objectEncryption.kmsKeyID(),
+		})
+		return err
+	})
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPutObjectEncryption(t *testing.T) {
+	tests := []struct {
+		name       string
+		encryption objectEncryption
+		wantMode   string
+		wantKeyID  string
+	}{
+		{name: "aes256 by default", wantMode: "AES256"},
+		{name: "kms with a key", encryption: objectEncryption{KMSKeyID: "alias/tubely"}, wantMode: "aws:kms", wantKeyID: "alias/tubely"},
+	}
+
+	path := filepath.Join(t.TempDir(), "video.mp4")
+	if err := os.WriteFile(path, []byte("data"), 0o644); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var header http.Header
+			cfg := &apiConfig{
+				s3Bucket:         "bucket",
+				objectEncryption: tt.encryption,
+				s3Client: newTestS3Client(t, func(w http.ResponseWriter, r *http.Request) {
+					header = r.Header.Clone()
+					w.WriteHeader(http.StatusOK)
+				}),
+			}
+
+			f, err := os.Open(path)
+			if err != nil {
+				t.Fatalf("open file: %v", err)
+			}
+			defer f.Close()
+			if err := cfg.putObject(context.Background(), "key.mp4", "video/mp4", f); err != nil {
+				t.Fatalf("putObject: %v", err)
+			}
+
+			if got := header.Get("X-Amz-Server-Side-Encryption"); got != tt.wantMode {
+				t.Errorf("encryption = %q, want %q", got, tt.wantMode)
+			}
+			if got := header.Get("X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id"); got != tt.wantKeyID {
+				t.Errorf("KMS key = %q, want %q", got, tt.wantKeyID)
+			}
+		})
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"math/rand/v2"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+)
+
+// s3Retryables are the SDK's own rules for what's worth retrying: 5xx
+// responses, throttling, and dropped connections. Auth failures, bad
+// requests, and cancelled contexts are not.
+var s3Retryables = retry.IsErrorRetryables(retry.DefaultRetryables)
+
+func isRetryableS3Error(err error) bool {
+	return s3Retryables.IsErrorRetryable(err) == aws.TrueTernary
+}
+
+// retryS3 runs an S3 call until it succeeds, fails for good, or policy runs
+// out of attempts. This sits on top of the SDK's own short retries so a
+// large upload survives a longer S3 hiccup. Waits double from Backoff with
+// full jitter, so concurrent uploads don't retry in lockstep. fn must be
+// safe to call again, e.g. by rewinding its request body.
+func retryS3(ctx context.Context, policy retryPolicy, op string, fn func() error) error {
+	wait := policy.Backoff
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= policy.Attempts || !isRetryableS3Error(err) {
+			return err
+		}
+
+		sleep := time.Duration(0)
+		if wait > 0 {
+			sleep = rand.N(wait)
+		}
+		slog.Warn("S3 call failed, retrying", "op", op, "attempt", attempt, "attempts", policy.Attempts, "wait", sleep, "error", err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(sleep):
+		}
+		wait *= 2
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// newTestS3Client returns a client for a fake S3 served by handler. The
+// SDK's own retries are off so tests see every attempt.
+func newTestS3Client(t *testing.T, handler http.HandlerFunc) *s3.Client {
+	t.Helper()
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+	return s3.New(s3.Options{
+		Region:           "us-east-1",
+		BaseEndpoint:     aws.String(srv.URL),
+		UsePathStyle:     true,
+		Credentials:      credentials.NewStaticCredentialsProvider("key", "secret", ""),
+		RetryMaxAttempts: 1,
+	})
+}
+
+func TestRetryS3(t *testing.T) {
+	tests := []struct {
+		name      string
+		failures  int
+		status    int
+		wantCalls int32
+		wantErr   bool
+	}{
+		{name: "recovers from 5xx", failures: 2, status: http.StatusServiceUnavailable, wantCalls: 3},
+		{name: "gives up after the last attempt", failures: 5, status: http.StatusServiceUnavailable, wantCalls: 3, wantErr: true},
+		{name: "does not retry auth failures", failures: 5, status: http.StatusForbidden, wantCalls: 1, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls atomic.Int32
+			client := newTestS3Client(t, func(w http.ResponseWriter, r *http.Request) {
+				if int(calls.Add(1)) <= tt.failures {
+					w.WriteHeader(tt.status)
+					return
+				}
+				w.WriteHeader(http.StatusOK)
+			})
+
+			err := retryS3(context.Background(), retryPolicy{Attempts: 3}, "test put", func() error {
+				_, err := client.PutObject(context.Background(), &s3.PutObjectInput{
+					Bucket: aws.String("bucket"),
+					Key:    aws.String("key"),
+					Body:   strings.NewReader("data"),
+				})
+				return err
+			})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("retryS3() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got := calls.Load(); got != tt.wantCalls {
+				t.Errorf("calls = %d, want %d", got, tt.wantCalls)
+			}
+		})
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// serverTimings collects how long each stage of a request took, reported
+// to clients as a Server-Timing header. A nil *serverTimings records
+// nothing, so stages can be timed unconditionally.
+type serverTimings struct {
+	stages []timedStage
+}
+
+type timedStage struct {
+	name     string
+	duration time.Duration
+}
+
+// start begins timing a stage; call the returned func when it's done.
+func (t *serverTimings) start(name string) func() {
+	if t == nil {
+		return func() {}
+	}
+	began := time.Now()
+	return func() {
+		t.stages = append(t.stages, timedStage{name: name, duration: time.Since(began)})
+	}
+}
+
+// write sets the Server-Timing header, e.g. "probe;dur=12.5, upload;dur=830.1".
+func (t *serverTimings) write(w http.ResponseWriter) {
+	if t == nil || len(t.stages) == 0 {
+		return
+	}
+	entries := make([]string, len(t.stages))
+	for i, s := range t.stages {
+		entries[i] = fmt.Sprintf("%s;dur=%.1f", s.name, float64(s.duration.Microseconds())/1000)
+	}
+	w.Header().Set("Server-Timing", strings.Join(entries, ", "))
+}
+
+// uploadTimingsFor returns a collector when the deployment always reports
+// timings or the client asks with "X-Upload-Timings: true", else nil.
+func (cfg *apiConfig) uploadTimingsFor(r *http.Request) *serverTimings {
+	if cfg.uploadTimings || r.Header.Get("X-Upload-Timings") == "true" {
+		return &serverTimings{}
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// streamRateLimits caps streaming egress in bytes per second per
+// connection. Zero means unlimited.
+type streamRateLimits struct {
+	defaultRate int64
+	perUser     map[uuid.UUID]int64
+}
+
+func (l streamRateLimits) forUser(userID uuid.UUID) int64 {
+	if rate, ok := l.perUser[userID]; ok {
+		return rate
+	}
+	return l.defaultRate
+}
+
+// streamRateLimitsFromEnv reads STREAM_RATE_LIMIT and
+// STREAM_RATE_LIMIT_USERS, a comma separated list of userID=bytesPerSecond
+// overrides for users that need a different cap.
+func streamRateLimitsFromEnv() streamRateLimits {
+	limits := streamRateLimits{
+		defaultRate: int64(envInt("STREAM_RATE_LIMIT", 0)),
+		perUser:     make(map[uuid.UUID]int64),
+	}
+	raw := os.Getenv("STREAM_RATE_LIMIT_USERS")
+	if raw == "" {
+		return limits
+	}
+	for _, entry := range strings.Split(raw, ",") {
+		idStr, rateStr, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if !ok {
+			log.Printf("Ignoring STREAM_RATE_LIMIT_USERS entry %q: want userID=bytesPerSecond", entry)
+			continue
+		}
+		id, err := uuid.Parse(idStr)
+		if err != nil {
+			log.Printf("Ignoring STREAM_RATE_LIMIT_USERS entry %q: %v", entry, err)
+			continue
+		}
+		rate, err := strconv.ParseInt(rateStr, 10, 64)
+		if err != nil || rate < 0 {
+			log.Printf("Ignoring STREAM_RATE_LIMIT_USERS entry %q: invalid rate", entry)
+			continue
+		}
+		limits.perUser[id] = rate
+	}
+	return limits
+}
+
+// throttledWriter paces writes to rate bytes per second with a token
+// bucket holding up to one second of burst. It stops waiting as soon as
+// ctx is done, so a disconnected client doesn't hold the goroutine.
+type throttledWriter struct {
+	ctx    context.Context
+	w      io.Writer
+	rate   int64
+	tokens float64
+	last   time.Time
+}
+
+func newThrottledWriter(ctx context.Context, w io.Writer, rate int64) io.Writer {
+	if rate <= 0 {
+		return w
+	}
+	return &throttledWriter{ctx: ctx, w: w, rate: rate, last: time.Now()}
+}
+
+func (t *throttledWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		now := time.Now()
+		t.tokens += now.Sub(t.last).Seconds() * float64(t.rate)
+		t.last = now
+		if burst := float64(t.rate); t.tokens > burst {
+			t.tokens = burst
+		}
+
+		if t.tokens < 1 {
+			wait := time.Duration((1 - t.tokens) / float64(t.rate) * float64(time.Second))
+			timer := time.NewTimer(wait)
+			select {
+			case <-t.ctx.Done():
+				timer.Stop()
+				return written, t.ctx.Err()
+			case <-timer.C:
+			}
+			continue
+		}
+
+		chunk := int(t.tokens)
+		if chunk > len(p) {
+			chunk = len(p)
+		}
+		n, err := t.w.Write(p[:chunk])
+		written += n
+		t.tokens -= float64(n)
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+)
+
+// extractThumbnailCandidates writes up to count JPEG frames from the video
+// into a new temp directory and returns their paths. Frames are picked by
+// ffmpeg's scene-change score so they land on visually distinct shots
+// rather than fades or black transitions. If the video has too few cuts
+// above threshold, it falls back to frames at evenly spaced timestamps.
+// threads caps ffmpeg's worker threads per run. The caller is responsible
+// for removing the returned directory.
+func extractThumbnailCandidates(ctx context.Context, tempDir, filePath string, count int, threshold float64, threads int) (dir string, frames []string, err error) {
+	if count < 1 {
+		return "", nil, fmt.Errorf("candidate count must be positive")
+	}
+	dir, err = os.MkdirTemp(tempDir, "tubely-thumbs-")
+	if err != nil {
+		return "", nil, fmt.Errorf("create candidate dir: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			os.RemoveAll(dir)
+		}
+	}()
+
+	frames, err = sceneCandidates(ctx, filePath, dir, count, threshold, threads)
+	if err != nil {
+		return "", nil, err
+	}
+	if len(frames) >= count {
+		return dir, frames, nil
+	}
+
+	for _, f := range frames {
+		os.Remove(f)
+	}
+	frames, err = intervalCandidates(ctx, filePath, dir, count, threads)
+	if err != nil {
+		return "", nil, err
+	}
+	return dir, frames, nil
+}
+
+// sceneCandidates keeps only frames whose scene score exceeds threshold.
+func sceneCandidates(ctx context.Context, filePath, dir string, count int, threshold float64, threads int) ([]string, error) {
+	input, err := ffmpegPath(filePath)
+	if err != nil {
+		return nil, err
+	}
+	pattern, err := ffmpegPath(filepath.Join(dir, "scene-%03d.jpg"))
+	if err != nil {
+		return nil, err
+	}
+	cmd := exec.CommandContext(
+		ctx,
+		"ffmpeg",
+		"-v", "error",
+		"-i", input,
+		"-threads", strconv.Itoa(threads),
+		"-vf", fmt.Sprintf("select='gt(scene,%s)'", strconv.FormatFloat(threshold, 'f', -1, 64)),
+		"-vsync", "vfr",
+		"-frames:v", strconv.Itoa(count),
+		"-q:v", "2",
+		pattern,
+	)
+	var errBuf bytes.Buffer
+	cmd.Stderr = &errBuf
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("ffmpeg scene detection failed: %w", newFFmpegError(ctx, cmd, err, errBuf.String()))
+	}
+
+	frames, err := filepath.Glob(filepath.Join(dir, "scene-*.jpg"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(frames)
+	return frames, nil
+}
+
+// intervalCandidates grabs one frame at each of count evenly spaced points,
+// skipping the very start and end of the video.
+func intervalCandidates(ctx context.Context, filePath, dir string, count, threads int) ([]string, error) {
+	duration, err := getVideoDuration(ctx, filePath)
+	if err != nil {
+		return nil, err
+	}
+	input, err := ffmpegPath(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	frames := make([]string, 0, count)
+	for i := 1; i <= count; i++ {
+		at := duration * float64(i) / float64(count+1)
+		out := filepath.Join(dir, fmt.Sprintf("interval-%03d.jpg", i))
+		output, err := ffmpegPath(out)
+		if err != nil {
+			return nil, err
+		}
+		cmd := exec.CommandContext(
+			ctx,
+			"ffmpeg",
+			"-v", "error",
+			"-ss", strconv.FormatFloat(at, 'f', 3, 64),
+			"-i", input,
+			"-threads", strconv.Itoa(threads),
+			"-frames:v", "1",
+			"-q:v", "2",
+			output,
+		)
+		var errBuf bytes.Buffer
+		cmd.Stderr = &errBuf
+		if err := cmd.Run(); err != nil {
+			return nil, fmt.Errorf("ffmpeg frame grab at %.3fs failed: %w", at, newFFmpegError(ctx, cmd, err, errBuf.String()))
+		}
+		frames = append(frames, out)
+	}
+	return frames, nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+// maxThumbnailPixels caps how big an image is decoded at all. A small,
+// highly compressed file can claim enormous dimensions, and decoding it
+// would allocate the full bitmap.
+const maxThumbnailPixels = 50_000_000
+
+var errThumbnailTooLarge = errors.New("thumbnail dimensions are too large")
+
+// fitThumbnail scales an uploaded thumbnail down so neither side is
+// longer than maxSide, keeping its aspect ratio, and returns it with its
+// media type and final size. Smaller images are never scaled up and come
+// back untouched. GIFs are flattened to their first frame and stored as
+// PNG, as are resized WebPs, which the standard library can't encode.
+// maxSide 0 leaves the size alone.
+func fitThumbnail(file io.ReadSeeker, mediaType string, maxSide int) (io.ReadSeeker, string, image.Point, error) {
+	config, _, err := image.DecodeConfig(file)
+	if err != nil {
+		return nil, "", image.Point{}, err
+	}
+	if config.Width*config.Height > maxThumbnailPixels {
+		return nil, "", image.Point{}, errThumbnailTooLarge
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, "", image.Point{}, err
+	}
+
+	size := image.Pt(config.Width, config.Height)
+	resize := maxSide > 0 && max(size.X, size.Y) > maxSide
+	if !resize && mediaType != "image/gif" {
+		return file, mediaType, size, nil
+	}
+
+	// For a GIF this is the first frame
+	img, _, err := image.Decode(file)
+	if err != nil {
+		return nil, "", image.Point{}, err
+	}
+	if resize {
+		if size.X >= size.Y {
+			size = image.Pt(maxSide, max(1, maxSide*size.Y/size.X))
+		} else {
+			size = image.Pt(max(1, maxSide*size.X/size.Y), maxSide)
+		}
+		dst := image.NewRGBA(image.Rectangle{Max: size})
+		draw.CatmullRom.Scale(dst, dst.Bounds(), img, img.Bounds(), draw.Src, nil)
+		img = dst
+	}
+
+	var buf bytes.Buffer
+	if mediaType == "image/jpeg" {
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: 90})
+	} else {
+		mediaType = "image/png"
+		err = png.Encode(&buf, img)
+	}
+	if err != nil {
+		return nil, "", image.Point{}, err
+	}
+	return bytes.NewReader(buf.Bytes()), mediaType, size, nil
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// thumbnailEncoders are the formats uploaded thumbnails can be re-encoded
+// to, with their media type.
+var thumbnailEncoders = map[string]string{
+	"webp": "image/webp",
+	"avif": "image/avif",
+}
+
+// thumbnailFormatsFromEnv reads THUMBNAIL_FORMATS, a comma-separated list
+// of formats to try re-encoding PNG and JPEG thumbnails to. It defaults to
+// "webp"; "off" keeps thumbnails as uploaded.
+func thumbnailFormatsFromEnv() []string {
+	raw := strings.TrimSpace(os.Getenv("THUMBNAIL_FORMATS"))
+	switch raw {
+	case "":
+		return []string{"webp"}
+	case "off":
+		return nil
+	}
+	var formats []string
+	for _, format := range strings.Split(raw, ",") {
+		format = strings.ToLower(strings.TrimSpace(format))
+		if format == "" {
+			continue
+		}
+		if _, ok := thumbnailEncoders[format]; !ok {
+			log.Printf("Ignoring unsupported format %q in THUMBNAIL_FORMATS", format)
+			continue
+		}
+		if !slices.Contains(formats, format) {
+			formats = append(formats, format)
+		}
+	}
+	return formats
+}
+
+// transcodeThumbnail re-encodes the image at inputPath to format at the
+// given quality (0-100, higher is better) and returns the new file's
+// path, which the caller must remove. It fails if ffmpeg was built
+// without the encoder.
+func transcodeThumbnail(tempDir, inputPath, format string, quality, threads int, retry retryPolicy) (string, error) {
+	out, err := os.CreateTemp(tempDir, "tubely-thumbnail-*."+format)
+	if err != nil {
+		return "", fmt.Errorf("create %s thumbnail: %w", format, err)
+	}
+	outPath := out.Name()
+	out.Close()
+	input, err := ffmpegPath(inputPath)
+	if err != nil {
+		os.Remove(outPath)
+		return "", err
+	}
+	output, err := ffmpegPath(outPath)
+	if err != nil {
+		os.Remove(outPath)
+		return "", err
+	}
+
+	var codec []string
+	switch format {
+	case "webp":
+		codec = []string{"-c:v", "libwebp", "-quality", strconv.Itoa(quality)}
+	case "avif":
+		// libaom's CRF runs the other way, from 0 (lossless) to 63
+		crf := 63 - quality*63/100
+		codec = []string{"-c:v", "libaom-av1", "-still-picture", "1", "-crf", strconv.Itoa(crf)}
+	default:
+		os.Remove(outPath)
+		return "", fmt.Errorf("unsupported thumbnail format %q", format)
+	}
+
+	err = runFFmpeg(func(ctx context.Context) *exec.Cmd {
+		args := []string{"-y", "-v", "error", "-i", input, "-threads", strconv.Itoa(threads), "-frames:v", "1"}
+		args = append(args, codec...)
+		args = append(args, "-f", format, output)
+		return exec.CommandContext(ctx, "ffmpeg", args...)
+	}, retry)
+	if err != nil {
+		os.Remove(outPath)
+		return "", fmt.Errorf("ffmpeg %s thumbnail failed: %w", format, err)
+	}
+	return outPath, nil
+}
+
+// saveThumbnail stores an uploaded thumbnail as an asset and returns its
+// asset path, whose extension gives the stored format. PNG and JPEG uploads are re-encoded to each
+// of the configured formats and the smallest file is kept, which may be
+// the original. Formats that can't be encoded are skipped, so without
+// ffmpeg or its encoders thumbnails are stored as uploaded.
+func (cfg *apiConfig) saveThumbnail(src io.Reader, mediaType string) (string, error) {
+	if len(cfg.thumbnailFormats) == 0 || (mediaType != "image/png" && mediaType != "image/jpeg") {
+		return cfg.saveContentAddressedAsset(src, mediaType)
+	}
+
+	original, err := os.CreateTemp(cfg.tempDir, "tubely-thumbnail-*"+mediaTypeToExt(mediaType))
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(original.Name())
+	size, err := io.Copy(original, src)
+	if closeErr := original.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", err
+	}
+
+	bestPath, bestType, bestSize := original.Name(), mediaType, size
+	for _, format := range cfg.thumbnailFormats {
+		path, err := transcodeThumbnail(cfg.tempDir, original.Name(), format, cfg.thumbnailQuality, cfg.ffmpegThreads, cfg.ffmpegRetry)
+		if err != nil {
+			cfg.logger.Warn("skipping thumbnail format", "format", format, "error", err)
+			continue
+		}
+		defer os.Remove(path)
+		info, err := os.Stat(path)
+		if err != nil || info.Size() == 0 || info.Size() >= bestSize {
+			continue
+		}
+		bestPath, bestType, bestSize = path, thumbnailEncoders[format], info.Size()
+	}
+
+	best, err := os.Open(bestPath)
+	if err != nil {
+		return "", err
+	}
+	defer best.Close()
+	return cfg.saveContentAddressedAsset(best, bestType)
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// uploadRateLimiter gives each user a token bucket of uploads, refilled at
+// rate per second up to burst, so one user can't flood the ffmpeg and S3
+// pipeline. A nil limiter allows everything.
+type uploadRateLimiter struct {
+	rate  float64
+	burst float64
+
+	mu        sync.Mutex
+	buckets   map[uuid.UUID]*uploadBucket
+	lastSweep time.Time
+}
+
+type uploadBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// newUploadRateLimiter allows perMinute uploads per user on average, with
+// bursts of up to burst. It returns nil, no limit, when perMinute isn't
+// positive.
+func newUploadRateLimiter(perMinute float64, burst int) *uploadRateLimiter {
+	if perMinute <= 0 {
+		return nil
+	}
+	return &uploadRateLimiter{
+		rate:      perMinute / 60,
+		burst:     float64(max(burst, 1)),
+		buckets:   make(map[uuid.UUID]*uploadBucket),
+		lastSweep: time.Now(),
+	}
+}
+
+// allow takes a token from userID's bucket. When the bucket is empty it
+// returns false and how long until the next token.
+func (l *uploadRateLimiter) allow(userID uuid.UUID) (bool, time.Duration) {
+	if l == nil {
+		return true, 0
+	}
+	now := time.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.sweep(now)
+
+	b, ok := l.buckets[userID]
+	if !ok {
+		b = &uploadBucket{tokens: l.burst, last: now}
+		l.buckets[userID] = b
+	}
+	b.tokens = min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens < 1 {
+		wait := time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+		return false, wait
+	}
+	b.tokens--
+	return true, 0
+}
+
+// sweep drops buckets that have refilled completely, at most once per
+// refill period. A full bucket is the same as a new one, so nothing is
+// lost and the map only holds recently active users.
+func (l *uploadRateLimiter) sweep(now time.Time) {
+	refill := time.Duration(l.burst / l.rate * float64(time.Second))
+	if now.Sub(l.lastSweep) < refill {
+		return
+	}
+	l.lastSweep = now
+	for userID, b := range l.buckets {
+		if now.Sub(b.last) >= refill {
+			delete(l.buckets, userID)
+		}
+	}
+}
+
+// allowUpload applies the upload rate limit for userID, responding with a
+// 429 and returning false when it's used up.
+func (cfg *apiConfig) allowUpload(w http.ResponseWriter, userID uuid.UUID) bool {
+	ok, retryAfter := cfg.uploadRateLimiter.allow(userID)
+	if !ok {
+		respondWithRetryAfter(w, http.StatusTooManyRequests, retryAfter, "Too many uploads, try again later", nil)
+	}
+	return ok
+}
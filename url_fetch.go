@@ -0,0 +1,110 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"syscall"
+	"time"
+)
+
+// errNonPublicAddress is returned when a fetch would connect somewhere
+// that isn't on the public internet.
+var errNonPublicAddress = errors.New("address is not public")
+
+// nonPublicPrefixes are ranges netip's predicates don't cover that still
+// shouldn't be reachable from a server-side fetch. The IPv6 ones embed
+// IPv4 addresses, which could be private.
+var nonPublicPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"), // carrier-grade NAT
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+	netip.MustParsePrefix("64:ff9b::/96"), // NAT64
+	netip.MustParsePrefix("2002::/16"),    // 6to4
+}
+
+func isPublicAddr(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if !addr.IsGlobalUnicast() || addr.IsPrivate() {
+		return false
+	}
+	for _, prefix := range nonPublicPrefixes {
+		if prefix.Contains(addr) {
+			return false
+		}
+	}
+	return true
+}
+
+// dialPublicOnly refuses connections to non-public addresses. It runs
+// after DNS resolution, for every connection including redirects, so a
+// hostname can't be pointed at an internal address to get around it.
+func dialPublicOnly(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return err
+	}
+	if !isPublicAddr(addr) {
+		return fmt.Errorf("%w: %s", errNonPublicAddress, addr)
+	}
+	return nil
+}
+
+// newURLFetchClient returns the client used to download videos by URL. It
+// only talks HTTPS to public addresses, ignores proxy settings so
+// requests can't be relayed somewhere internal, and gives up on a
+// download after timeout.
+func newURLFetchClient(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{
+		Timeout: 10 * time.Second,
+		Control: dialPublicOnly,
+	}
+	transport := &http.Transport{
+		DialContext:           dialer.DialContext,
+		ForceAttemptHTTP2:     true,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: 30 * time.Second,
+		MaxIdleConns:          10,
+		IdleConnTimeout:       90 * time.Second,
+	}
+	return &http.Client{
+		Transport: transport,
+		Timeout:   timeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 5 {
+				return errors.New("stopped after 5 redirects")
+			}
+			if req.URL.Scheme != "https" {
+				return fmt.Errorf("redirect to non-HTTPS URL %s", req.URL.Redacted())
+			}
+			return nil
+		},
+	}
+}
+
+// parseFetchURL checks a URL a client asked us to download from.
+func parseFetchURL(raw string) (*url.URL, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "https" {
+		return nil, errors.New("URL must use https")
+	}
+	if u.Hostname() == "" {
+		return nil, errors.New("URL has no host")
+	}
+	if u.User != nil {
+		return nil, errors.New("URL must not contain credentials")
+	}
+	return u, nil
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"text/template"
+
+	"github.com/google/uuid"
+)
+
+// videoURLData is what VIDEO_URL_TEMPLATE can reference, e.g.
+// "https://cdn.example.com/v/{{.VideoID}}/{{.Key}}".
+type videoURLData struct {
+	Bucket  string
+	Key     string
+	VideoID uuid.UUID
+}
+
+func parseVideoURLTemplate(text string) (*template.Template, error) {
+	if text == "" {
+		return nil, nil
+	}
+	return template.New("video_url").Option("missingkey=error").Parse(text)
+}
+
+// renderVideoURL builds the public URL for a stored bucket,key through the
+// configured template instead of presigning it.
+func renderVideoURL(tmpl *template.Template, bucket, key string, videoID uuid.UUID) (string, error) {
+	var sb strings.Builder
+	err := tmpl.Execute(&sb, videoURLData{Bucket: bucket, Key: key, VideoID: videoID})
+	if err != nil {
+		return "", fmt.Errorf("render video URL template: %w", err)
+	}
+	return sb.String(), nil
+}
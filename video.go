@@ -4,25 +4,78 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"log"
 	"math"
+	"mime"
 	"os"
 	"os/exec"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
 )
 
-func getVideoAspectRatio(filePath string) (string, error) {
-	cmd := exec.Command(
+// ffprobeOutput holds the parts of `ffprobe -show_streams -show_format`
+// JSON output that we use.
+type ffprobeOutput struct {
+	Streams []struct {
+		CodecType string `json:"codec_type"` // "video", "audio", etc.
+		CodecName string `json:"codec_name"`
+		Width     int    `json:"width"`
+		Height    int    `json:"height"`
+		// Some streams only report coded dimensions
+		CodedWidth  int    `json:"coded_width"`
+		CodedHeight int    `json:"coded_height"`
+		NbFrames    string `json:"nb_frames"`
+		FrameRate   string `json:"avg_frame_rate"` // e.g. "30000/1001"
+		Duration    string `json:"duration"`
+		// Anamorphic video stores non-square pixels, e.g. SAR "4:3";
+		// the shape it's shown at is DAR.
+		SampleAspectRatio  string `json:"sample_aspect_ratio"`
+		DisplayAspectRatio string `json:"display_aspect_ratio"`
+		Tags               struct {
+			Rotate   string `json:"rotate"`
+			Language string `json:"language"`
+		} `json:"tags"`
+		SideDataList []struct {
+			Rotation int `json:"rotation"`
+		} `json:"side_data_list"`
+		// AttachedPic marks cover art in audio files, which ffprobe
+		// reports as a one-frame video stream.
+		Disposition struct {
+			AttachedPic int `json:"attached_pic"`
+		} `json:"disposition"`
+	} `json:"streams"`
+	Format struct {
+		Duration string `json:"duration"`
+		Size     string `json:"size"`
+		BitRate  string `json:"bit_rate"`
+	} `json:"format"`
+}
+
+// probeVideo runs ffprobe on filePath, which may also be a URL. ctx should
+// carry a timeout: a malformed file or a stalled download can otherwise
+// keep ffprobe running forever.
+func probeVideo(ctx context.Context, filePath string) (ffprobeOutput, error) {
+	input, err := ffmpegPath(filePath)
+	if err != nil {
+		return ffprobeOutput{}, err
+	}
+	cmd := exec.CommandContext(
+		ctx,
 		"ffprobe",
 		"-v", "error",
 		"-print_format", "json",
 		"-show_streams",
-		filePath,
+		"-show_format",
+		input,
 	)
 
 	var out bytes.Buffer
@@ -33,130 +86,586 @@ func getVideoAspectRatio(filePath string) (string, error) {
 
 	// Run the command
 	if err := cmd.Run(); err != nil {
-		return "", fmt.Errorf("ffprobe failed: %w; stderr: %s", err, errBuf.String())
-	}
-
-	// Define minimal structs matching the parts of ffprobe's JSON we need
-	type stream struct {
-		CodecType string `json:"codec_type"` // "video", "audio", etc.
-		Width     int    `json:"width"`
-		Height    int    `json:"height"`
-	}
-	type ffprobeOutput struct {
-		Streams []stream `json:"streams"`
+		return ffprobeOutput{}, fmt.Errorf("ffprobe failed: %w", newFFmpegError(ctx, cmd, err, errBuf.String()))
 	}
 
 	// Unmarshal from the byte's buffer
 	var info ffprobeOutput
 	if err := json.Unmarshal(out.Bytes(), &info); err != nil {
-		return "", fmt.Errorf("failed to parse ffprobe to JSON: %w", err)
+		return ffprobeOutput{}, fmt.Errorf("failed to parse ffprobe to JSON: %w", err)
+	}
+	return info, nil
+}
+
+// videoMetadata is what the upload path needs to know about a video file.
+type videoMetadata struct {
+	Width      int
+	Height     int
+	VideoCodec string
+	AudioCodec string
+	Bitrate    int64 // overall bits per second, 0 if unknown
+	FrameCount int64 // frames in the video stream, 0 if unknown
+	// AudioLanguages has one entry per audio track, in stream order;
+	// untagged tracks are "und".
+	AudioLanguages []string
+	// DisplayWidth and DisplayHeight are the shape the video is shown at,
+	// after applying its sample aspect ratio and rotation. Use these to
+	// classify orientation; Width and Height are the stored pixels.
+	DisplayWidth  int
+	DisplayHeight int
+	// AudioOnly is set when there's an audio stream but no real video,
+	// e.g. a podcast episode. Width, Height and FrameCount are then 0.
+	AudioOnly bool
+	// Duration is the container duration in seconds, 0 when the container
+	// doesn't record one.
+	Duration float64
+}
+
+func getVideoMetadata(ctx context.Context, filePath string) (videoMetadata, error) {
+	info, err := probeVideo(ctx, filePath)
+	if err != nil {
+		return videoMetadata{}, err
 	}
 
+	var meta videoMetadata
 	// Find the first video stream with height and width
-	var w, h int
 	for _, s := range info.Streams {
-		if s.CodecType == "video" && s.Width > 0 && s.Height > 0 {
-			w, h = s.Width, s.Height
-			break
+		if s.Width == 0 || s.Height == 0 {
+			s.Width, s.Height = s.CodedWidth, s.CodedHeight
+		}
+		switch {
+		case s.CodecType == "video" && s.Disposition.AttachedPic == 1:
+			// Cover art, not video
+		case s.CodecType == "video" && meta.Width == 0 && s.Width > 0 && s.Height > 0:
+			meta.Width, meta.Height = s.Width, s.Height
+			rotation := 0
+			if r, err := strconv.Atoi(s.Tags.Rotate); err == nil {
+				rotation = r
+			}
+			for _, sd := range s.SideDataList {
+				if sd.Rotation != 0 {
+					rotation = sd.Rotation
+				}
+			}
+			meta.DisplayWidth, meta.DisplayHeight = displayDimensions(s.Width, s.Height, s.SampleAspectRatio, s.DisplayAspectRatio, rotation)
+			meta.VideoCodec = s.CodecName
+			meta.FrameCount = streamFrameCount(s.NbFrames, s.FrameRate, s.Duration, info.Format.Duration)
+		case s.CodecType == "audio":
+			if meta.AudioCodec == "" {
+				meta.AudioCodec = s.CodecName
+			}
+			language := s.Tags.Language
+			if language == "" {
+				language = "und"
+			}
+			meta.AudioLanguages = append(meta.AudioLanguages, language)
+		}
+	}
+	if meta.Width == 0 {
+		if meta.AudioCodec == "" {
+			return videoMetadata{}, fmt.Errorf("no valid video stream found with width and height")
+		}
+		meta.AudioOnly = true
+	}
+	meta.Bitrate = formatBitrate(info)
+	meta.Duration, err = formatDuration(info)
+	if errors.Is(err, errNoDuration) {
+		// Live and some fragmented files just don't say; that's fine
+		err = nil
+	}
+	if err != nil {
+		return videoMetadata{}, err
+	}
+	return meta, nil
+}
+
+// displayDimensions turns stored dimensions into the shown ones. A sample
+// aspect ratio other than 1:1 stretches the width; when SAR is missing
+// ("0:1" or empty) a display aspect ratio is used instead. A quarter-turn
+// rotation swaps the axes.
+func displayDimensions(width, height int, sar, dar string, rotation int) (int, int) {
+	if n, d, ok := parseRatio(sar); ok {
+		width = int(math.Round(float64(width) * n / d))
+	} else if n, d, ok := parseRatio(dar); ok {
+		width = int(math.Round(float64(height) * n / d))
+	}
+	if rotation%180 != 0 {
+		width, height = height, width
+	}
+	return width, height
+}
+
+// parseRatio parses ffprobe's "N:D" ratios, rejecting zero parts.
+func parseRatio(ratio string) (n, d float64, ok bool) {
+	num, den, found := strings.Cut(ratio, ":")
+	if !found {
+		return 0, 0, false
+	}
+	n, errN := strconv.ParseFloat(num, 64)
+	d, errD := strconv.ParseFloat(den, 64)
+	if errN != nil || errD != nil || n <= 0 || d <= 0 {
+		return 0, 0, false
+	}
+	return n, d, true
+}
+
+// streamFrameCount uses the frame count the container records and, when
+// there is none (common for MKV/WebM), estimates it from the average frame
+// rate and the stream or container duration. It returns 0 if neither works.
+func streamFrameCount(nbFrames, frameRate, streamDuration, formatDuration string) int64 {
+	if n, err := strconv.ParseInt(nbFrames, 10, 64); err == nil && n > 0 {
+		return n
+	}
+
+	num, den, ok := strings.Cut(frameRate, "/")
+	if !ok {
+		return 0
+	}
+	n, errN := strconv.ParseFloat(num, 64)
+	d, errD := strconv.ParseFloat(den, 64)
+	if errN != nil || errD != nil || n <= 0 || d <= 0 {
+		return 0
+	}
+
+	duration, err := strconv.ParseFloat(streamDuration, 64)
+	if err != nil || duration <= 0 {
+		duration, err = strconv.ParseFloat(formatDuration, 64)
+		if err != nil || duration <= 0 {
+			return 0
 		}
 	}
-	if w == 0 || h == 0 {
-		return "", fmt.Errorf("no valid video stream found with width and height")
+	return int64(math.Ceil(n / d * duration))
+}
+
+// formatBitrate prefers the container's reported bit_rate and otherwise
+// derives it from size and duration. It returns 0 when neither is usable.
+func formatBitrate(info ffprobeOutput) int64 {
+	if bitrate, err := strconv.ParseInt(info.Format.BitRate, 10, 64); err == nil && bitrate > 0 {
+		return bitrate
+	}
+	size, errSize := strconv.ParseInt(info.Format.Size, 10, 64)
+	duration, errDuration := strconv.ParseFloat(info.Format.Duration, 64)
+	if errSize != nil || errDuration != nil || size <= 0 || duration <= 0 {
+		return 0
 	}
+	return int64(float64(size*8) / duration)
+}
+
+func getVideoAspectRatio(ctx context.Context, filePath string) (string, error) {
+	meta, err := getVideoMetadata(ctx, filePath)
+	if err != nil {
+		return "", err
+	}
+	return aspectRatio(meta.DisplayWidth, meta.DisplayHeight), nil
+}
 
+func aspectRatio(w, h int) string {
 	// Compute aspect ratio
 	const (
 		target169 = 16.0 / 9.0
 		target916 = 9.0 / 16.0
-		eps = 0.02 // 2% tolerance
+		target43  = 4.0 / 3.0
+		target219 = 21.0 / 9.0
+		target11  = 1.0
+		eps       = 0.02 // 2% tolerance
 	)
 
 	r := float64(w) / float64(h)
 
 	switch {
-	case math.Abs(r - target169) < eps:
-		return "16:9", nil
-	case math.Abs(r - target916) < eps:
-		return "9:16", nil
+	case math.Abs(r-target169) < eps:
+		return "16:9"
+	case math.Abs(r-target916) < eps:
+		return "9:16"
+	case math.Abs(r-target43) < eps:
+		return "4:3"
+	case math.Abs(r-target219) < eps:
+		return "21:9"
+	case math.Abs(r-target11) < eps:
+		return "1:1"
+	default:
+		return "other"
+	}
+}
+
+// Ways to lay out the S3 prefix for videos whose aspect ratio isn't one we
+// recognise.
+const (
+	otherAspectFlat       = "flat"       // everything under "other"
+	otherAspectRatio      = "ratio"      // "other/1.85"
+	otherAspectDimensions = "dimensions" // "other/1998x1080"
+)
+
+// otherAspectPrefix is the key prefix for an unrecognised aspect ratio.
+func otherAspectPrefix(mode string, w, h int) string {
+	switch mode {
+	case otherAspectRatio:
+		return fmt.Sprintf("other/%.2f", float64(w)/float64(h))
+	case otherAspectDimensions:
+		return fmt.Sprintf("other/%dx%d", w, h)
 	default:
-		return "other", nil
+		return "other"
+	}
+}
+
+// errNoDuration means the container doesn't record a duration, as with
+// live or some fragmented streams. Callers can treat it as "unknown".
+var errNoDuration = errors.New("video has no duration")
+
+// getVideoDuration returns the container duration in seconds as reported
+// by ffprobe's format section.
+func getVideoDuration(ctx context.Context, filePath string) (float64, error) {
+	info, err := probeVideo(ctx, filePath)
+	if err != nil {
+		return 0, err
+	}
+	return formatDuration(info)
+}
+
+// formatDuration reads the duration from a probe's format section.
+func formatDuration(info ffprobeOutput) (float64, error) {
+	if info.Format.Duration == "" || info.Format.Duration == "N/A" {
+		return 0, errNoDuration
+	}
+	duration, err := strconv.ParseFloat(info.Format.Duration, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration %q: %w", info.Format.Duration, err)
 	}
-	
+	if duration <= 0 {
+		return 0, errNoDuration
+	}
+	return duration, nil
+}
+
+// fastStartMuxer is the container every processed upload is remuxed into,
+// so every stored video carries fastStartExtension.
+const (
+	fastStartMuxer     = "mp4"
+	fastStartExtension = ".mp4"
+)
+
+// Layouts processVideoForFastStart can write.
+const (
+	// fastStartModeFaststart moves the moov box to the front of a regular MP4.
+	fastStartModeFaststart = "faststart"
+	// fastStartModeFragmented writes fragmented MP4, as used by DASH and
+	// HLS with fMP4 segments.
+	fastStartModeFragmented = "fragmented"
+)
+
+// fragmentedMovflags start a new fragment at each keyframe behind an empty
+// moov, which is what fMP4 streaming expects.
+const fragmentedMovflags = "frag_keyframe+empty_moov+default_base_moof"
+
+// fastStartMovflags maps a mode to ffmpeg's -movflags. Unknown modes get
+// faststart.
+func fastStartMovflags(mode string) string {
+	if mode == fastStartModeFragmented {
+		return fragmentedMovflags
+	}
+	return "faststart"
 }
 
 // processVideoForFastStart takes a path to a local (temp) file and produces a new MP4
-// with the "faststart" flag (moov atom moved to the front). It returns the new file path.
-func processVideoForFastStart(filePath string) (string, error) {
+// with the "faststart" flag (moov atom moved to the front), or fragmented MP4 when
+// mode is fastStartModeFragmented. It returns the path of a new temp file,
+// which the caller is responsible for removing; on error nothing is left behind.
+// threads caps ffmpeg's worker threads; 0 lets ffmpeg use every core.
+// streams picks which tracks are kept and whether video is re-encoded.
+func processVideoForFastStart(tempDir, filePath string, threads int, mode string, retry retryPolicy, streams remuxStreams) (string, error) {
 	if filePath == "" {
 		return "", fmt.Errorf("empty input file path")
 	}
-	// Create output path (simple convention: append ".processing")
-	outPath := filePath + ".processing"
-
-	// ffmpeg -i <in> -c copy -movflags faststart -f mp4 <out>
-	cmd := exec.Command(
-		"ffmpeg",
-		"-i", filePath,
-		"-c", "copy",
-		"-movflags", "faststart",
-		"-f", "mp4",
-		outPath,
-	)
-
-	// If you want logs, you can wire these up:
-	// cmd.Stdout = os.Stdout
-	// cmd.Stderr = os.Stderr
+	// A unique name, so concurrent uploads never write to the same output
+	out, err := os.CreateTemp(tempDir, "tubely-processed-*.mp4")
+	if err != nil {
+		return "", fmt.Errorf("create processed file: %w", err)
+	}
+	outPath := out.Name()
+	out.Close()
+	input, err := ffmpegPath(filePath)
+	if err != nil {
+		os.Remove(outPath)
+		return "", err
+	}
+	output, err := ffmpegPath(outPath)
+	if err != nil {
+		os.Remove(outPath)
+		return "", err
+	}
 
-	if err := cmd.Run(); err != nil {
+	// ffmpeg -y -i <in> -c copy -movflags faststart -f mp4 <out>
+	// -y lets a retry overwrite a partial output.
+	err = runFFmpeg(func(ctx context.Context) *exec.Cmd {
+		args := []string{"-y", "-i", input, "-threads", strconv.Itoa(threads)}
+		args = append(args, streams.args()...)
+		args = append(args, "-movflags", fastStartMovflags(mode), "-f", fastStartMuxer, output)
+		return exec.CommandContext(ctx, "ffmpeg", args...)
+	}, retry)
+	if err != nil {
+		os.Remove(outPath)
 		return "", fmt.Errorf("ffmpeg faststart failed: %w", err)
 	}
 	// Basic sanity check that output exists and is non-zero
 	info, err := os.Stat(outPath)
 	if err != nil {
+		os.Remove(outPath)
 		return "", fmt.Errorf("processed file missing: %w", err)
 	}
 	if info.Size() == 0 {
+		os.Remove(outPath)
 		return "", fmt.Errorf("processed file is empty")
 	}
 
 	return outPath, nil
 }
 
-func (cfg *apiConfig) dbVideoToSignedVideo(video database.Video) (database.Video, error) {
-	if video.VideoURL == nil {
-		return video, nil
+// processVideoForFastStartToS3 remuxes filePath into fragmented MP4 and pipes
+// ffmpeg's stdout straight into a multipart upload at key, so no processed
+// copy ever touches the disk. Fragmented MP4 writes its moov box first,
+// which gives the same progressive playback as faststart without needing a
+// seekable output.
+func (cfg *apiConfig) processVideoForFastStartToS3(ctx context.Context, filePath, key, contentType string, streams remuxStreams) error {
+	if filePath == "" {
+		return fmt.Errorf("empty input file path")
 	}
 
-	if *video.VideoURL == "" {
-		return video, fmt.Errorf("video has empty VideoURL")
+	input, err := ffmpegPath(filePath)
+	if err != nil {
+		return err
 	}
 
-	parts := strings.SplitN(*video.VideoURL, ",", 2)
-	if len(parts) != 2 {
-		return video, fmt.Errorf("invalid VideoURL format (want 'bucket,key'), got: %q", video.VideoURL)
+	pr, pw := io.Pipe()
+	args := []string{"-v", "error", "-i", input, "-threads", strconv.Itoa(cfg.ffmpegThreads)}
+	args = append(args, streams.args()...)
+	args = append(args, "-movflags", fragmentedMovflags, "-f", fastStartMuxer, "pipe:1")
+	// Killing ffmpeg closes the pipe with an error, which aborts the upload
+	ffmpegCtx, cancelFFmpeg := commandContext(ctx, cfg.ffmpegRetry.Timeout)
+	defer cancelFFmpeg()
+	cmd := exec.CommandContext(ffmpegCtx, "ffmpeg", args...)
+	cmd.Stdout = pw
+	var errBuf bytes.Buffer
+	cmd.Stderr = &errBuf
+
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("start ffmpeg: %w", err)
 	}
-	bucket := strings.TrimSpace(parts[0])
-	key := strings.TrimSpace(parts[1])
-	if bucket == "" || key == "" {
-		return video, fmt.Errorf("invalid bucket/key parsed from VideoURL: bucket=%q key=%q", bucket, key)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		err := cmd.Wait()
+		if err != nil {
+			err = fmt.Errorf("ffmpeg fragmented remux failed: %w", newFFmpegError(ffmpegCtx, cmd, err, errBuf.String()))
+		}
+		// A nil error surfaces as a clean EOF on the reading side.
+		pw.CloseWithError(err)
+	}()
+
+	// The remuxed size isn't known until ffmpeg finishes
+	uploadCtx, cancel := cfg.s3Context(ctx)
+	defer cancel()
+	err = cfg.uploadMultipart(uploadCtx, key, contentType, pr, -1)
+	// Unblock ffmpeg if the upload gave up early, then wait for it to exit.
+	pr.CloseWithError(err)
+	<-done
+	return err
+}
+
+func (cfg *apiConfig) dbVideoToSignedVideo(ctx context.Context, video database.Video) (database.Video, error) {
+	signed, _, err := cfg.signVideo(ctx, video, dispositionInline)
+	return signed, err
+}
+
+const (
+	dispositionInline     = "inline"
+	dispositionAttachment = "attachment"
+)
+
+// signVideo is dbVideoToSignedVideo with a choice of how the browser
+// treats the video URL: played inline, or downloaded as an attachment
+// under its original filename. It also reports when the first of the
+// signed URLs expires; that is zero if none of them do.
+func (cfg *apiConfig) signVideo(ctx context.Context, video database.Video, disposition string) (database.Video, time.Time, error) {
+	contentDisposition := ""
+	if disposition == dispositionAttachment {
+		contentDisposition = attachmentDisposition(video)
+	}
+	if video.ThumbnailURL != nil {
+		thumbnailURL := thumbnailProxyURL(video.ID)
+		video.ThumbnailURL = &thumbnailURL
 	}
 
-	// Use a sensible default expiry; adjust if you keep this in config.
-	const defaultExpiry = 15 * time.Minute
+	var expiresAt time.Time
+	sign := func(location string, replica *string, contentDisposition string) (string, error) {
+		signedURL, urlExpiresAt, err := cfg.signVideoLocation(ctx, location, replica, video.ID, contentDisposition)
+		if err != nil {
+			return "", err
+		}
+		if !urlExpiresAt.IsZero() && (expiresAt.IsZero() || urlExpiresAt.Before(expiresAt)) {
+			expiresAt = urlExpiresAt
+		}
+		return signedURL, nil
+	}
+	if video.VideoURL != nil {
+		signedURL, err := sign(*video.VideoURL, video.ReplicaURL, contentDisposition)
+		if errors.Is(err, errPresignedURLTooLong) {
+			// The stream proxy serves the same bytes from a short URL
+			cfg.logger.Warn("presigned URL too long, using the stream URL", "video_id", video.ID, "error", err)
+			signedURL, err = "/api/videos/"+video.ID.String()+"/stream", nil
+		}
+		if err != nil {
+			return video, time.Time{}, err
+		}
+		video.VideoURL = &signedURL
+	}
+	if video.IFrameURL != nil {
+		signedURL, err := sign(*video.IFrameURL, nil, "")
+		if err != nil {
+			return video, time.Time{}, err
+		}
+		video.IFrameURL = &signedURL
+	}
+	// The manifest is served through the API, which signs each segment
+	if video.HLSURL != nil {
+		manifestURL := hlsManifestURL(video.ID)
+		video.HLSURL = &manifestURL
+	}
+	if len(video.Renditions) > 0 {
+		// A fresh slice, so the caller's video keeps its locations
+		renditions := make([]database.Rendition, len(video.Renditions))
+		for i, rendition := range video.Renditions {
+			signedURL, err := sign(rendition.URL, nil, "")
+			if err != nil {
+				return video, time.Time{}, err
+			}
+			rendition.URL = signedURL
+			renditions[i] = rendition
+		}
+		video.Renditions = renditions
+	}
+	return video, expiresAt, nil
+}
+
+// attachmentDisposition builds the Content-Disposition for downloading a
+// video, falling back to the video ID when no filename was recorded.
+func attachmentDisposition(video database.Video) string {
+	filename := video.ID.String() + ".mp4"
+	if video.OriginalFilename != nil && *video.OriginalFilename != "" {
+		filename = *video.OriginalFilename
+	}
+	return mime.FormatMediaType(dispositionAttachment, map[string]string{"filename": filename})
+}
+
+// errPresignedURLTooLong is returned when a presigned URL is longer than
+// MAX_PRESIGNED_URL_LENGTH, which some legacy clients would truncate.
+var errPresignedURLTooLong = errors.New("presigned URL too long")
 
-	signedURL, err := generatePresignedURL(cfg.s3Client, bucket, key, defaultExpiry)
+const (
+	// defaultPresignExpiry is how long presigned video URLs stay valid
+	// unless PRESIGN_EXPIRY says otherwise.
+	defaultPresignExpiry = 15 * time.Minute
+	// defaultUploadPresignExpiry is how long presigned upload part URLs
+	// stay valid unless UPLOAD_PRESIGN_EXPIRY says otherwise. Uploading
+	// takes longer than starting playback, so it's longer.
+	defaultUploadPresignExpiry = time.Hour
+	// maxPresignExpiry is the longest S3 accepts for a presigned URL.
+	maxPresignExpiry = 7 * 24 * time.Hour
+)
+
+// presignExpiryFromEnv reads a presigned URL lifetime from the named
+// variable. Values S3 would reject, zero or negative or over 7 days, use
+// fallback.
+func presignExpiryFromEnv(name string, fallback time.Duration) time.Duration {
+	expiry := envDuration(name, fallback)
+	if expiry <= 0 || expiry > maxPresignExpiry {
+		log.Printf("%s %s out of range, using default %s", name, expiry, fallback)
+		return fallback
+	}
+	return expiry
+}
+
+// signVideoLocation turns a stored "bucket,key" into a URL clients can
+// fetch, reading from replica if the primary object is gone. A non-empty
+// contentDisposition is signed in as the response's Content-Disposition.
+// expiresAt is when the URL stops working, or zero if it doesn't expire.
+func (cfg *apiConfig) signVideoLocation(ctx context.Context, location string, replica *string, videoID uuid.UUID, contentDisposition string) (signedURL string, expiresAt time.Time, err error) {
+	// A URL template replaces presigning; the stored bucket,key is untouched.
+	// Templated URLs can't carry response overrides, so the disposition is
+	// left to whatever serves them.
+	if cfg.videoURLTemplate != nil {
+		bucket, key, err := parseVideoLocation(location)
+		if err != nil {
+			return "", time.Time{}, err
+		}
+		signedURL, err := renderVideoURL(cfg.videoURLTemplate, bucket, key, videoID)
+		return signedURL, time.Time{}, err
+	}
+
+	// CloudFront serves the primary bucket, so there's no replica fallback,
+	// and like templated URLs it can't carry the disposition
+	if cfg.cloudFront != nil {
+		_, key, err := parseVideoLocation(location)
+		if err != nil {
+			return "", time.Time{}, err
+		}
+		expiresAt := time.Now().Add(cfg.presignExpiry)
+		signedURL, err := cfg.cloudFront.sign(key, expiresAt)
+		return signedURL, expiresAt, err
+	}
+
+	ctx, cancel := cfg.s3Context(ctx)
+	defer cancel()
+	bucket, key, err := parseVideoLocation(location)
 	if err != nil {
-		return video, fmt.Errorf("presigning S3 URL: %w", err)
+		return "", time.Time{}, err
 	}
 
-	video.VideoURL = &signedURL
-	return video, nil
+	// URLs are cached under the primary location, so whether to sign the
+	// replica instead is only checked when signing afresh, at most once a
+	// reuse window per object
+	signedURL, signedAt, err := cfg.presignCache.get(bucket, key, contentDisposition, cfg.presignExpiry, func() (string, error) {
+		readBucket, readKey, client, err := cfg.readableVideoLocation(ctx, location, replica)
+		if err != nil {
+			return "", err
+		}
+		return generatePresignedURL(ctx, client, readBucket, readKey, contentDisposition, cfg.presignExpiry)
+	})
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("presigning S3 URL: %w", err)
+	}
+	if cfg.maxPresignedURLLength > 0 && len(signedURL) > cfg.maxPresignedURLLength {
+		return "", time.Time{}, fmt.Errorf("%w: %d characters, limit %d", errPresignedURLTooLong, len(signedURL), cfg.maxPresignedURLLength)
+	}
+	return signedURL, signedAt.Add(cfg.presignExpiry), nil
 }
 
+// parseVideoLocation splits a stored VideoURL of the form "bucket,key".
+// Videos uploaded before locations were stored that way have a full S3
+// object URL instead, which is accepted too.
+func parseVideoLocation(videoURL string) (bucket, key string, err error) {
+	if videoURL == "" {
+		return "", "", fmt.Errorf("video has empty VideoURL")
+	}
+	if strings.HasPrefix(videoURL, "https://") || strings.HasPrefix(videoURL, "http://") {
+		return parseS3ObjectURL(videoURL)
+	}
+
+	parts := strings.SplitN(videoURL, ",", 2)
+	if len(parts) != 2 {
+		return "", "", fmt.Errorf("invalid VideoURL format (want 'bucket,key'), got: %q", videoURL)
+	}
+	bucket = strings.TrimSpace(parts[0])
+	key = strings.TrimSpace(parts[1])
+	if bucket == "" || key == "" {
+		return "", "", fmt.Errorf("invalid bucket/key parsed from VideoURL: bucket=%q key=%q", bucket, key)
+	}
+	return bucket, key, nil
+}
 
 // generatePresignedURL builds a GET pre-signed URL for an S3 object.
-// Expiration is clamped to S3's maximum of 7 days.
-func generatePresignedURL(s3Client *s3.Client, bucket, key string, expireTime time.Duration) (string, error) {
+// Expiration is clamped to S3's maximum of 7 days. A non-empty
+// contentDisposition overrides the Content-Disposition S3 responds with.
+func generatePresignedURL(ctx context.Context, s3Client *s3.Client, bucket, key, contentDisposition string, expireTime time.Duration) (string, error) {
 	if s3Client == nil {
 		return "", fmt.Errorf("s3Client is nil")
 	}
@@ -164,21 +673,25 @@ func generatePresignedURL(s3Client *s3.Client, bucket, key string, expireTime ti
 		return "", fmt.Errorf("bucket and key are required")
 	}
 	if expireTime <= 0 {
-		expireTime = 15 * time.Minute
+		expireTime = defaultPresignExpiry
+	}
+	if expireTime > maxPresignExpiry {
+		expireTime = maxPresignExpiry
+	}
+
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
 	}
-	const maxTTL = 7 * 24 * time.Hour
-	if expireTime > maxTTL {
-		expireTime = maxTTL
+	if contentDisposition != "" {
+		input.ResponseContentDisposition = aws.String(contentDisposition)
 	}
 
 	presigner := s3.NewPresignClient(s3Client)
 
 	out, err := presigner.PresignGetObject(
-		context.Background(),
-		&s3.GetObjectInput{
-			Bucket: aws.String(bucket),
-			Key:    aws.String(key),
-		},
+		ctx,
+		input,
 		s3.WithPresignExpires(expireTime),
 	)
 	if err != nil {
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// fakeFFprobe puts an ffprobe on PATH that prints output, whatever it's
+// asked.
+func fakeFFprobe(t *testing.T, output string) {
+	t.Helper()
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "ffprobe.json"), []byte(output), 0o644); err != nil {
+		t.Fatalf("write ffprobe output: %v", err)
+	}
+	script := "#!/bin/sh\ncat '" + filepath.Join(dir, "ffprobe.json") + "'\n"
+	if err := os.WriteFile(filepath.Join(dir, "ffprobe"), []byte(script), 0o755); err != nil {
+		t.Fatalf("write fake ffprobe: %v", err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+func TestGetVideoAspectRatioRotated(t *testing.T) {
+	tests := []struct {
+		name   string
+		output string
+		want   string
+	}{
+		{
+			name:   "landscape",
+			output: `{"streams":[{"codec_type":"video","width":1920,"height":1080}],"format":{"duration":"10.0"}}`,
+			want:   "16:9",
+		},
+		{
+			name:   "rotate tag",
+			output: `{"streams":[{"codec_type":"video","width":1920,"height":1080,"tags":{"rotate":"90"}}],"format":{"duration":"10.0"}}`,
+			want:   "9:16",
+		},
+		{
+			name:   "display matrix",
+			output: `{"streams":[{"codec_type":"video","width":1920,"height":1080,"side_data_list":[{"side_data_type":"Display Matrix","rotation":-90}]}],"format":{"duration":"10.0"}}`,
+			want:   "9:16",
+		},
+		{
+			name:   "upside down",
+			output: `{"streams":[{"codec_type":"video","width":1920,"height":1080,"side_data_list":[{"rotation":180}]}],"format":{"duration":"10.0"}}`,
+			want:   "16:9",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fakeFFprobe(t, tt.output)
+			got, err := getVideoAspectRatio(context.Background(), filepath.Join(t.TempDir(), "video.mp4"))
+			if err != nil {
+				t.Fatalf("getVideoAspectRatio() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("getVideoAspectRatio() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"sync"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// videoQueue processes uploads on a fixed pool of workers, so the upload
+// request can return as soon as the file is received. The queue is
+// bounded; when it's full, uploads are turned away rather than piling up
+// on disk.
+type videoQueue struct {
+	jobs chan uploadJob
+	wg   sync.WaitGroup
+	// cancel stops the jobs still running when shutdown runs out of time.
+	cancel context.CancelFunc
+
+	mu     sync.RWMutex
+	closed bool
+}
+
+// newVideoQueue starts workers goroutines running process on queued jobs.
+// It returns nil, meaning uploads are processed in the request, when
+// workers isn't positive.
+func newVideoQueue(workers, size int, process func(context.Context, uploadJob)) *videoQueue {
+	if workers <= 0 {
+		return nil
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	q := &videoQueue{jobs: make(chan uploadJob, max(size, 0)), cancel: cancel}
+	for range workers {
+		q.wg.Add(1)
+		go func() {
+			defer q.wg.Done()
+			for job := range q.jobs {
+				process(ctx, job)
+			}
+		}()
+	}
+	return q
+}
+
+// enqueue adds a job without blocking. It returns false when the queue is
+// full or shutting down.
+func (q *videoQueue) enqueue(job uploadJob) bool {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	if q.closed {
+		return false
+	}
+	select {
+	case q.jobs <- job:
+		return true
+	default:
+		return false
+	}
+}
+
+// shutdown stops taking jobs and waits for the workers to finish every
+// job already queued. If ctx ends first, the remaining jobs are cancelled
+// and it waits for the workers to record them as failed.
+func (q *videoQueue) shutdown(ctx context.Context) error {
+	q.mu.Lock()
+	if !q.closed {
+		q.closed = true
+		close(q.jobs)
+	}
+	q.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		q.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		q.cancel()
+		<-done
+		return ctx.Err()
+	}
+}
+
+// processQueuedUpload is the worker side of an upload: it runs the same
+// processing as a synchronous upload and records the outcome as the
+// video's status. Jobs aren't tied to a request; ctx only ends when
+// shutdown gives up waiting, and a job cut short that way is failed like
+// any other. The pipeline limits still apply, but a job waits for a slot
+// rather than failing. The upload's locks are released once it's done.
+func (cfg *apiConfig) processQueuedUpload(ctx context.Context, job uploadJob) {
+	if job.unlock != nil {
+		defer job.unlock()
+	}
+	video, err := cfg.processUpload(ctx, job)
+	if err != nil && ctx.Err() != nil {
+		job.logger.Warn("processing video cancelled by shutdown", "error", err)
+		cfg.setVideoStatus(&job.video, database.VideoStatusFailed)
+		return
+	}
+	if err != nil {
+		job.logger.Error("processing video failed", "error", err)
+		cfg.setVideoStatus(&job.video, database.VideoStatusFailed)
+		return
+	}
+	cfg.setVideoStatus(&video, database.VideoStatusReady)
+}
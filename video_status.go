@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// videoStatusHeader repeats the status on every response, so a HEAD
+// request is enough to poll it.
+const videoStatusHeader = "X-Video-Status"
+
+// setVideoStatus records status on the video. A status that can't be
+// saved is logged rather than failing the upload it describes.
+func (cfg *apiConfig) setVideoStatus(video *database.Video, status database.VideoStatus) {
+	if err := cfg.db.SetVideoStatus(video.ID, status); err != nil {
+		cfg.logger.Error("recording video status failed", "video_id", video.ID, "status", status, "error", err)
+		return
+	}
+	video.Status = status
+}
+
+// trackUploadStatus marks video as uploading and returns a func to defer,
+// which marks it failed unless done was set by then.
+func (cfg *apiConfig) trackUploadStatus(video *database.Video, done *bool) func() {
+	cfg.setVideoStatus(video, database.VideoStatusUploading)
+	return func() {
+		if !*done {
+			cfg.setVideoStatus(video, database.VideoStatusFailed)
+		}
+	}
+}
+
+// handlerVideoStatus returns just the status of one of the caller's
+// videos, for polling while an upload is processed. While this server is
+// processing it, eta_seconds estimates how long that has left. GET routes
+// also answer HEAD, which gets only the X-Video-Status header.
+func (cfg *apiConfig) handlerVideoStatus(w http.ResponseWriter, r *http.Request) {
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid video ID", err)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret, cfg.jwtExpectations)
+	if err != nil {
+		respondWithJWTError(w, err)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if video.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
+	if video.UserID != userID {
+		respondWithError(w, http.StatusUnauthorized, "You can't view this video", nil)
+		return
+	}
+
+	type response struct {
+		Status     database.VideoStatus `json:"status"`
+		ETASeconds *int64               `json:"eta_seconds,omitempty"`
+	}
+	resp := response{Status: video.Status}
+	if video.Status == database.VideoStatusProcessing {
+		if job, ahead, ok := cfg.processingProgress.lookup(videoID); ok {
+			eta := int64(cfg.processingETA.estimate(job, ahead, time.Now()).Round(time.Second).Seconds())
+			resp.ETASeconds = &eta
+		}
+	}
+	w.Header().Set(videoStatusHeader, string(video.Status))
+	w.Header().Set("Cache-Control", "no-store")
+	respondWithJSON(w, http.StatusOK, resp)
+}
@@ -0,0 +1,69 @@
+package main
+
+import "testing"
+
+func TestAspectRatio(t *testing.T) {
+	tests := []struct {
+		name          string
+		width, height int
+		want          string
+	}{
+		{"1080p", 1920, 1080, "16:9"},
+		{"720p", 1280, 720, "16:9"},
+		{"odd 16:9 encode", 854, 480, "16:9"},
+		{"vertical", 1080, 1920, "9:16"},
+		{"4:3", 640, 480, "4:3"},
+		{"21:9", 2520, 1080, "21:9"},
+		{"square", 1080, 1080, "1:1"},
+		{"nearly square", 1080, 1070, "1:1"},
+		{"cinemascope", 2048, 858, "other"},
+		{"3:2", 1500, 1000, "other"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := aspectRatio(tt.width, tt.height); got != tt.want {
+				t.Errorf("aspectRatio(%d, %d) = %q, want %q", tt.width, tt.height, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseVideoLocation(t *testing.T) {
+	tests := []struct {
+		name       string
+		location   string
+		wantBucket string
+		wantKey    string
+		wantErr    bool
+	}{
+		{name: "bucket,key", location: "tubely-videos,landscape/abc.mp4", wantBucket: "tubely-videos", wantKey: "landscape/abc.mp4"},
+		{name: "virtual-hosted URL", location: "https://tubely-videos.s3.us-east-2.amazonaws.com/landscape/abc.mp4", wantBucket: "tubely-videos", wantKey: "landscape/abc.mp4"},
+		{name: "dotted bucket", location: "https://videos.example.com.s3.us-east-2.amazonaws.com/abc.mp4", wantBucket: "videos.example.com", wantKey: "abc.mp4"},
+		{name: "legacy regional host", location: "https://tubely-videos.s3-us-west-1.amazonaws.com/abc.mp4", wantBucket: "tubely-videos", wantKey: "abc.mp4"},
+		{name: "path-style URL", location: "https://s3.us-east-1.amazonaws.com/tubely-videos/landscape/abc.mp4", wantBucket: "tubely-videos", wantKey: "landscape/abc.mp4"},
+		{name: "escaped key", location: "https://tubely-videos.s3.cn-north-1.amazonaws.com.cn/my%20clip.mp4", wantBucket: "tubely-videos", wantKey: "my clip.mp4"},
+		{name: "empty", location: "", wantErr: true},
+		{name: "no comma", location: "tubely-videos", wantErr: true},
+		{name: "missing key", location: "tubely-videos,", wantErr: true},
+		{name: "not S3", location: "https://example.com/abc.mp4", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bucket, key, err := parseVideoLocation(tt.location)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parseVideoLocation(%q) = %q, %q, want an error", tt.location, bucket, key)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseVideoLocation(%q) error = %v", tt.location, err)
+			}
+			if bucket != tt.wantBucket || key != tt.wantKey {
+				t.Errorf("parseVideoLocation(%q) = %q, %q, want %q, %q", tt.location, bucket, key, tt.wantBucket, tt.wantKey)
+			}
+		})
+	}
+}
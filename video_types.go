@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"strings"
+)
+
+// Container families that sniffContainer can tell apart. MP4 and QuickTime
+// are both ISO base media files and look the same up front.
+const (
+	containerISOBMFF = "isobmff"
+	containerWebM    = "webm"
+)
+
+// videoTypeContainers maps each upload type this server knows how to
+// process to the container its bytes must be in.
+var videoTypeContainers = map[string]string{
+	"video/mp4":       containerISOBMFF,
+	"audio/mp4":       containerISOBMFF,
+	"video/quicktime": containerISOBMFF,
+	"video/webm":      containerWebM,
+}
+
+// isMP4Type reports whether uploads of this type are already MP4. Anything
+// else is transcoded into MP4, which is all that's ever stored.
+func isMP4Type(mimeType string) bool {
+	return mimeType == "video/mp4" || mimeType == "audio/mp4"
+}
+
+// acceptedVideoTypesFromEnv reads ACCEPTED_VIDEO_TYPES, a comma-separated
+// list of MIME types that defaults to MP4 only. Types this server can't
+// process are logged and ignored.
+func acceptedVideoTypesFromEnv() map[string]bool {
+	raw := os.Getenv("ACCEPTED_VIDEO_TYPES")
+	if raw == "" {
+		raw = "video/mp4,audio/mp4"
+	}
+	accepted := map[string]bool{}
+	for _, mimeType := range strings.Split(raw, ",") {
+		mimeType = strings.ToLower(strings.TrimSpace(mimeType))
+		if mimeType == "" {
+			continue
+		}
+		if _, known := videoTypeContainers[mimeType]; !known {
+			log.Printf("Ignoring unsupported type %q in ACCEPTED_VIDEO_TYPES", mimeType)
+			continue
+		}
+		accepted[mimeType] = true
+	}
+	return accepted
+}
+
+// isoBMFFBoxes are box types an MP4 or QuickTime file can start with.
+// MP4 always leads with "ftyp"; older QuickTime files may not have one.
+var isoBMFFBoxes = map[string]bool{
+	"ftyp": true,
+	"moov": true,
+	"mdat": true,
+	"wide": true,
+	"free": true,
+	"skip": true,
+}
+
+// ebmlMagic starts every Matroska and WebM file.
+var ebmlMagic = []byte{0x1A, 0x45, 0xDF, 0xA3}
+
+// sniffContainer identifies a file's container from its first bytes, or
+// returns "" if it isn't one we process. It rewinds the file so it can
+// still be read from the start.
+func sniffContainer(file io.ReadSeeker) (string, error) {
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	head := make([]byte, 512)
+	n, err := io.ReadFull(file, head)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return "", err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	head = head[:n]
+
+	switch {
+	// A box is a 4-byte size followed by its 4-byte type
+	case len(head) >= 8 && isoBMFFBoxes[string(head[4:8])]:
+		return containerISOBMFF, nil
+	case bytes.HasPrefix(head, ebmlMagic):
+		return containerWebM, nil
+	default:
+		return "", nil
+	}
+}